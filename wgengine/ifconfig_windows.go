@@ -6,13 +6,10 @@
 package wgengine
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"net"
-	"sort"
 	"time"
 	"unsafe"
 
@@ -23,6 +20,7 @@ import (
 	"github.com/tailscale/wireguard-go/wgcfg"
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
+	"tailscale.com/logger"
 	"tailscale.com/wgengine/winnet"
 )
 
@@ -37,7 +35,7 @@ func htonl(val uint32) uint32 {
 	return *(*uint32)(unsafe.Pointer(&bytes[0]))
 }
 
-func bindSocketRoute(family winipcfg.AddressFamily, device *device.Device, ourLuid uint64, lastLuid *uint64) error {
+func bindSocketRoute(logf logger.Logf, family winipcfg.AddressFamily, device *device.Device, ourLuid uint64, lastLuid *uint64) error {
 	routes, err := winipcfg.GetRoutes(family)
 	if err != nil {
 		return err
@@ -67,12 +65,12 @@ func bindSocketRoute(family winipcfg.AddressFamily, device *device.Device, ourLu
 			return device.BindSocketToInterface6(index, false)
 		}
 	} else {
-		log.Printf("WARNING: skipping windows socket binding.\n")
+		logf("WARNING: skipping windows socket binding.\n")
 	}
 	return nil
 }
 
-func MonitorDefaultRoutes(device *device.Device, autoMTU bool, tun *tun.NativeTun) (*winipcfg.RouteChangeCallback, error) {
+func MonitorDefaultRoutes(logf logger.Logf, device *device.Device, autoMTU bool, tun *tun.NativeTun) (*winipcfg.RouteChangeCallback, error) {
 	guid := tun.GUID()
 	ourLuid, err := winipcfg.InterfaceGuidToLuid(&guid)
 	lastLuid4 := uint64(0)
@@ -82,11 +80,11 @@ func MonitorDefaultRoutes(device *device.Device, autoMTU bool, tun *tun.NativeTu
 		return nil, err
 	}
 	doIt := func() error {
-		err = bindSocketRoute(winipcfg.AF_INET, device, ourLuid, &lastLuid4)
+		err = bindSocketRoute(logf, winipcfg.AF_INET, device, ourLuid, &lastLuid4)
 		if err != nil {
 			return err
 		}
-		err = bindSocketRoute(winipcfg.AF_INET6, device, ourLuid, &lastLuid6)
+		err = bindSocketRoute(logf, winipcfg.AF_INET6, device, ourLuid, &lastLuid6)
 		if err != nil {
 			return err
 		}
@@ -158,13 +156,13 @@ func MonitorDefaultRoutes(device *device.Device, autoMTU bool, tun *tun.NativeTu
 	return cb, nil
 }
 
-func setDNSDomains(g windows.GUID, dnsDomains []string) {
+func setDNSDomains(logf logger.Logf, g windows.GUID, dnsDomains []string) {
 	gs := g.String()
-	log.Printf("setDNSDomains(%v) guid=%v\n", dnsDomains, gs)
+	logf("setDNSDomains(%v) guid=%v\n", dnsDomains, gs)
 	p := `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters\Interfaces\` + gs
 	key, err := registry.OpenKey(registry.LOCAL_MACHINE, p, registry.READ|registry.SET_VALUE)
 	if err != nil {
-		log.Printf("setDNSDomains(%v): open: %v\n", p, err)
+		logf("setDNSDomains(%v): open: %v\n", p, err)
 		return
 	}
 	defer key.Close()
@@ -176,11 +174,11 @@ func setDNSDomains(g windows.GUID, dnsDomains []string) {
 	}
 	err = key.SetStringValue("Domain", dom)
 	if err != nil {
-		log.Printf("setDNSDomains(%v): SetStringValue: %v\n", p, err)
+		logf("setDNSDomains(%v): SetStringValue: %v\n", p, err)
 	}
 }
 
-func setFirewall(ifcGUID *windows.GUID) (bool, error) {
+func setFirewall(logf logger.Logf, ifcGUID *windows.GUID) (bool, error) {
 	c := ole.Connection{}
 	err := c.Initialize()
 	if err != nil {
@@ -206,10 +204,10 @@ func setFirewall(ifcGUID *windows.GUID) (bool, error) {
 			panic(err)
 		}
 		if aid != ifcGUID.String() {
-			log.Printf("skipping adapter id: %v\n", aid)
+			logf("skipping adapter id: %v\n", aid)
 			continue
 		}
-		log.Printf("found! adapter id: %v\n", aid)
+		logf("found! adapter id: %v\n", aid)
 
 		n, err := nco.GetNetwork()
 		if err != nil {
@@ -228,7 +226,7 @@ func setFirewall(ifcGUID *windows.GUID) (bool, error) {
 				return false, fmt.Errorf("SetCategory: %v", err)
 			}
 		} else {
-			log.Printf("setFirewall: already category %v\n", cat)
+			logf("setFirewall: already category %v\n", cat)
 		}
 
 		return true, nil
@@ -237,10 +235,13 @@ func setFirewall(ifcGUID *windows.GUID) (bool, error) {
 	return false, nil
 }
 
-func ConfigureInterface(m *wgcfg.Config, tun *tun.NativeTun, dns []net.IP, dnsDomains []string) error {
+// ConfigureInterface configures tun for m and the given DNS settings.
+// st is the configuration applied by the previous call, and is
+// updated so that only changes are made each time.
+func ConfigureInterface(logf logger.Logf, st *adapterConfig, m *wgcfg.Config, tun *tun.NativeTun, dns []net.IP, dnsDomains []string) error {
 	const mtu = 0
 	guid := tun.GUID()
-	log.Printf("wintun GUID is %v\n", guid)
+	logf("wintun GUID is %v\n", guid)
 	iface, err := winipcfg.InterfaceFromGUID(&guid)
 	if err != nil {
 		return err
@@ -251,9 +252,9 @@ func ConfigureInterface(m *wgcfg.Config, tun *tun.NativeTun, dns []net.IP, dnsDo
 		// new interface has come up. Poll periodically until it
 		// does.
 		for i := 0; i < 20; i++ {
-			found, err := setFirewall(&guid)
+			found, err := setFirewall(logf, &guid)
 			if err != nil {
-				log.Printf("setFirewall: %v\n", err)
+				logf("setFirewall: %v\n", err)
 				// fall through anyway, this isn't fatal.
 			}
 			if found {
@@ -263,116 +264,34 @@ func ConfigureInterface(m *wgcfg.Config, tun *tun.NativeTun, dns []net.IP, dnsDo
 		}
 	}()
 
-	setDNSDomains(guid, dnsDomains)
-
-	routes := []winipcfg.RouteData{}
-	var firstGateway4 *net.IP
-	var firstGateway6 *net.IP
-	addresses := make([]*net.IPNet, len(m.Interface.Addresses))
-	for i, addr := range m.Interface.Addresses {
-		ipnet := addr.IPNet()
-		addresses[i] = ipnet
-		gateway := ipnet.IP
-		if addr.IP.Is4() && firstGateway4 == nil {
-			firstGateway4 = &gateway
-		} else if addr.IP.Is6() && firstGateway6 == nil {
-			firstGateway6 = &gateway
-		}
+	var errAcc error
+	err = st.apply(logf, winipcfgHelper{logf: logf, iface: iface, guid: guid}, m, dns, dnsDomains)
+	if err != nil {
+		logf("apply: %v\n", err)
+		errAcc = err
 	}
 
 	foundDefault4 := false
 	foundDefault6 := false
 	for _, peer := range m.Peers {
 		for _, allowedip := range peer.AllowedIPs {
-			if (allowedip.IP.Is4() && firstGateway4 == nil) || (allowedip.IP.Is6() && firstGateway6 == nil) {
-				return errors.New("Due to a Windows limitation, one cannot have interface routes without an interface address")
-			}
-
-			ipn := allowedip.IPNet()
-			var gateway net.IP
-			if allowedip.IP.Is4() {
-				gateway = *firstGateway4
-			} else if allowedip.IP.Is6() {
-				gateway = *firstGateway6
-			}
-			r := winipcfg.RouteData{
-				Destination: net.IPNet{
-					IP:   ipn.IP.Mask(ipn.Mask),
-					Mask: ipn.Mask,
-				},
-				NextHop: gateway,
-				Metric:  0,
-			}
-			if bytes.Compare(r.Destination.IP, gateway) == 0 {
-				// no need to add a route for the interface's
-				// own IP. The kernel does that for us.
-				// If we try to replace it, we'll fail to
-				// add the route unless NextHop is set, but
-				// then the interface's IP won't be pingable.
+			if allowedip.Mask != 0 {
 				continue
 			}
 			if allowedip.IP.Is4() {
-				if allowedip.Mask == 0 {
-					foundDefault4 = true
-				}
-				r.NextHop = *firstGateway4
+				foundDefault4 = true
 			} else if allowedip.IP.Is6() {
-				if allowedip.Mask == 0 {
-					foundDefault6 = true
-				}
-				r.NextHop = *firstGateway6
+				foundDefault6 = true
 			}
-			routes = append(routes, r)
 		}
 	}
 
-	err = iface.SetAddresses(addresses)
-	if err != nil {
-		return err
-	}
-
-	sort.Slice(routes, func(i, j int) bool {
-		return (bytes.Compare(routes[i].Destination.IP, routes[j].Destination.IP) == -1 ||
-			// Narrower masks first
-			bytes.Compare(routes[i].Destination.Mask, routes[j].Destination.Mask) == 1 ||
-			// No nexthop before non-empty nexthop
-			bytes.Compare(routes[i].NextHop, routes[j].NextHop) == -1 ||
-			// Lower metrics first
-			routes[i].Metric < routes[j].Metric)
-	})
-
-	deduplicatedRoutes := []*winipcfg.RouteData{}
-	for i := 0; i < len(routes); i++ {
-		// There's only one way to get to a given IP+Mask, so delete
-		// all matches after the first.
-		if i > 0 &&
-			bytes.Equal(routes[i].Destination.IP, routes[i-1].Destination.IP) &&
-			bytes.Equal(routes[i].Destination.Mask, routes[i-1].Destination.Mask) {
-			continue
-		}
-		deduplicatedRoutes = append(deduplicatedRoutes, &routes[i])
-	}
-	log.Printf("routes: %v\n", routes)
-
-	var errAcc error
-	err = iface.SetRoutes(deduplicatedRoutes)
-	if err != nil && errAcc == nil {
-		log.Printf("setroutes: %v\n", err)
-		errAcc = err
-	}
-
-	err = iface.SetDNS(dns)
-	if err != nil && errAcc == nil {
-		log.Printf("setdns: %v\n", err)
-		errAcc = err
-	}
-
 	ipif, err := iface.GetIpInterface(winipcfg.AF_INET)
 	if err != nil {
-		log.Printf("getipif: %v\n", err)
+		logf("getipif: %v\n", err)
 		return err
 	}
-	log.Printf("foundDefault4: %v\n", foundDefault4)
+	logf("foundDefault4: %v\n", foundDefault4)
 	if foundDefault4 {
 		ipif.UseAutomaticMetric = false
 		ipif.Metric = 0
@@ -409,3 +328,56 @@ func ConfigureInterface(m *wgcfg.Config, tun *tun.NativeTun, dns []net.IP, dnsDo
 
 	return errAcc
 }
+
+// winipcfgHelper is the ipHelper for a Windows adapter.
+//
+// Flush clears the adapter the first time its settings are applied,
+// and again on each winRouter.Reload. AddAddress and AddRoute still
+// succeed if what they add is already there, in case Windows put it
+// back in between.
+type winipcfgHelper struct {
+	logf  logger.Logf
+	iface *winipcfg.Interface
+	guid  windows.GUID
+}
+
+func (h winipcfgHelper) Flush() error {
+	if err := h.iface.FlushAddresses(); err != nil {
+		return err
+	}
+	return h.iface.FlushRoutes()
+}
+
+func (h winipcfgHelper) AddAddress(addr *net.IPNet) error {
+	return ignoreExists(h.iface.AddAddresses([]*net.IPNet{addr}))
+}
+
+func (h winipcfgHelper) DeleteAddress(ip net.IP) error {
+	return h.iface.DeleteAddress(&ip)
+}
+
+func (h winipcfgHelper) AddRoute(dst *net.IPNet, nextHop net.IP) error {
+	return ignoreExists(h.iface.AddRoute(&winipcfg.RouteData{
+		Destination: *dst,
+		NextHop:     nextHop,
+		Metric:      0,
+	}))
+}
+
+// ignoreExists returns err, or nil if err is because the object
+// being added already exists.
+func ignoreExists(err error) error {
+	if errors.Is(err, windows.ERROR_OBJECT_ALREADY_EXISTS) {
+		return nil
+	}
+	return err
+}
+
+func (h winipcfgHelper) DeleteRoute(dst *net.IPNet, nextHop net.IP) error {
+	return h.iface.DeleteRoute(dst, &nextHop)
+}
+
+func (h winipcfgHelper) SetDNS(servers []net.IP, domains []string) error {
+	setDNSDomains(h.logf, h.guid, domains)
+	return h.iface.SetDNS(servers)
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"time"
+
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/logger"
+)
+
+// RouterOptions are the settings a Router is made with. Only Logf and
+// TunName are needed; the zero value of every other field gives the
+// router's default behavior. Routers ignore the settings that don't
+// apply to their platform: most of those after NetChanged are only
+// supported on Linux.
+type RouterOptions struct {
+	Logf    logger.Logf
+	TunName string         // the tun device to configure
+	Device  *device.Device // the WireGuard device, if any
+	Tun     tun.Device     // the tun device itself, if any
+
+	// NetChanged, if non-nil, is called when the system's network
+	// configuration changes.
+	NetChanged func()
+
+	// MTU is the MTU to set on the tun device. If zero, it's 1280.
+	MTU int
+
+	// ProbePathMTU, if MTU isn't set, sizes the tun MTU for the
+	// MTU of the egress interface, so that jumbo frames are used
+	// where the underlay has them.
+	ProbePathMTU bool
+
+	// TxQueueLen, if non-zero, is the transmit queue length to set
+	// on the tun device. Busy subnet routers may need more than
+	// the kernel's default to not drop packets under load.
+	TxQueueLen int
+
+	// NoARP turns off ARP on the tun device, which has no
+	// neighbors to find.
+	NoARP bool
+
+	// HostAddrs adds the tun device's addresses as host addresses,
+	// with a route for the network of each, rather than letting
+	// the kernel derive the on-link route from the address's mask.
+	HostAddrs bool
+
+	// RouteTable, if non-zero, is the routing table to add routes
+	// to. With FwMark also set, packets with that firewall mark are
+	// routed with the table.
+	RouteTable int
+	FwMark     uint32
+
+	// RouteMetric, if non-zero, is the metric to add routes with.
+	RouteMetric int
+
+	// RouteOnlink adds routes with a gateway "onlink".
+	RouteOnlink bool
+
+	// RouteTailscaleRanges also adds a route for each of the whole
+	// Tailscale address ranges, 100.64.0.0/10 and
+	// fd7a:115c:a1e0::/48, so that every Tailscale address goes to
+	// the tun device, not only those of the peers in the network
+	// map. The peers' own routes are still added, and take
+	// precedence inside the ranges.
+	RouteTailscaleRanges bool
+
+	// NoPrefSrc adds routes without the local address as their
+	// preferred source.
+	NoPrefSrc bool
+
+	// SkipConflictingRoutes leaves out routes that would shadow
+	// one of the system's own, rather than only warning about them.
+	SkipConflictingRoutes bool
+
+	// AllowedRoutes, if non-empty, limits the routes added for
+	// peers to those inside its networks. Routes inside one of the
+	// DeniedRoutes networks are never added.
+	AllowedRoutes []wgcfg.CIDR
+	DeniedRoutes  []wgcfg.CIDR
+
+	// RouteRetries is how many times a route change that fails
+	// with a transient error, such as the kernel running short of
+	// buffer space, is retried; if zero, it's 3, and if negative,
+	// changes aren't retried. RouteRetryInterval is how long to
+	// wait before the first retry, doubling for each one after;
+	// if zero, it's 50ms.
+	RouteRetries       int
+	RouteRetryInterval time.Duration
+
+	// RepairRoutes watches for the tun device's addresses and
+	// routes being deleted by other programs, such as
+	// NetworkManager or dhcpcd, and adds them back, until the
+	// Router is closed.
+	RepairRoutes bool
+
+	// FlushConntrack deletes the conntrack entries for connections
+	// to routes that are removed.
+	FlushConntrack bool
+
+	// AdvertiseRoutes allows forwarding traffic from the tun device
+	// to other networks, as a subnet router does, masqueraded out
+	// of EgressIface (if empty, that of the default route) or, if
+	// SNATSource is set, SNATed to it.
+	AdvertiseRoutes bool
+	EgressIface     string
+	SNATSource      wgcfg.IP
+
+	// NAT66 masquerades IPv6 traffic forwarded from the tun device
+	// too, out of the same interface. It's rarely wanted: IPv6
+	// subnets usually route back to Tailscale addresses without it.
+	NAT66 bool
+
+	// FastPath, if non-nil, is an eBPF program to forward and NAT
+	// the traffic for AdvertiseRoutes with, instead of firewall
+	// rules. If it can't be attached, the rules are used after all.
+	FastPath FastPath
+
+	// Firewall is the system to install firewall rules with:
+	// "iptables", "nftables" or "none". If empty, it's picked from
+	// what's installed.
+	Firewall string
+
+	// DNSMode is the system to configure DNS with:
+	// "systemd-resolved", "NetworkManager", "resolv.conf" or
+	// "resolv.conf (appending)". If empty, it's detected. If
+	// "off", DNS isn't managed at all: the DNS settings passed to
+	// SetRoutes are ignored, and the system's are left alone.
+	DNSMode string
+
+	// SplitDNS only uses the DNS servers for names under the
+	// search domains, where the DNS system supports it.
+	SplitDNS bool
+
+	// DNSDefaultRoute, with systemd-resolved, sends every name to
+	// the DNS servers, not only those under the search domains.
+	DNSDefaultRoute bool
+
+	// ResolvConf is the resolv.conf to write DNS settings to. If
+	// empty, it's /etc/resolv.conf.
+	ResolvConf string
+
+	// KeepDNSOnClose makes Close leave the DNS settings in place,
+	// rather than restoring the system's, for a restart that hands
+	// them over to the next Router.
+	KeepDNSOnClose bool
+
+	// DNSTimeout, if non-zero, is how long each DNS command may
+	// take before it's killed.
+	DNSTimeout time.Duration
+
+	// SetRoutesDelay, if non-zero, is how long SetRoutes waits so
+	// that a burst of calls is applied once.
+	SetRoutesDelay time.Duration
+
+	// SetRoutesMaxDelay, if non-zero, is the longest that a
+	// continuous burst of SetRoutes calls can hold up applying
+	// the latest settings. If zero, it's ten times SetRoutesDelay.
+	SetRoutesMaxDelay time.Duration
+
+	// Netns, if non-empty, is the network namespace the tun device
+	// is in.
+	Netns string
+
+	// BinPaths maps the names of programs the router runs, such as
+	// "ip", to the paths to run them from, instead of looking them
+	// up in PATH.
+	BinPaths map[string]string
+
+	// DryRun logs the changes the router would make to the system
+	// rather than making them.
+	DryRun bool
+}
+
+// FastPath is an accelerated forwarding path for subnet routers, such
+// as an eBPF program attached with XDP or tc, that forwards traffic
+// from the tun device out of the egress interface, and its replies
+// back in, without going through the firewall. It's provided
+// separately from the Router, which only decides when to use it.
+type FastPath interface {
+	// Attach attaches the fast path to the tun device tun and the
+	// egress interface egress. If snat is non-zero, traffic out
+	// of egress is SNATed to it; otherwise it's masqueraded. It
+	// returns an error if the kernel doesn't support the program
+	// or it can't be loaded, and the Router uses firewall rules
+	// instead. Reload calls it again, so attaching again must
+	// replace what it attached before.
+	Attach(ctx context.Context, tun, egress string, snat wgcfg.IP) error
+
+	// Detach removes what Attach attached.
+	Detach(ctx context.Context) error
+}
+
+// NewRouter returns the Router for the platform the engine is
+// running on, to configure the tun device opts.TunName. It's a
+// RouterGen, so callers can pass it to NewUserspaceEngineAdvanced
+// without needing build tags of their own.
+//
+// On platforms with no Router implementation, it warns and returns a
+// Router that leaves the system alone.
+func NewRouter(opts RouterOptions) (Router, error) {
+	return newUserspaceRouter(opts)
+}
+
+// Each platform's router file, or router_default.go for the rest,
+// provides newUserspaceRouter. A GOOS without one fails to build
+// here rather than in the packages that use NewRouter.
+var _ RouterGen = newUserspaceRouter
@@ -0,0 +1,279 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build freebsd openbsd
+
+package wgengine
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/logger"
+)
+
+// For now this router only supports the userspace WireGuard implementations.
+//
+// There is an experimental kernel version in the works for OpenBSD:
+// https://git.zx2c4.com/wireguard-openbsd.
+//
+// TODO(mbaillie): netlink-style monitoring might be possible through
+// `ifstated(8)`/`devd(8)`, or become possible with the OpenBSD kernel
+// implementation. This merits further investigation.
+
+// bsdRouter configures a tun device on FreeBSD and OpenBSD with
+// ifconfig(8) and route(8), and DNS by replacing resolv.conf.
+type bsdRouter struct {
+	logf    logger.Logf
+	tunname string
+	runner  commandRunner
+
+	// resolvConf is the resolv.conf to rewrite for DNS. If empty,
+	// it's defaultResolvConf.
+	resolvConf string
+
+	local      []wgcfg.CIDR
+	routes     map[wgcfg.CIDR]struct{}
+	dns        []net.IP
+	dnsDomains []string
+	dnsSet     bool // whether resolv.conf may need restoring
+	closed     bool // whether Close has been called
+}
+
+func newUserspaceRouter(opts RouterOptions) (Router, error) {
+	if err := checkTunName(opts.TunName); err != nil {
+		return nil, err
+	}
+	r := bsdRouter{
+		logf:       opts.Logf,
+		tunname:    opts.TunName,
+		runner:     execRunner{},
+		resolvConf: opts.ResolvConf,
+	}
+	return &r, nil
+}
+
+func (r *bsdRouter) Up(ctx context.Context) error {
+	if err := r.run(ctx, "ifconfig", r.tunname, "up"); err != nil {
+		r.logf("running ifconfig failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (r *bsdRouter) SetRoutes(ctx context.Context, rs RouteSettings) error {
+	if err := rs.Validate(); err != nil {
+		return fmt.Errorf("invalid route settings: %v", err)
+	}
+	var errs MultiError
+
+	// local is what the tun device has once we're done, as with
+	// routes below.
+	var local []wgcfg.CIDR
+	delAddrs, addAddrs := addrChanges(r.local, rs.LocalAddrs)
+	for _, addr := range delAddrs {
+		if err := r.run(ctx, r.addrArgs(addr, "-alias")...); err != nil {
+			r.logf("addr del failed: %v", err)
+			errs = append(errs, err)
+			local = append(local, addr)
+		}
+		if err := r.run(ctx, r.routeArgs("del", addr, addr.IP)...); err != nil {
+			r.logf("route del failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	failed := make(map[wgcfg.CIDR]bool)
+	for _, addr := range addAddrs {
+		if err := r.run(ctx, r.addrArgs(addr, "alias")...); err != nil {
+			r.logf("addr add failed: %v", err)
+			errs = append(errs, err)
+			failed[addr] = true
+		}
+		if err := r.run(ctx, r.routeArgs("add", addr, addr.IP)...); err != nil {
+			r.logf("route add failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+
+	for _, addr := range rs.LocalAddrs {
+		if !failed[addr] {
+			local = append(local, addr)
+		}
+	}
+
+	newRoutes := make(map[wgcfg.CIDR]struct{})
+	for _, peer := range rs.Cfg.Peers {
+		for _, route := range peer.AllowedIPs {
+			if isLinkScope(route) {
+				r.logf("WARNING: route %v from peer %v is link-local or multicast; skipping it", route, peer.PublicKey.ShortString())
+				continue
+			}
+			// route(8) adds the network, so peers that advertise
+			// different host bits of it share one route.
+			newRoutes[networkCIDR(route)] = struct{}{}
+		}
+	}
+	// routes is what the kernel has once we're done: routes whose
+	// delete failed are still there, and those whose add failed
+	// aren't, so that the next SetRoutes tries them again.
+	routes := make(map[wgcfg.CIDR]struct{}, len(newRoutes))
+	for _, route := range sortedCIDRs(r.routes) {
+		if _, keep := newRoutes[route]; keep {
+			routes[route] = struct{}{}
+			continue
+		}
+		if err := r.run(ctx, r.routeArgs("del", route, localIP(r.local, route))...); err != nil {
+			r.logf("route del failed: %v", err)
+			errs = append(errs, &RouteOpError{Dst: route, Err: err})
+			routes[route] = struct{}{}
+		}
+	}
+	for _, route := range sortedCIDRs(newRoutes) {
+		if _, exists := r.routes[route]; exists {
+			continue
+		}
+		// The route already being there, as after a restart, is
+		// as good as adding it.
+		if err := r.run(ctx, r.routeArgs("add", route, localIP(rs.LocalAddrs, route))...); err != nil && !isFileExists(err) {
+			r.logf("route add failed: %v", err)
+			errs = append(errs, &RouteOpError{Add: true, Dst: route, Err: err})
+			continue
+		}
+		routes[route] = struct{}{}
+	}
+
+	r.local = local
+	r.routes = routes
+
+	if !sameIPs(rs.DNS, r.dns) || !sameStrings(rs.DNSDomains, r.dnsDomains) {
+		if len(rs.DNS) > 0 {
+			r.dnsSet = true
+		}
+		if err := replaceResolvConf(r.resolvConf, rs.DNS, rs.DNSDomains, nil); err != nil {
+			errs = append(errs, fmt.Errorf("replacing resolv.conf failed: %v", err))
+		} else {
+			r.dnsSet = len(rs.DNS) > 0
+			r.dns = append([]net.IP(nil), rs.DNS...)
+			r.dnsDomains = append([]string(nil), rs.DNSDomains...)
+		}
+	}
+
+	return errs.errOrNil()
+}
+
+// Reload brings the tun device up again, and adds back its addresses,
+// routes and DNS settings. Routes that are still there are left
+// alone.
+func (r *bsdRouter) Reload(ctx context.Context) error {
+	if err := r.Up(ctx); err != nil {
+		return err
+	}
+	var errs MultiError
+	for _, addr := range r.local {
+		if err := r.run(ctx, r.addrArgs(addr, "alias")...); err != nil {
+			r.logf("addr add failed: %v", err)
+			errs = append(errs, err)
+		}
+		if err := r.run(ctx, r.routeArgs("add", addr, addr.IP)...); err != nil && !isFileExists(err) {
+			r.logf("route add failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	for _, route := range sortedCIDRs(r.routes) {
+		if err := r.run(ctx, r.routeArgs("add", route, localIP(r.local, route))...); err != nil && !isFileExists(err) {
+			r.logf("route add failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	if len(r.dns) > 0 {
+		if err := replaceResolvConf(r.resolvConf, r.dns, r.dnsDomains, nil); err != nil {
+			errs = append(errs, fmt.Errorf("replacing resolv.conf failed: %v", err))
+		}
+	}
+	return errs.errOrNil()
+}
+
+func (r *bsdRouter) Status() RouterStatus {
+	return routerStatus(r.local, r.routes, r.dns, r.dnsDomains)
+}
+
+// CheckHealth doesn't check anything yet.
+func (r *bsdRouter) CheckHealth(ctx context.Context) error {
+	return nil
+}
+
+// Close removes the routes and addresses, brings the tun device
+// down, and restores resolv.conf if it was replaced. Closing the
+// router again does nothing.
+func (r *bsdRouter) Close(ctx context.Context) error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	var errs MultiError
+	for _, route := range sortedCIDRs(r.routes) {
+		if err := r.run(ctx, r.routeArgs("del", route, localIP(r.local, route))...); err != nil {
+			r.logf("route del failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	r.routes = nil
+	for _, addr := range r.local {
+		if err := r.run(ctx, r.routeArgs("del", addr, addr.IP)...); err != nil {
+			r.logf("route del failed: %v", err)
+			errs = append(errs, err)
+		}
+		if err := r.run(ctx, r.addrArgs(addr, "-alias")...); err != nil {
+			r.logf("addr del failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	r.local = nil
+
+	if err := r.run(ctx, "ifconfig", r.tunname, "down"); err != nil {
+		r.logf("running ifconfig failed: %v", err)
+		errs = append(errs, err)
+	}
+
+	if r.dnsSet {
+		if err := restoreResolvConf(r.resolvConf, nil); err != nil {
+			r.logf("failed to restore system resolv.conf: %v", err)
+			errs = append(errs, err)
+		}
+		r.dnsSet = false
+	}
+
+	return errs.errOrNil()
+}
+
+// addrArgs returns the ifconfig command that adds (op "alias") or
+// removes (op "-alias") addr on the tun device.
+func (r *bsdRouter) addrArgs(addr wgcfg.CIDR, op string) []string {
+	family := "inet"
+	if addr.IP.Is6() {
+		family = "inet6"
+	}
+	return []string{"ifconfig", r.tunname, family, addr.String(), op}
+}
+
+// routeArgs returns the route command that adds (op "add") or
+// removes (op "del") a route to dst through the tun device, which
+// has the local address iface.
+func (r *bsdRouter) routeArgs(op string, dst wgcfg.CIDR, iface wgcfg.IP) []string {
+	family := "-inet"
+	if dst.IP.Is6() {
+		family = "-inet6"
+	}
+	return []string{"route", "-q", "-n", op, family, canonicalCIDR(dst), "-iface", iface.String()}
+}
+
+func (r *bsdRouter) run(ctx context.Context, args ...string) error {
+	out, err := r.runner.Run(ctx, args...)
+	if err != nil {
+		return commandError(args, err, out)
+	}
+	return nil
+}
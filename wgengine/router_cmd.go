@@ -0,0 +1,266 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"tailscale.com/logger"
+)
+
+// commandRunner runs the external commands that a Router uses to
+// configure the system. It returns the command's combined output.
+//
+// It exists so that tests can substitute a fake.
+//
+// If ctx is done before the command finishes, the command is
+// killed.
+type commandRunner interface {
+	Run(ctx context.Context, args ...string) ([]byte, error)
+
+	// RunStdin is like Run, but feeds stdin to the command.
+	RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error)
+}
+
+// execRunner is the commandRunner that executes commands for real.
+type execRunner struct{}
+
+func (execRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	c, err := cmd(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	out, err := c.CombinedOutput()
+	countResult("command", err)
+	return out, err
+}
+
+func (execRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	c, err := cmd(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	c.Stdin = bytes.NewReader(stdin)
+	out, err := c.CombinedOutput()
+	countResult("command", err)
+	return out, err
+}
+
+// dryRunner is the commandRunner that logs commands instead of
+// running them. They all succeed, with no output.
+type dryRunner struct {
+	logf logger.Logf
+}
+
+func (r dryRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	r.logf("dry run: %s", strings.Join(args, " "))
+	return nil, nil
+}
+
+func (r dryRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	r.logf("dry run: %s", strings.Join(args, " "))
+	for _, line := range strings.Split(strings.TrimSpace(string(stdin)), "\n") {
+		r.logf("dry run:   %s", line)
+	}
+	return nil, nil
+}
+
+// binPathRunner is a commandRunner that runs programs from the paths
+// in paths, keyed by program name, rather than looking them up in
+// PATH. Programs not in paths are run as they are.
+type binPathRunner struct {
+	runner commandRunner
+	paths  map[string]string
+}
+
+func (r binPathRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	return r.runner.Run(ctx, r.resolve(args)...)
+}
+
+func (r binPathRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	return r.runner.RunStdin(ctx, stdin, r.resolve(args)...)
+}
+
+func (r binPathRunner) resolve(args []string) []string {
+	if path, ok := r.paths[args[0]]; ok {
+		args = append([]string{path}, args[1:]...)
+	}
+	return args
+}
+
+// timeoutRunner is a commandRunner that gives each command at most
+// timeout to finish, for commands that talk to daemons that may hang,
+// such as systemctl(1).
+type timeoutRunner struct {
+	runner  commandRunner
+	timeout time.Duration
+}
+
+func (r timeoutRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	tctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	out, err := r.runner.Run(tctx, args...)
+	return out, r.check(ctx, tctx, err)
+}
+
+func (r timeoutRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	tctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	out, err := r.runner.RunStdin(tctx, stdin, args...)
+	return out, r.check(ctx, tctx, err)
+}
+
+// check returns err, or an error saying the command timed out if that's
+// why it failed: being killed says less.
+func (r timeoutRunner) check(ctx, tctx context.Context, err error) error {
+	if err != nil && ctx.Err() == nil && tctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", r.timeout)
+	}
+	return err
+}
+
+// netnsRunner is a commandRunner that runs commands in the network
+// namespace ns, using the ip(8) at ip.
+type netnsRunner struct {
+	runner commandRunner
+	ns     string
+	ip     string
+}
+
+func (r netnsRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	return r.runner.Run(ctx, r.wrap(args)...)
+}
+
+func (r netnsRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	return r.runner.RunStdin(ctx, stdin, r.wrap(args)...)
+}
+
+func (r netnsRunner) wrap(args []string) []string {
+	return append([]string{r.ip, "netns", "exec", r.ns}, args...)
+}
+
+// resolveBinPaths returns the absolute path of each of the programs,
+// looked up in PATH unless overrides gives one. Programs that aren't
+// installed are left out, unless they're required, in which case
+// it's an error.
+func resolveBinPaths(programs []program, overrides map[string]string) (map[string]string, error) {
+	paths := make(map[string]string, len(programs))
+	for _, p := range programs {
+		name := p.name
+		if path, ok := overrides[p.name]; ok {
+			name = path
+		}
+		path, err := exec.LookPath(name)
+		if err != nil {
+			if !p.required {
+				continue
+			}
+			return nil, fmt.Errorf("%s is required but can't be run: %v", p.name, err)
+		}
+		paths[p.name] = path
+	}
+	return paths, nil
+}
+
+// program is one of the programs that a Router runs.
+type program struct {
+	name     string
+	required bool // whether the Router can't work without it
+}
+
+// cmd returns the command to run args with, or an error if args is
+// empty.
+func cmd(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("exec.Cmd(%#v) invalid; need argv[0]", args)
+	}
+	return exec.CommandContext(ctx, args[0], args[1:]...), nil
+}
+
+// cmdError is the error from a command that failed. Its message
+// gives the command, how it failed and its output as key=value
+// fields, so that failures can be picked out of aggregated logs:
+//
+//	cmd="ip route add 10.0.0.0/8 dev tailscale0" exit=2 output="RTNETLINK answers: File exists"
+//
+// A command that exited has its exit status in exit; one that didn't
+// run or was killed has the error from running it in err instead.
+// The output is the command's combined stdout and stderr.
+type cmdError struct {
+	args []string
+	err  error
+	out  []byte
+}
+
+// commandError returns the error for the command args failing with
+// err, having printed out.
+func commandError(args []string, err error, out []byte) error {
+	return &cmdError{args: args, err: err, out: out}
+}
+
+func (e *cmdError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "cmd=%q", strings.Join(e.args, " "))
+	var ee *exec.ExitError
+	if errors.As(e.err, &ee) && ee.Exited() {
+		fmt.Fprintf(&b, " exit=%d", ee.ExitCode())
+	} else {
+		fmt.Fprintf(&b, " err=%q", e.err.Error())
+	}
+	if out := bytes.TrimSpace(e.out); len(out) > 0 {
+		fmt.Fprintf(&b, " output=%q", out)
+	}
+	return b.String()
+}
+
+func (e *cmdError) Unwrap() error { return e.err }
+
+// isFileExists reports whether err, from adding an address or route,
+// is because it's already there. ip(8), route(8) and rtnetlink all
+// report EEXIST, spelled "File exists" or "file exists".
+func isFileExists(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "file exists")
+}
+
+// isNotInstalled reports whether err, from running a command, is
+// because the program isn't installed.
+func isNotInstalled(err error) bool {
+	return errors.Is(err, exec.ErrNotFound)
+}
+
+// maxTunNameLen is the longest network interface name that Linux
+// and the BSDs accept (IFNAMSIZ, less the trailing NUL).
+const maxTunNameLen = 15
+
+// checkTunName returns an error if name isn't a sane network
+// interface name. Routers pass the tun device's name to commands
+// like ip(8) and ifconfig(8), so a bad name would produce broken
+// commands, or be taken for an option.
+func checkTunName(name string) error {
+	if name == "" {
+		return errors.New("tun device name is empty")
+	}
+	if len(name) > maxTunNameLen {
+		return fmt.Errorf("tun device name %q is longer than %d characters", name, maxTunNameLen)
+	}
+	if name[0] == '-' {
+		return fmt.Errorf("tun device name %q starts with '-'", name)
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return fmt.Errorf("tun device name %q contains invalid character %q", name, c)
+		}
+	}
+	return nil
+}
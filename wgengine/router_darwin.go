@@ -5,33 +5,283 @@
 package wgengine
 
 import (
-	"github.com/tailscale/wireguard-go/device"
-	"github.com/tailscale/wireguard-go/tun"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
 	"tailscale.com/logger"
 )
 
+// darwinRouter configures a utun device with ifconfig(8) and
+// route(8), and DNS with scutil(8).
+//
+// If SetRoutesFunc is set, as it is in the macOS and iOS apps, route
+// settings are handed to it instead.
 type darwinRouter struct {
+	logf    logger.Logf
 	tunname string
+	runner  commandRunner
+
+	local      []wgcfg.CIDR
+	routes     map[wgcfg.CIDR]struct{}
+	dns        []net.IP
+	dnsDomains []string
+	dnsSet     bool // whether our scutil DNS entry exists
 }
 
-func NewUserspaceRouter(logf logger.Logf, tunname string, dev *device.Device, tuntap tun.Device, netChanged func()) Router {
+func newUserspaceRouter(opts RouterOptions) (Router, error) {
+	if err := checkTunName(opts.TunName); err != nil {
+		return nil, err
+	}
 	r := darwinRouter{
-		tunname: tunname,
+		logf:    opts.Logf,
+		tunname: opts.TunName,
+		runner:  execRunner{},
 	}
-	return &r
+	return &r, nil
 }
 
-func (r *darwinRouter) Up() error {
-	return nil
+func (r *darwinRouter) Up(ctx context.Context) error {
+	if SetRoutesFunc != nil {
+		return nil
+	}
+	return r.ifconfig(ctx, r.tunname, "up")
 }
 
-func (r *darwinRouter) SetRoutes(rs RouteSettings) error {
+func (r *darwinRouter) SetRoutes(ctx context.Context, rs RouteSettings) error {
+	if err := rs.Validate(); err != nil {
+		return fmt.Errorf("invalid route settings: %v", err)
+	}
 	if SetRoutesFunc != nil {
 		return SetRoutesFunc(rs)
 	}
+
+	var errs MultiError
+
+	// local is what the tun device has once we're done, as with
+	// routes below.
+	var local []wgcfg.CIDR
+	delAddrs, addAddrs := addrChanges(r.local, rs.LocalAddrs)
+	for _, addr := range delAddrs {
+		if err := r.delAddr(ctx, addr); err != nil {
+			r.logf("addr del failed: %v", err)
+			errs = append(errs, err)
+			local = append(local, addr)
+		}
+	}
+	failed := make(map[wgcfg.CIDR]bool)
+	for _, addr := range addAddrs {
+		if err := r.addAddr(ctx, addr); err != nil {
+			r.logf("addr add failed: %v", err)
+			errs = append(errs, err)
+			failed[addr] = true
+		}
+	}
+	for _, addr := range rs.LocalAddrs {
+		if !failed[addr] {
+			local = append(local, addr)
+		}
+	}
+
+	newRoutes := make(map[wgcfg.CIDR]struct{})
+	for _, peer := range rs.Cfg.Peers {
+		for _, route := range peer.AllowedIPs {
+			if isLinkScope(route) {
+				r.logf("WARNING: route %v from peer %v is link-local or multicast; skipping it", route, peer.PublicKey.ShortString())
+				continue
+			}
+			// route(8) adds the network, so peers that advertise
+			// different host bits of it share one route.
+			newRoutes[networkCIDR(route)] = struct{}{}
+		}
+	}
+	// routes is what the kernel has once we're done: routes whose
+	// delete failed are still there, and those whose add failed
+	// aren't, so that the next SetRoutes tries them again.
+	routes := make(map[wgcfg.CIDR]struct{}, len(newRoutes))
+	for _, route := range sortedCIDRs(r.routes) {
+		if _, keep := newRoutes[route]; keep {
+			routes[route] = struct{}{}
+			continue
+		}
+		if err := r.route(ctx, "delete", route); err != nil {
+			r.logf("route del failed: %v", err)
+			errs = append(errs, &RouteOpError{Dst: route, Err: err})
+			routes[route] = struct{}{}
+		}
+	}
+	for _, route := range sortedCIDRs(newRoutes) {
+		if _, exists := r.routes[route]; exists {
+			continue
+		}
+		// The route already being there, as after a restart, is
+		// as good as adding it.
+		if err := r.route(ctx, "add", route); err != nil && !isFileExists(err) {
+			r.logf("route add failed: %v", err)
+			errs = append(errs, &RouteOpError{Add: true, Dst: route, Err: err})
+			continue
+		}
+		routes[route] = struct{}{}
+	}
+
+	r.local = local
+	r.routes = routes
+
+	if !sameIPs(rs.DNS, r.dns) || !sameStrings(rs.DNSDomains, r.dnsDomains) {
+		if err := r.setDNS(ctx, rs.DNS, rs.DNSDomains); err != nil {
+			r.logf("dns set failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	return errs.errOrNil()
+}
+
+// Reload brings the tun device up again, and adds back its addresses,
+// routes and DNS settings. Routes that are still there are left
+// alone.
+func (r *darwinRouter) Reload(ctx context.Context) error {
+	if SetRoutesFunc != nil {
+		return nil
+	}
+	if err := r.Up(ctx); err != nil {
+		return err
+	}
+	var errs MultiError
+	for _, addr := range r.local {
+		if err := r.addAddr(ctx, addr); err != nil {
+			r.logf("addr add failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	for _, route := range sortedCIDRs(r.routes) {
+		if err := r.route(ctx, "add", route); err != nil && !isFileExists(err) {
+			r.logf("route add failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	if r.dnsSet {
+		if err := r.setDNS(ctx, r.dns, r.dnsDomains); err != nil {
+			r.logf("dns set failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	return errs.errOrNil()
+}
+
+func (r *darwinRouter) Status() RouterStatus {
+	return routerStatus(r.local, r.routes, r.dns, r.dnsDomains)
+}
+
+// CheckHealth doesn't check anything yet.
+func (r *darwinRouter) CheckHealth(ctx context.Context) error {
+	return nil
+}
+
+// Close removes the routes, addresses and DNS settings. Failures are
+// collected, so that one doesn't stop the rest from being removed.
+func (r *darwinRouter) Close(ctx context.Context) error {
+	if SetRoutesFunc != nil {
+		return nil
+	}
+	var errs MultiError
+	for _, route := range sortedCIDRs(r.routes) {
+		if err := r.route(ctx, "delete", route); err != nil {
+			r.logf("route del failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	r.routes = nil
+	for _, addr := range r.local {
+		if err := r.delAddr(ctx, addr); err != nil {
+			r.logf("addr del failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	r.local = nil
+	if err := r.setDNS(ctx, nil, nil); err != nil {
+		r.logf("dns remove failed: %v", err)
+		errs = append(errs, err)
+	}
+	return errs.errOrNil()
+}
+
+// addAddr assigns addr to the tun device. utun devices are
+// point-to-point, so IPv4 addresses need a destination; we use the
+// address itself.
+func (r *darwinRouter) addAddr(ctx context.Context, addr wgcfg.CIDR) error {
+	if addr.IP.Is6() {
+		return r.ifconfig(ctx, r.tunname, "inet6", addr.String(), "alias")
+	}
+	return r.ifconfig(ctx, r.tunname, "inet", addr.String(), addr.IP.String(), "alias")
+}
+
+// delAddr removes addr from the tun device.
+func (r *darwinRouter) delAddr(ctx context.Context, addr wgcfg.CIDR) error {
+	if addr.IP.Is6() {
+		return r.ifconfig(ctx, r.tunname, "inet6", addr.String(), "-alias")
+	}
+	return r.ifconfig(ctx, r.tunname, "inet", addr.String(), "-alias")
+}
+
+// route runs "route add" or "route delete" for a route to dst
+// through the tun device.
+func (r *darwinRouter) route(ctx context.Context, op string, dst wgcfg.CIDR) error {
+	family := "-inet"
+	if dst.IP.Is6() {
+		family = "-inet6"
+	}
+	// route(8) rejects destinations with host bits set.
+	args := []string{"route", "-q", "-n", op, family, canonicalCIDR(dst), "-interface", r.tunname}
+	out, err := r.runner.Run(ctx, args...)
+	if err != nil {
+		return commandError(args, err, out)
+	}
+	return nil
+}
+
+func (r *darwinRouter) ifconfig(ctx context.Context, args ...string) error {
+	args = append([]string{"ifconfig"}, args...)
+	if out, err := r.runner.Run(ctx, args...); err != nil {
+		return commandError(args, err, out)
+	}
 	return nil
 }
 
-func (r *darwinRouter) Close() error {
+// dnsKey is the dynamic store key that holds our DNS settings.
+func (r *darwinRouter) dnsKey() string {
+	return "State:/Network/Service/" + r.tunname + "/DNS"
+}
+
+// setDNS points the system resolver at servers, searching domains,
+// by publishing them to the dynamic store with scutil. With no
+// servers, it removes our settings instead.
+func (r *darwinRouter) setDNS(ctx context.Context, servers []net.IP, domains []string) error {
+	var b strings.Builder
+	if len(servers) == 0 {
+		if !r.dnsSet {
+			return nil
+		}
+		fmt.Fprintf(&b, "remove %s\n", r.dnsKey())
+	} else {
+		b.WriteString("d.init\n")
+		b.WriteString("d.add ServerAddresses *")
+		for _, ip := range servers {
+			fmt.Fprintf(&b, " %s", ip)
+		}
+		b.WriteString("\n")
+		if len(domains) > 0 {
+			fmt.Fprintf(&b, "d.add SearchDomains * %s\n", strings.Join(domains, " "))
+		}
+		fmt.Fprintf(&b, "set %s\n", r.dnsKey())
+	}
+	out, err := r.runner.RunStdin(ctx, []byte(b.String()), "scutil")
+	if err != nil {
+		return commandError([]string{"scutil"}, err, out)
+	}
+	r.dns = append([]net.IP(nil), servers...)
+	r.dnsDomains = append([]string(nil), domains...)
+	r.dnsSet = len(servers) > 0
 	return nil
 }
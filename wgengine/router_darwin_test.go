@@ -0,0 +1,263 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDarwinRouterSetRoutes(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &darwinRouter{logf: t.Logf, tunname: "utun3", runner: fake}
+
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rs := peerSettings(t, "100.101.102.103/32", []string{"100.64.0.1/32", "10.1.2.3/16"}, []string{"fd7a::1/128"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ifconfig utun3 up",
+		"ifconfig utun3 inet 100.101.102.103/32 100.101.102.103 alias",
+		"route -q -n add -inet 100.64.0.1/32 -interface utun3",
+		"route -q -n add -inet 10.1.0.0/16 -interface utun3",
+		"route -q -n add -inet6 fd7a::1/128 -interface utun3",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+
+	// Only the differences should be applied.
+	fake.cmds = nil
+	rs = peerSettings(t, "100.101.102.104/32", []string{"100.64.0.1/32"}, []string{"fd7a::2/128"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ifconfig utun3 inet 100.101.102.103/32 -alias",
+		"ifconfig utun3 inet 100.101.102.104/32 100.101.102.104 alias",
+		"route -q -n delete -inet 10.1.0.0/16 -interface utun3",
+		"route -q -n delete -inet6 fd7a::1/128 -interface utun3",
+		"route -q -n add -inet6 fd7a::2/128 -interface utun3",
+	}
+	for _, c := range want {
+		if !fake.ran(c) {
+			t.Errorf("did not run %q; ran %q", c, fake.cmds)
+		}
+	}
+	if len(fake.cmds) != len(want) {
+		t.Errorf("ran %d commands, want %d: %q", len(fake.cmds), len(want), fake.cmds)
+	}
+}
+
+func TestDarwinRouterDNS(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &darwinRouter{logf: t.Logf, tunname: "utun3", runner: fake}
+
+	rs := peerSettings(t, "100.101.102.103/32")
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	rs.DNSDomains = []string{"example.com"}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, "scutil set "); n != 1 {
+		t.Fatalf("set DNS %d times, want 1", n)
+	}
+	for _, want := range []string{
+		"scutil d.add ServerAddresses * 100.100.100.100",
+		"scutil d.add SearchDomains * example.com",
+		"scutil set State:/Network/Service/utun3/DNS",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+
+	// Unchanged DNS settings are not reapplied.
+	fake.cmds = nil
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, "scutil"); n != 0 {
+		t.Errorf("ran scutil %d times for unchanged DNS, want 0", n)
+	}
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := "scutil remove State:/Network/Service/utun3/DNS"; !fake.ran(want) {
+		t.Errorf("Close did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+func TestDarwinRouterSetRoutesErrors(t *testing.T) {
+	r := &darwinRouter{logf: t.Logf, tunname: "utun3", runner: failingRunner{}}
+	err := r.SetRoutes(context.Background(), peerSettings(t, "100.101.102.103/32", []string{"100.64.0.1/32", "100.64.0.2/32"}))
+	if err == nil {
+		t.Fatal("SetRoutes succeeded; want error")
+	}
+	merr, ok := err.(MultiError)
+	if !ok || len(merr) != 3 {
+		t.Fatalf("got %v; want 3 errors", err)
+	}
+	if !strings.Contains(err.Error(), "Cannot find device") {
+		t.Errorf("error %q does not include command output", err)
+	}
+}
+
+func TestDarwinRouterReload(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &darwinRouter{logf: t.Logf, tunname: "utun3", runner: fake}
+	rs := peerSettings(t, "100.101.102.103/32", []string{"100.64.0.1/32", "10.1.2.3/16"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+
+	// One of the routes is still there.
+	fake.cmds = nil
+	fake.outputs = map[string]string{
+		"route -q -n add -inet 100.64.0.1/32 -interface utun3": "route: writing to routing socket: File exists",
+	}
+	fake.fail = map[string]bool{"route -q -n add -inet 100.64.0.1/32 -interface utun3": true}
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ifconfig utun3 up",
+		"ifconfig utun3 inet 100.101.102.103/32 100.101.102.103 alias",
+		"route -q -n add -inet 10.1.0.0/16 -interface utun3",
+		"scutil set State:/Network/Service/utun3/DNS",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+}
+
+func TestDarwinRouterSameNetwork(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &darwinRouter{logf: t.Logf, tunname: "utun3", runner: fake}
+	ctx := context.Background()
+	rs := peerSettings(t, "100.101.102.103/32", []string{"10.0.0.1/24"}, []string{"10.0.0.2/24"})
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, "route -q -n add -inet 10.0.0.0/24 "); n != 1 {
+		t.Errorf("added 10.0.0.0/24 %d times, want once; ran %q", n, fake.cmds)
+	}
+
+	// The other peer still needs the route.
+	fake.cmds = nil
+	rs = peerSettings(t, "100.101.102.103/32", []string{"10.0.0.2/24"})
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.cmds) != 0 {
+		t.Errorf("ran %q; want nothing", fake.cmds)
+	}
+}
+
+func TestDarwinRouterRetryRoutes(t *testing.T) {
+	const add = "route -q -n add -inet 10.1.0.0/16 -interface utun3"
+	fake := &fakeRunner{fail: map[string]bool{add: true}}
+	r := &darwinRouter{logf: t.Logf, tunname: "utun3", runner: fake}
+	ctx := context.Background()
+	rs := peerSettings(t, "100.101.102.103/32", []string{"10.1.0.0/16"})
+	if err := r.SetRoutes(ctx, rs); err == nil {
+		t.Fatal("SetRoutes succeeded; want error")
+	}
+
+	// The route is tried again, and the kernel already having it
+	// counts as success.
+	fake.cmds = nil
+	fake.outputs = map[string]string{add: "route: writing to routing socket: File exists"}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.ran(add) {
+		t.Errorf("did not retry %q; ran %q", add, fake.cmds)
+	}
+	fake.cmds = nil
+	delete(fake.fail, add)
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.cmds) != 0 {
+		t.Errorf("ran %q; want nothing", fake.cmds)
+	}
+}
+
+func TestDarwinRouterRetryAddrs(t *testing.T) {
+	const (
+		add = "ifconfig utun3 inet 100.101.102.104/32 100.101.102.104 alias"
+		del = "ifconfig utun3 inet 100.101.102.103/32 -alias"
+	)
+	fake := &fakeRunner{}
+	r := &darwinRouter{logf: t.Logf, tunname: "utun3", runner: fake}
+	ctx := context.Background()
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/32")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither change is made, so both are tried again.
+	fake.fail = map[string]bool{add: true, del: true}
+	rs := peerSettings(t, "100.101.102.104/32")
+	if err := r.SetRoutes(ctx, rs); err == nil {
+		t.Fatal("SetRoutes succeeded; want error")
+	}
+	fake.cmds = nil
+	fake.fail = nil
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{del, add} {
+		if !fake.ran(want) {
+			t.Errorf("did not retry %q; ran %q", want, fake.cmds)
+		}
+	}
+}
+
+func TestDarwinRouterClose(t *testing.T) {
+	const del = "route -q -n delete -inet 10.1.0.0/16 -interface utun3"
+	fake := &fakeRunner{}
+	r := &darwinRouter{logf: t.Logf, tunname: "utun3", runner: fake}
+	ctx := context.Background()
+	rs := peerSettings(t, "100.101.102.103/32", []string{"10.1.0.0/16", "10.2.0.0/16"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed delete doesn't stop the rest.
+	fake.cmds = nil
+	fake.fail = map[string]bool{del: true}
+	if err := r.Close(ctx); err == nil {
+		t.Error("Close succeeded; want error")
+	}
+	for _, want := range []string{
+		del,
+		"route -q -n delete -inet 10.2.0.0/16 -interface utun3",
+		"ifconfig utun3 inet 100.101.102.103/32 -alias",
+		"scutil remove State:/Network/Service/utun3/DNS",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("Close did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+
+	fake.cmds = nil
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.cmds) != 0 {
+		t.Errorf("second Close ran %q", fake.cmds)
+	}
+}
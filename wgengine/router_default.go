@@ -2,16 +2,16 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// +build !windows,!linux,!darwin,!openbsd
+// +build !windows,!linux,!darwin,!openbsd,!freebsd
 
 package wgengine
 
-import (
-	"github.com/tailscale/wireguard-go/device"
-	"github.com/tailscale/wireguard-go/tun"
-	"tailscale.com/logger"
-)
+import "runtime"
 
-func NewUserspaceRouter(logf logger.Logf, tunname string, dev *device.Device, tuntap tun.Device, netChanged func()) Router {
-	return NewFakeRouter(logf, tunname, dev, tuntap, netChanged)
+// newUserspaceRouter returns a fakeRouter: there's no Router for this
+// platform, so the tun device's addresses, routes and DNS settings
+// have to be configured some other way.
+func newUserspaceRouter(opts RouterOptions) (Router, error) {
+	opts.Logf("WARNING: no router for %s; not configuring %s's addresses, routes or DNS", runtime.GOOS, opts.TunName)
+	return NewFakeRouter(opts)
 }
@@ -0,0 +1,392 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"tailscale.com/logger"
+)
+
+// dnsConfigurator applies DNS settings to the system.
+type dnsConfigurator interface {
+	// SetDNS makes servers the system's DNS servers, searching
+	// domains. With no servers, it's the same as RestoreDNS.
+	SetDNS(ctx context.Context, servers []net.IP, domains []string) error
+	// RestoreDNS puts back the system's original DNS settings.
+	RestoreDNS(ctx context.Context) error
+}
+
+// dnsDomainSetter is implemented by dnsConfigurators that can change
+// the search domains alone, leaving the servers already set by
+// SetDNS as they are.
+type dnsDomainSetter interface {
+	SetDNSDomains(ctx context.Context, domains []string) error
+}
+
+// resolvConfDNS is the dnsConfigurator that rewrites resolv.conf.
+// resolv.conf has no way of sending only some names to a server, so
+// it can't do split DNS: the servers are used for every name.
+type resolvConfDNS struct {
+	path    string                // resolv.conf to rewrite; if empty, defaultResolvConf
+	changed func(context.Context) // if non-nil, called after resolv.conf changes
+}
+
+func (c resolvConfDNS) SetDNS(ctx context.Context, servers []net.IP, domains []string) error {
+	return replaceResolvConf(c.path, servers, domains, c.onChange(ctx))
+}
+
+func (c resolvConfDNS) RestoreDNS(ctx context.Context) error {
+	return restoreResolvConf(c.path, c.onChange(ctx))
+}
+
+// onChange returns the func to call with ctx after resolv.conf
+// changes.
+func (c resolvConfDNS) onChange(ctx context.Context) func() {
+	if c.changed == nil {
+		return nil
+	}
+	return func() { c.changed(ctx) }
+}
+
+// resolvConfAppendDNS is the dnsConfigurator that adds our servers
+// and search domains to resolv.conf, after the entries already
+// there, rather than replacing it.
+type resolvConfAppendDNS struct {
+	resolvConfDNS
+	logf func(format string, args ...interface{})
+}
+
+func (c resolvConfAppendDNS) SetDNS(ctx context.Context, servers []net.IP, domains []string) error {
+	return appendResolvConf(c.logf, c.path, servers, domains, c.onChange(ctx))
+}
+
+func (c resolvConfAppendDNS) RestoreDNS(ctx context.Context) error {
+	return unappendResolvConf(c.path, c.onChange(ctx))
+}
+
+// dryRunDNS is the dnsConfigurator that logs DNS settings instead of
+// applying them.
+type dryRunDNS struct {
+	logf logger.Logf
+}
+
+func (c dryRunDNS) SetDNS(ctx context.Context, servers []net.IP, domains []string) error {
+	c.logf("dry run: set DNS servers %v, search domains %v", servers, domains)
+	return nil
+}
+
+func (c dryRunDNS) SetDNSDomains(ctx context.Context, domains []string) error {
+	c.logf("dry run: set DNS search domains %v", domains)
+	return nil
+}
+
+func (c dryRunDNS) RestoreDNS(ctx context.Context) error {
+	c.logf("dry run: restore DNS")
+	return nil
+}
+
+// dnsBackend returns the name of the system that c configures DNS
+// with.
+func dnsBackend(c dnsConfigurator) string {
+	switch c.(type) {
+	case nil:
+		return "none"
+	case resolvConfDNS:
+		return string(dnsResolvConf)
+	case resolvConfAppendDNS:
+		return string(dnsResolvConfAppend)
+	case resolvedDNS:
+		return string(dnsResolved)
+	case nmDNS:
+		return string(dnsNM)
+	default:
+		return fmt.Sprintf("%T", c)
+	}
+}
+
+// dnsMode is the system used to configure DNS.
+type dnsMode string
+
+const (
+	dnsResolvConf       dnsMode = "resolv.conf"
+	dnsResolvConfAppend dnsMode = "resolv.conf (appending)"
+	dnsResolved         dnsMode = "systemd-resolved"
+	dnsResolvedDirect   dnsMode = "systemd-resolved (direct)"
+	dnsNM               dnsMode = "NetworkManager"
+
+	// dnsOff leaves the system's DNS alone, for hosts whose DNS
+	// is managed by other means, whatever DNS servers SetRoutes
+	// is given.
+	dnsOff dnsMode = "off"
+)
+
+// parseDNSMode returns the dnsMode named s, or "" if s is empty, for
+// the mode to be detected.
+func parseDNSMode(s string) (dnsMode, error) {
+	switch mode := dnsMode(s); mode {
+	case "", dnsResolvConf, dnsResolvConfAppend, dnsResolved, dnsResolvedDirect, dnsNM, dnsOff:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown DNS mode %q", s)
+}
+
+// detectDNSMode reports which system to configure DNS with. If
+// systemd-resolved or NetworkManager is running, it owns
+// resolv.conf, and rewriting the file would fight with it; we tell
+// it about the tun link instead. NetworkManager often hands DNS to
+// resolved itself, so resolved is preferred, as long as it's what
+// resolv.conf actually uses.
+func (r *linuxRouter) detectDNSMode(ctx context.Context) dnsMode {
+	if r.resolvedActive(ctx) {
+		if mode := r.resolvedMode(); mode != "" {
+			return mode
+		}
+		r.logf("systemd-resolved is running, but resolv.conf doesn't use it")
+	}
+	if out, err := r.dnsCommands().Run(ctx, "nmcli", "-t", "-f", "RUNNING", "general"); err == nil && string(bytes.TrimSpace(out)) == "running" {
+		return dnsNM
+	}
+	return dnsResolvConf
+}
+
+// newDNSConfigurator returns the dnsConfigurator for mode, or nil
+// for dnsOff.
+func (r *linuxRouter) newDNSConfigurator(mode dnsMode) dnsConfigurator {
+	if mode == dnsOff {
+		r.logf("DNS management is off; leaving the system's DNS settings alone")
+		return nil
+	}
+	r.logf("using %s for DNS", mode)
+	switch mode {
+	case dnsResolved, dnsResolvedDirect:
+		return resolvedDNS{
+			runner:       r.dnsCommands(),
+			tunname:      r.tunname,
+			ifindex:      func() int { return r.tunIndex },
+			splitDNS:     r.splitDNS,
+			defaultRoute: r.dnsDefaultRoute,
+		}
+	case dnsNM:
+		return nmDNS{runner: r.dnsCommands(), tunname: r.tunname}
+	case dnsResolvConfAppend:
+		return resolvConfAppendDNS{resolvConfDNS{path: r.resolvConf, changed: r.restartResolved}, r.logf}
+	default:
+		return resolvConfDNS{path: r.resolvConf, changed: r.restartResolved}
+	}
+}
+
+// resolvedActive reports whether systemd-resolved is installed and
+// running. It only asks systemctl the first time.
+func (r *linuxRouter) resolvedActive(ctx context.Context) bool {
+	if !r.resolvedChecked {
+		_, err := r.dnsCommands().Run(ctx, "systemctl", "is-active", "--quiet", "systemd-resolved")
+		r.resolvedChecked, r.isResolved = true, err == nil
+	}
+	return r.isResolved
+}
+
+// resolvedStub is the address of systemd-resolved's stub resolver,
+// and resolvedStubUDP is how /proc/net/udp shows a socket bound to
+// it, in either byte order.
+const resolvedStub = "127.0.0.53"
+
+var resolvedStubUDP = []string{"3500007F:0035", "7F000035:0035"}
+
+// resolvedMode reports how resolv.conf uses systemd-resolved, which
+// is running: dnsResolved if it sends queries to resolved's stub
+// listener, dnsResolvedDirect if it's the upstream server list
+// resolved writes itself, or "" if it's a file of some other
+// system's, where resolved's link settings wouldn't take effect.
+func (r *linuxRouter) resolvedMode() dnsMode {
+	path := r.resolvConf
+	if path == "" {
+		path = defaultResolvConf
+	}
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		r.logf("reading resolv.conf: %v", err)
+		return ""
+	}
+	servers := resolvConfNameservers(strings.Split(string(conf), "\n"))
+	if len(servers) > 0 && servers[0] == resolvedStub {
+		if !r.stubListening() {
+			r.logf("resolv.conf uses systemd-resolved's stub, but nothing is listening on %s", resolvedStub)
+			return ""
+		}
+		return dnsResolved
+	}
+	if bytes.Contains(conf, []byte("managed by man:systemd-resolved")) {
+		return dnsResolvedDirect
+	}
+	return ""
+}
+
+// stubListening reports whether a UDP socket is bound to
+// resolvedStub port 53. If the socket table can't be read, it
+// assumes so.
+func (r *linuxRouter) stubListening() bool {
+	path := r.procNetUDP
+	if path == "" {
+		path = "/proc/net/udp"
+	}
+	table, err := ioutil.ReadFile(path)
+	if err != nil {
+		return true
+	}
+	for _, line := range strings.Split(string(table), "\n") {
+		f := strings.Fields(line)
+		if len(f) > 1 && hasString(resolvedStubUDP, f[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// restartResolved restarts systemd-resolved, if it's running, so that
+// it picks up changes to resolv.conf. If it isn't, there's nothing to
+// restart, and "service" could well pick some other unit.
+func (r *linuxRouter) restartResolved(ctx context.Context) {
+	if !r.resolvedActive(ctx) {
+		return
+	}
+	args := []string{"service", "systemd-resolved", "restart"}
+	out, err := r.dnsCommands().Run(ctx, args...)
+	if err != nil {
+		r.logf("restarting systemd-resolved failed: %v", commandError(args, err, out))
+	} else if len(out) > 0 {
+		r.logf("service systemd-resolved restart: %s", out)
+	}
+}
+
+// resolvedDNS is the dnsConfigurator that gives systemd-resolved
+// per-link DNS settings for the tun device, leaving the settings of
+// other links alone.
+//
+// It uses resolvectl(1), which makes the SetLinkDNS, SetLinkDomains,
+// SetLinkDefaultRoute and RevertLink calls on resolved's
+// org.freedesktop.resolve1 D-Bus API for the link with the tun
+// device's interface index. Nothing global, such as resolved's own
+// configuration or resolv.conf, is changed.
+//
+// Unless defaultRoute is set, the link isn't made a default route
+// for DNS: only names under the domains are sent to its servers, and
+// other names keep using the other links' servers. With splitDNS set,
+// as for MagicDNS, the domains are set as routing domains
+// ("~example.com"), which resolved sends the names under to this
+// link's servers but doesn't use for search, and the link is never a
+// default route.
+type resolvedDNS struct {
+	runner       commandRunner
+	tunname      string
+	ifindex      func() int // the tun device's interface index, or 0 if unknown
+	splitDNS     bool
+	defaultRoute bool
+}
+
+// link returns how to name the tun device's link to resolvectl: by
+// its interface index if that's known, else by name. The index is
+// looked up each time, as it changes if the device is made again.
+func (c resolvedDNS) link() string {
+	if c.ifindex != nil {
+		if i := c.ifindex(); i != 0 {
+			return strconv.Itoa(i)
+		}
+	}
+	return c.tunname
+}
+
+func (c resolvedDNS) SetDNS(ctx context.Context, servers []net.IP, domains []string) error {
+	if len(servers) == 0 {
+		return c.RestoreDNS(ctx)
+	}
+	args := []string{"resolvectl", "dns", c.link()}
+	for _, ip := range servers {
+		args = append(args, ip.String())
+	}
+	if err := c.run(ctx, args...); err != nil {
+		return err
+	}
+	defaultRoute := c.defaultRoute && !c.splitDNS
+	if err := c.run(ctx, "resolvectl", "default-route", c.link(), strconv.FormatBool(defaultRoute)); err != nil {
+		return err
+	}
+	return c.SetDNSDomains(ctx, domains)
+}
+
+func (c resolvedDNS) SetDNSDomains(ctx context.Context, domains []string) error {
+	args := []string{"resolvectl", "domain", c.link()}
+	for _, d := range domains {
+		if c.splitDNS {
+			d = "~" + d
+		}
+		args = append(args, d)
+	}
+	return c.run(ctx, args...)
+}
+
+func (c resolvedDNS) RestoreDNS(ctx context.Context) error {
+	return c.run(ctx, "resolvectl", "revert", c.link())
+}
+
+func (c resolvedDNS) run(ctx context.Context, args ...string) error {
+	out, err := c.runner.Run(ctx, args...)
+	if err != nil {
+		return commandError(args, err, out)
+	}
+	return nil
+}
+
+// nmDNS is the dnsConfigurator that sets DNS on the tun device's
+// NetworkManager connection, with nmcli(1). The changes are made to
+// the device's applied connection only, so they don't outlive the
+// device and aren't saved to the connection profile.
+type nmDNS struct {
+	runner  commandRunner
+	tunname string
+}
+
+func (c nmDNS) SetDNS(ctx context.Context, servers []net.IP, domains []string) error {
+	if len(servers) == 0 {
+		return c.RestoreDNS(ctx)
+	}
+	var dns4, dns6 []string
+	for _, ip := range servers {
+		if ip.To4() != nil {
+			dns4 = append(dns4, ip.String())
+		} else {
+			dns6 = append(dns6, ip.String())
+		}
+	}
+	search := strings.Join(domains, ",")
+	return c.modify(ctx, "ipv4.dns", strings.Join(dns4, ","), "ipv4.dns-search", search,
+		"ipv6.dns", strings.Join(dns6, ","), "ipv6.dns-search", search)
+}
+
+func (c nmDNS) SetDNSDomains(ctx context.Context, domains []string) error {
+	search := strings.Join(domains, ",")
+	return c.modify(ctx, "ipv4.dns-search", search, "ipv6.dns-search", search)
+}
+
+func (c nmDNS) RestoreDNS(ctx context.Context) error {
+	return c.modify(ctx, "ipv4.dns", "", "ipv4.dns-search", "", "ipv6.dns", "", "ipv6.dns-search", "")
+}
+
+// modify sets the given properties and values of the tun device's
+// applied connection.
+func (c nmDNS) modify(ctx context.Context, props ...string) error {
+	args := append([]string{"nmcli", "device", "modify", c.tunname}, props...)
+	out, err := c.runner.Run(ctx, args...)
+	if err != nil {
+		return commandError(args, err, out)
+	}
+	return nil
+}
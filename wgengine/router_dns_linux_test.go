@@ -0,0 +1,496 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// stubResolvConf is a resolv.conf as resolved writes it for its stub
+// listener, and stubUDP a /proc/net/udp with the listener in it.
+const (
+	stubResolvConf = "# This file is managed by man:systemd-resolved(8). Do not edit.\nnameserver 127.0.0.53\noptions edns0\n"
+	stubUDP        = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+ 3302: 3500007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 21270 2 0000000000000000 0
+`
+)
+
+// writeDNSFiles writes resolvConf and udp to files in dir, and
+// returns their paths.
+func writeDNSFiles(t *testing.T, dir, resolvConf, udp string) (confPath, udpPath string) {
+	t.Helper()
+	confPath, udpPath = filepath.Join(dir, "resolv.conf"), filepath.Join(dir, "udp")
+	if err := ioutil.WriteFile(confPath, []byte(resolvConf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(udpPath, []byte(udp), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return confPath, udpPath
+}
+
+func TestDetectDNSMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsmode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fake := &fakeRunner{}
+	conf, udp := writeDNSFiles(t, dir, stubResolvConf, stubUDP)
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, resolvConf: conf, procNetUDP: udp}
+	if got := r.detectDNSMode(context.Background()); got != dnsResolved {
+		t.Errorf("with resolved running, got %v; want %v", got, dnsResolved)
+	}
+	if _, ok := r.newDNSConfigurator(dnsResolved).(resolvedDNS); !ok {
+		t.Errorf("%v configurator is not resolvedDNS", dnsResolved)
+	}
+
+	fake.fail = map[string]bool{"systemctl is-active --quiet systemd-resolved": true}
+	fake.outputs = map[string]string{"nmcli -t -f RUNNING general": "running\n"}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	if got := r.detectDNSMode(context.Background()); got != dnsNM {
+		t.Errorf("with NetworkManager running, got %v; want %v", got, dnsNM)
+	}
+	if _, ok := r.newDNSConfigurator(dnsNM).(nmDNS); !ok {
+		t.Errorf("%v configurator is not nmDNS", dnsNM)
+	}
+
+	fake.fail["nmcli -t -f RUNNING general"] = true
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	if got := r.detectDNSMode(context.Background()); got != dnsResolvConf {
+		t.Errorf("without resolved or NetworkManager, got %v; want %v", got, dnsResolvConf)
+	}
+	if _, ok := r.newDNSConfigurator(dnsResolvConf).(resolvConfDNS); !ok {
+		t.Errorf("%v configurator is not resolvConfDNS", dnsResolvConf)
+	}
+
+	if _, ok := r.newDNSConfigurator(dnsResolvConfAppend).(resolvConfAppendDNS); !ok {
+		t.Errorf("%v configurator is not resolvConfAppendDNS", dnsResolvConfAppend)
+	}
+}
+
+func TestDetectDNSModeResolved(t *testing.T) {
+	const (
+		directConf = "# This file is managed by man:systemd-resolved(8). Do not edit.\nnameserver 192.168.1.1\nsearch lan\n"
+		plainConf  = "# Generated by dhclient\nnameserver 192.168.1.1\n"
+		emptyUDP   = "  sl  local_address rem_address   st\n"
+	)
+	tests := []struct {
+		name       string
+		resolvConf string
+		udp        string
+		want       dnsMode
+	}{
+		{"stub", stubResolvConf, stubUDP, dnsResolved},
+		{"stub not listening", stubResolvConf, emptyUDP, dnsResolvConf},
+		{"direct", directConf, emptyUDP, dnsResolvedDirect},
+		{"plain file", plainConf, stubUDP, dnsResolvConf},
+	}
+	dir, err := ioutil.TempDir("", "dnsmode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		conf, udp := writeDNSFiles(t, dir, tt.resolvConf, tt.udp)
+		fake := &fakeRunner{fail: map[string]bool{"nmcli -t -f RUNNING general": true}}
+		r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, resolvConf: conf, procNetUDP: udp}
+		mode := r.detectDNSMode(context.Background())
+		if mode != tt.want {
+			t.Errorf("%s: got %v; want %v", tt.name, mode, tt.want)
+		}
+
+		// The same configurator applies and reverts the settings,
+		// and String reports the mode.
+		r.dnsMode, r.dnsConfig = mode, r.newDNSConfigurator(mode)
+		if err := r.SetRoutes(context.Background(), RouteSettings{Cfg: new(wgcfg.Config), DNS: []net.IP{net.ParseIP("100.100.100.100")}}); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if err := r.Close(context.Background()); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		resolvectl := countPrefix(fake.cmds, "resolvectl ")
+		if viaResolved := mode != dnsResolvConf; viaResolved != (resolvectl >= 2) {
+			t.Errorf("%s: ran resolvectl %d times; ran %q", tt.name, resolvectl, fake.cmds)
+		}
+		if got := r.String(); !strings.HasSuffix(got, " dns="+string(mode)) {
+			t.Errorf("%s: String() = %q; want dns=%s", tt.name, got, mode)
+		}
+	}
+}
+
+func TestRestartResolvedInactive(t *testing.T) {
+	const isActive = "systemctl is-active --quiet systemd-resolved"
+	fake := &fakeRunner{fail: map[string]bool{isActive: true}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	for i := 0; i < 2; i++ {
+		r.restartResolved(context.Background())
+	}
+	if n := countPrefix(fake.cmds, "service "); n != 0 {
+		t.Errorf("restarted a service %d times without resolved; ran %q", n, fake.cmds)
+	}
+	if n := countPrefix(fake.cmds, isActive); n != 1 {
+		t.Errorf("checked for resolved %d times; want 1", n)
+	}
+
+	// When it is running, it's restarted.
+	fake = &fakeRunner{}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	r.restartResolved(context.Background())
+	if want := "service systemd-resolved restart"; !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+// blockingRunner is a commandRunner whose commands hang until they're
+// killed, like systemctl talking to a wedged init system.
+type blockingRunner struct{}
+
+func (blockingRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, errors.New("signal: killed")
+}
+
+func (blockingRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	<-ctx.Done()
+	return nil, errors.New("signal: killed")
+}
+
+func TestLinuxRouterDNSTimeout(t *testing.T) {
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          blockingRunner{},
+		resolvedChecked: true,
+		isResolved:      true,
+		dnsTimeout:      20 * time.Millisecond,
+	}
+	start := time.Now()
+	r.restartResolved(context.Background())
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("restartResolved took %v with a %v timeout", d, r.dnsTimeout)
+	}
+
+	c := r.newDNSConfigurator(dnsResolved)
+	err := c.SetDNS(context.Background(), []net.IP{net.ParseIP("100.100.100.100")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 20ms") {
+		t.Errorf("SetDNS with a hung resolvectl: err = %v; want a timeout", err)
+	}
+
+	// The caller's own deadline is reported as it is.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := c.RestoreDNS(ctx); err == nil || strings.Contains(err.Error(), "timed out") {
+		t.Errorf("RestoreDNS with a cancelled context: err = %v", err)
+	}
+}
+
+func TestLinuxRouterResolved(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	r.dnsConfig = r.newDNSConfigurator(dnsResolved)
+
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100"), net.ParseIP("8.8.8.8")}
+	rs.DNSDomains = []string{"example.com", "example.net"}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"resolvectl dns tailscale0 100.100.100.100 8.8.8.8",
+		"resolvectl domain tailscale0 example.com example.net",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+	if n := countPrefix(fake.cmds, "service "); n != 0 {
+		t.Errorf("restarted a service %d times with resolved", n)
+	}
+
+	// Changing only the search domains leaves the servers be.
+	fake.cmds = nil
+	rs.DNSDomains = []string{"example.org"}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "resolvectl domain tailscale0 example.org"; !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+	if n := countPrefix(fake.cmds, "resolvectl dns "); n != 0 {
+		t.Errorf("set DNS servers %d times for a domains-only change", n)
+	}
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := "resolvectl revert tailscale0"; !fake.ran(want) {
+		t.Errorf("Close did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+func TestLinuxRouterResolvedPerLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resolved")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf, _ := writeDNSFiles(t, dir, stubResolvConf, stubUDP)
+
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, tunIndex: 7, resolvConf: conf}
+	r.dnsConfig = r.newDNSConfigurator(dnsResolved)
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	rs.DNSDomains = []string{"example.com"}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"resolvectl dns 7 100.100.100.100",
+		"resolvectl default-route 7 false",
+		"resolvectl domain 7 example.com",
+		"resolvectl revert 7",
+	}
+	var got []string
+	for _, c := range fake.cmds {
+		if strings.HasPrefix(c, "resolvectl ") {
+			got = append(got, c)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ran resolvectl:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	b, err := ioutil.ReadFile(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != stubResolvConf {
+		t.Errorf("resolv.conf was changed to:\n%s", b)
+	}
+	if n := countPrefix(fake.cmds, "service ") + countPrefix(fake.cmds, "systemctl "); n != 0 {
+		t.Errorf("changed global DNS settings: ran %q", fake.cmds)
+	}
+
+	// Asked to, the link answers every name.
+	fake = &fakeRunner{}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, tunIndex: 7, dnsDefaultRoute: true}
+	r.dnsConfig = r.newDNSConfigurator(dnsResolved)
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "resolvectl default-route 7 true"; !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+
+	// Once checkTun finds the device made again, its new index is
+	// used.
+	fake.cmds = nil
+	r.tunIndex = 9
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.101")}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "resolvectl dns 9 100.100.100.101"; !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+func TestLinuxRouterResolvedSplitDNS(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, splitDNS: true}
+	r.dnsConfig = r.newDNSConfigurator(dnsResolved)
+
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	rs.DNSDomains = []string{"example.com", "example.net"}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"resolvectl dns tailscale0 100.100.100.100",
+		"resolvectl default-route tailscale0 false",
+		"resolvectl domain tailscale0 ~example.com ~example.net",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+
+	// Domains set alone are routing-only too.
+	fake.cmds = nil
+	rs.DNSDomains = []string{"example.org"}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "resolvectl domain tailscale0 ~example.org"; !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+func TestLinuxRouterNetworkManager(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	r.dnsConfig = r.newDNSConfigurator(dnsNM)
+
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100"), net.ParseIP("fd7a::53")}
+	rs.DNSDomains = []string{"example.com", "example.net"}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	want := "nmcli device modify tailscale0 ipv4.dns 100.100.100.100 ipv4.dns-search example.com,example.net ipv6.dns fd7a::53 ipv6.dns-search example.com,example.net"
+	if !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+
+	fake.cmds = nil
+	rs.DNSDomains = []string{"example.org"}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	want = "nmcli device modify tailscale0 ipv4.dns-search example.org ipv6.dns-search example.org"
+	if !fake.ran(want) {
+		t.Errorf("domains-only change did not run %q; ran %q", want, fake.cmds)
+	}
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = "nmcli device modify tailscale0 ipv4.dns  ipv4.dns-search  ipv6.dns  ipv6.dns-search "
+	if !fake.ran(want) {
+		t.Errorf("Close did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+func TestLinuxRouterKeepDNSOnClose(t *testing.T) {
+	f, cleanup := tempResolvConf(t)
+	defer cleanup()
+	const orig = "nameserver 192.168.1.1\n"
+	if err := ioutil.WriteFile(f.conf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRunner{fail: map[string]bool{"systemctl is-active --quiet systemd-resolved": true}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, resolvConf: f.conf, keepDNSOnClose: true}
+	r.dnsConfig = r.newDNSConfigurator(dnsResolvConf)
+	ctx := context.Background()
+
+	rs := peerSettings(t, "100.101.102.103/10")
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	ours := readFile(t, f.conf)
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := os.Readlink(f.conf); err != nil || ln != f.ts {
+		t.Errorf("resolv.conf links to %q, %v; want it left at %q", ln, err, f.ts)
+	}
+	if got := readFile(t, f.conf); got != ours {
+		t.Errorf("resolv.conf is %q; want it untouched, %q", got, ours)
+	}
+
+	// The next router takes over, and restores the original.
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, resolvConf: f.conf}
+	r.dnsConfig = r.newDNSConfigurator(dnsResolvConf)
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, f.conf); got != orig {
+		t.Errorf("restored resolv.conf is %q; want %q", got, orig)
+	}
+}
+
+func TestLinuxRouterDNSOff(t *testing.T) {
+	f, cleanup := tempResolvConf(t)
+	defer cleanup()
+	const orig = "nameserver 192.168.1.1\n"
+	if err := ioutil.WriteFile(f.conf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mode, err := parseDNSMode("off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, resolvConf: f.conf, dnsMode: mode}
+	r.dnsConfig = r.newDNSConfigurator(mode)
+	ctx := context.Background()
+
+	rs := peerSettings(t, "100.101.102.103/10")
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	rs.DNSDomains = []string{"example.com"}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range fake.cmds {
+		for _, prog := range []string{"resolvectl ", "systemctl ", "nmcli ", "busctl "} {
+			if strings.HasPrefix(c, prog) {
+				t.Errorf("ran DNS command %q", c)
+			}
+		}
+	}
+	if got := readFile(t, f.conf); got != orig {
+		t.Errorf("resolv.conf is %q; want it untouched, %q", got, orig)
+	}
+	if st := r.Status(); len(st.DNS) != 0 {
+		t.Errorf("Status reports DNS servers %v", st.DNS)
+	}
+	if s := r.String(); !strings.Contains(s, "dns=off") {
+		t.Errorf("String() = %q; want dns=off", s)
+	}
+}
+
+func TestLinuxRouterResolvConf(t *testing.T) {
+	f, cleanup := tempResolvConf(t)
+	defer cleanup()
+	const orig = "nameserver 192.168.1.1\n"
+	if err := ioutil.WriteFile(f.conf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeRunner{fail: map[string]bool{"systemctl is-active --quiet systemd-resolved": true}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, resolvConf: f.conf}
+	r.dnsConfig = r.newDNSConfigurator(dnsResolvConf)
+	ctx := context.Background()
+
+	rs := peerSettings(t, "100.101.102.103/10")
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := os.Readlink(f.conf); err != nil || ln != f.ts {
+		t.Errorf("resolv.conf links to %q, %v; want %q", ln, err, f.ts)
+	}
+	if got := readFile(t, f.backup); got != orig {
+		t.Errorf("backup is %q; want %q", got, orig)
+	}
+
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, f.conf); got != orig {
+		t.Errorf("restored resolv.conf is %q; want %q", got, orig)
+	}
+}
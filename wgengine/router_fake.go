@@ -5,34 +5,62 @@
 package wgengine
 
 import (
-	"github.com/tailscale/wireguard-go/device"
-	"github.com/tailscale/wireguard-go/tun"
+	"context"
+
 	"tailscale.com/logger"
 )
 
+// fakeRouter is a Router that doesn't touch the OS at all. It's used
+// when the engine runs purely in userspace, such as with a fake tun
+// device behind a SOCKS proxy, and on platforms that have no Router
+// implementation.
+//
+// Its methods only log, and are safe to call on a nil *fakeRouter.
 type fakeRouter struct {
 	tunname string
 	logf    logger.Logf
 }
 
-func NewFakeRouter(logf logger.Logf, tunname string, dev *device.Device, tuntap tun.Device, netChanged func()) Router {
+// NewFakeRouter returns a Router for opts.TunName that leaves the
+// system alone. It's a RouterGen.
+func NewFakeRouter(opts RouterOptions) (Router, error) {
 	return &fakeRouter{
-		logf:    logf,
-		tunname: tunname,
-	}
+		logf:    opts.Logf,
+		tunname: opts.TunName,
+	}, nil
 }
 
-func (r *fakeRouter) Up() error {
-	r.logf("Warning: fakeRouter.Up: not implemented.\n")
+func (r *fakeRouter) Up(ctx context.Context) error {
+	r.log("fakeRouter.Up: not implemented.")
 	return nil
 }
 
-func (r *fakeRouter) SetRoutes(rs RouteSettings) error {
-	r.logf("Warning: fakeRouter.SetRoutes: not implemented.\n")
+func (r *fakeRouter) SetRoutes(ctx context.Context, rs RouteSettings) error {
+	r.log("fakeRouter.SetRoutes: not implemented.")
 	return nil
 }
 
-func (r *fakeRouter) Close() error {
-	r.logf("Warning: fakeRouter.Close: not implemented.\n")
+func (r *fakeRouter) Reload(ctx context.Context) error {
+	r.log("fakeRouter.Reload: not implemented.")
+	return nil
+}
+
+func (r *fakeRouter) Status() RouterStatus {
+	return RouterStatus{}
+}
+
+func (r *fakeRouter) CheckHealth(ctx context.Context) error {
 	return nil
 }
+
+func (r *fakeRouter) Close(ctx context.Context) error {
+	r.log("fakeRouter.Close: not implemented.")
+	return nil
+}
+
+func (r *fakeRouter) log(msg string) {
+	if r == nil || r.logf == nil {
+		return
+	}
+	r.logf("Warning: %s\n", msg)
+}
@@ -0,0 +1,37 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFakeRouter(t *testing.T) {
+	routers := map[string]Router{
+		"nil": (*fakeRouter)(nil),
+	}
+	for name, logf := range map[string]func(string, ...interface{}){"NewFakeRouter": t.Logf, "nil logf": nil} {
+		r, err := NewFakeRouter(RouterOptions{Logf: logf, TunName: "faketun"})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		routers[name] = r
+	}
+	for name, r := range routers {
+		if err := r.Up(context.Background()); err != nil {
+			t.Errorf("%s: Up: %v", name, err)
+		}
+		if err := r.SetRoutes(context.Background(), RouteSettings{}); err != nil {
+			t.Errorf("%s: SetRoutes: %v", name, err)
+		}
+		if err := r.Reload(context.Background()); err != nil {
+			t.Errorf("%s: Reload: %v", name, err)
+		}
+		if err := r.Close(context.Background()); err != nil {
+			t.Errorf("%s: Close: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import "context"
+
+// attachFastPath attaches r.fastPath for the traffic of advertised
+// routes. Failures are logged rather than returned: the firewall
+// rules that addFirewall then installs do the same job, only slower.
+// If Reload can't attach it again, what was attached before is
+// detached, so that the two don't both handle the traffic.
+func (r *linuxRouter) attachFastPath(ctx context.Context) {
+	egress := r.egressIface
+	if egress == "" {
+		var err error
+		egress, err = r.defaultRouteInterface(ctx)
+		if err != nil {
+			r.logf("eBPF fast path not attached, using the firewall: %v", err)
+			r.detachFastPath(ctx)
+			return
+		}
+	}
+	if r.dryRun {
+		r.logf("dry run: would attach the eBPF fast path to %s and %s", r.tunname, egress)
+		return
+	}
+	if err := r.fastPath.Attach(ctx, r.tunname, egress, r.snatSource); err != nil {
+		r.logf("eBPF fast path not attached, using the firewall: %v", err)
+		r.detachFastPath(ctx)
+		return
+	}
+	if !r.fastPathOn {
+		r.logf("using the eBPF fast path on %s and %s", r.tunname, egress)
+	}
+	r.setFastPathOn(true)
+}
+
+// detachFastPath detaches r.fastPath if attachFastPath attached it.
+func (r *linuxRouter) detachFastPath(ctx context.Context) error {
+	if !r.fastPathOn {
+		return nil
+	}
+	r.setFastPathOn(false)
+	if err := r.fastPath.Detach(ctx); err != nil {
+		r.logf("detaching eBPF fast path failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+func (r *linuxRouter) setFastPathOn(on bool) {
+	r.mu.Lock()
+	r.fastPathOn = on
+	r.mu.Unlock()
+}
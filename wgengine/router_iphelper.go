@@ -0,0 +1,195 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"errors"
+	"net"
+	"sort"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"tailscale.com/logger"
+)
+
+// ipHelper programs the addresses, routes and DNS settings of a
+// single network adapter. On Windows it's backed by the IP Helper
+// API. It's an interface, and this file has no build tag, so that
+// the diffing in adapterConfig.apply can be tested everywhere.
+type ipHelper interface {
+	// Flush removes all of the adapter's addresses and routes.
+	Flush() error
+	AddAddress(addr *net.IPNet) error
+	DeleteAddress(ip net.IP) error
+	AddRoute(dst *net.IPNet, nextHop net.IP) error
+	DeleteRoute(dst *net.IPNet, nextHop net.IP) error
+	SetDNS(servers []net.IP, domains []string) error
+}
+
+// adapterRoute is a route through the adapter.
+type adapterRoute struct {
+	dst     net.IPNet // with host bits cleared
+	nextHop net.IP
+}
+
+// adapterConfig is the adapter configuration last applied by apply.
+// The zero value is one that apply hasn't configured yet, which may
+// still have addresses and routes from an earlier run.
+type adapterConfig struct {
+	flushed    bool                    // whether the adapter was flushed first
+	addrs      map[string]*net.IPNet   // keyed by CIDR string
+	routes     map[string]adapterRoute // keyed by masked dst
+	dns        []net.IP
+	dnsDomains []string
+	dnsSet     bool
+}
+
+// apply brings the adapter programmed through h from c to cfg plus
+// the given DNS settings, changing only what differs. All failures
+// are returned, as a MultiError.
+func (c *adapterConfig) apply(logf logger.Logf, h ipHelper, cfg *wgcfg.Config, dns []net.IP, dnsDomains []string) error {
+	// Routes go via the first adapter address of the route's
+	// family.
+	var gateway4, gateway6 net.IP
+	newAddrs := make(map[string]*net.IPNet)
+	for _, addr := range cfg.Interface.Addresses {
+		// IPNet's IP shares addr's storage, which the next
+		// iteration reuses.
+		ipnet := addr.IPNet()
+		ipnet.IP = append(net.IP(nil), ipnet.IP...)
+		newAddrs[ipnet.String()] = ipnet
+		if addr.IP.Is4() && gateway4 == nil {
+			gateway4 = ipnet.IP
+		} else if addr.IP.Is6() && gateway6 == nil {
+			gateway6 = ipnet.IP
+		}
+	}
+
+	newRoutes := make(map[string]adapterRoute)
+	for _, peer := range cfg.Peers {
+		for _, allowedip := range peer.AllowedIPs {
+			gateway := gateway4
+			if allowedip.IP.Is6() {
+				gateway = gateway6
+			}
+			if gateway == nil {
+				return errors.New("Due to a Windows limitation, one cannot have interface routes without an interface address")
+			}
+			ipn := allowedip.IPNet()
+			dst := net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask}
+			if dst.IP.Equal(gateway) {
+				// No need to add a route for the adapter's
+				// own IP. The kernel does that for us. If we
+				// try to replace it, we'll fail to add the
+				// route unless NextHop is set, but then the
+				// adapter's IP won't be pingable.
+				continue
+			}
+			// There's only one way to get to a given IP+Mask,
+			// so later duplicates are dropped.
+			if _, dup := newRoutes[dst.String()]; !dup {
+				newRoutes[dst.String()] = adapterRoute{dst: dst, nextHop: gateway}
+			}
+		}
+	}
+
+	// Only what was actually applied is recorded, so that the next
+	// apply retries whatever failed. Keys are visited in sorted
+	// order, so that the calls are the same from run to run.
+	var errs MultiError
+	if !c.flushed {
+		// The adapter may have addresses and routes that an
+		// earlier run, or one that crashed, left behind, which
+		// diffing from nothing would never remove.
+		if err := h.Flush(); err != nil {
+			logf("flush failed: %v", err)
+			errs = append(errs, err)
+		} else {
+			c.flushed = true
+			c.addrs, c.routes = nil, nil
+		}
+	}
+	addrs := make(map[string]*net.IPNet, len(newAddrs))
+	routes := make(map[string]adapterRoute, len(newRoutes))
+	for _, k := range sortedRouteKeys(c.routes) {
+		old := c.routes[k]
+		if rt, keep := newRoutes[k]; keep && rt.nextHop.Equal(old.nextHop) {
+			routes[k] = old
+			continue
+		}
+		if err := h.DeleteRoute(&old.dst, old.nextHop); err != nil {
+			logf("route del failed: %v", err)
+			errs = append(errs, err)
+			routes[k] = old
+		}
+	}
+	for _, k := range sortedAddrKeys(c.addrs) {
+		if _, keep := newAddrs[k]; keep {
+			addrs[k] = c.addrs[k]
+			continue
+		}
+		if err := h.DeleteAddress(c.addrs[k].IP); err != nil {
+			logf("addr del failed: %v", err)
+			errs = append(errs, err)
+			addrs[k] = c.addrs[k]
+		}
+	}
+	for _, k := range sortedAddrKeys(newAddrs) {
+		if _, exists := c.addrs[k]; exists {
+			continue
+		}
+		if err := h.AddAddress(newAddrs[k]); err != nil {
+			logf("addr add failed: %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		addrs[k] = newAddrs[k]
+	}
+	for _, k := range sortedRouteKeys(newRoutes) {
+		rt := newRoutes[k]
+		if old, exists := routes[k]; exists && old.nextHop.Equal(rt.nextHop) {
+			continue
+		}
+		if err := h.AddRoute(&rt.dst, rt.nextHop); err != nil {
+			logf("route add failed: %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		routes[k] = rt
+	}
+	c.addrs = addrs
+	c.routes = routes
+
+	if !c.dnsSet || !sameIPs(dns, c.dns) || !sameStrings(dnsDomains, c.dnsDomains) {
+		if err := h.SetDNS(dns, dnsDomains); err != nil {
+			logf("setdns: %v", err)
+			errs = append(errs, err)
+		} else {
+			c.dns = append([]net.IP(nil), dns...)
+			c.dnsDomains = append([]string(nil), dnsDomains...)
+			c.dnsSet = true
+		}
+	}
+	return errs.errOrNil()
+}
+
+// sortedAddrKeys returns the keys of addrs, sorted.
+func sortedAddrKeys(addrs map[string]*net.IPNet) []string {
+	keys := make([]string, 0, len(addrs))
+	for k := range addrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sortedRouteKeys returns the keys of routes, sorted.
+func sortedRouteKeys(routes map[string]adapterRoute) []string {
+	keys := make([]string, 0, len(routes))
+	for k := range routes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,184 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// fakeIPHelper is an ipHelper that records the calls made to it.
+type fakeIPHelper struct {
+	calls []string
+	fail  map[string]bool // calls that fail
+}
+
+// call records c, and returns an error if it should fail.
+func (f *fakeIPHelper) call(c string) error {
+	f.calls = append(f.calls, c)
+	if f.fail[c] {
+		return errors.New("The object already exists.")
+	}
+	return nil
+}
+
+func (f *fakeIPHelper) Flush() error {
+	return f.call("flush")
+}
+
+func (f *fakeIPHelper) AddAddress(addr *net.IPNet) error {
+	return f.call("addaddr " + addr.String())
+}
+
+func (f *fakeIPHelper) DeleteAddress(ip net.IP) error {
+	return f.call("deladdr " + ip.String())
+}
+
+func (f *fakeIPHelper) AddRoute(dst *net.IPNet, nextHop net.IP) error {
+	return f.call(fmt.Sprintf("addroute %v via %v", dst, nextHop))
+}
+
+func (f *fakeIPHelper) DeleteRoute(dst *net.IPNet, nextHop net.IP) error {
+	return f.call(fmt.Sprintf("delroute %v via %v", dst, nextHop))
+}
+
+func (f *fakeIPHelper) SetDNS(servers []net.IP, domains []string) error {
+	return f.call(fmt.Sprintf("setdns %v %v", servers, domains))
+}
+
+// adapterSettings returns a wgcfg.Config with the given adapter
+// addresses and one peer per entry in allowedIPs.
+func adapterSettings(t *testing.T, addrs []string, allowedIPs ...[]string) *wgcfg.Config {
+	t.Helper()
+	cfg := peerSettings(t, "", allowedIPs...).Cfg
+	for _, a := range addrs {
+		cfg.Interface.Addresses = append(cfg.Interface.Addresses, mustCIDR(t, a))
+	}
+	return cfg
+}
+
+func TestAdapterConfigApply(t *testing.T) {
+	dns := []net.IP{net.ParseIP("100.100.100.100")}
+	tests := []struct {
+		name  string
+		cfg   *wgcfg.Config
+		dns   []net.IP
+		calls []string
+	}{
+		{
+			name: "initial",
+			cfg:  adapterSettings(t, []string{"100.101.102.103/32"}, []string{"100.101.102.103/32", "100.64.0.1/32"}, []string{"10.1.2.3/16"}),
+			dns:  dns,
+			calls: []string{
+				"flush",
+				"addaddr 100.101.102.103/32",
+				"addroute 10.1.0.0/16 via 100.101.102.103",
+				"addroute 100.64.0.1/32 via 100.101.102.103",
+				"setdns [100.100.100.100] []",
+			},
+		},
+		{
+			name:  "unchanged",
+			cfg:   adapterSettings(t, []string{"100.101.102.103/32"}, []string{"100.101.102.103/32", "100.64.0.1/32"}, []string{"10.1.2.3/16"}),
+			dns:   dns,
+			calls: nil,
+		},
+		{
+			name: "route removed",
+			cfg:  adapterSettings(t, []string{"100.101.102.103/32"}, []string{"100.64.0.1/32"}),
+			dns:  dns,
+			calls: []string{
+				"delroute 10.1.0.0/16 via 100.101.102.103",
+			},
+		},
+		{
+			name: "new address",
+			cfg:  adapterSettings(t, []string{"100.101.102.104/32"}, []string{"100.64.0.1/32"}),
+			calls: []string{
+				"delroute 100.64.0.1/32 via 100.101.102.103",
+				"deladdr 100.101.102.103",
+				"addaddr 100.101.102.104/32",
+				"addroute 100.64.0.1/32 via 100.101.102.104",
+				"setdns [] []",
+			},
+		},
+	}
+
+	var c adapterConfig
+	for _, tt := range tests {
+		h := &fakeIPHelper{}
+		if err := c.apply(t.Logf, h, tt.cfg, tt.dns, nil); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if fmt.Sprint(h.calls) != fmt.Sprint(tt.calls) {
+			t.Errorf("%s: calls\n%q\nwant\n%q", tt.name, h.calls, tt.calls)
+		}
+	}
+}
+
+func TestAdapterConfigNeedsAddress(t *testing.T) {
+	var c adapterConfig
+	h := &fakeIPHelper{}
+	cfg := adapterSettings(t, []string{"100.101.102.103/32"}, []string{"fd7a::1/128"})
+	if err := c.apply(t.Logf, h, cfg, nil, nil); err == nil {
+		t.Fatal("apply succeeded with an IPv6 route and no IPv6 address")
+	}
+	if len(h.calls) != 0 {
+		t.Errorf("apply made changes before failing: %q", h.calls)
+	}
+}
+
+func TestAdapterConfigRetry(t *testing.T) {
+	const add = "addroute 10.1.0.0/16 via 100.101.102.103"
+	var c adapterConfig
+	h := &fakeIPHelper{fail: map[string]bool{add: true, "addaddr 100.101.102.104/32": true}}
+	cfg := adapterSettings(t, []string{"100.101.102.103/32", "100.101.102.104/32"}, []string{"10.1.0.0/16", "10.2.0.0/16"})
+	if err := c.apply(t.Logf, h, cfg, nil, nil); err == nil {
+		t.Fatal("apply succeeded; want error")
+	}
+
+	// Only what failed is tried again.
+	h = &fakeIPHelper{}
+	if err := c.apply(t.Logf, h, cfg, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"addaddr 100.101.102.104/32", add}
+	if fmt.Sprint(h.calls) != fmt.Sprint(want) {
+		t.Errorf("calls\n%q\nwant\n%q", h.calls, want)
+	}
+}
+
+func TestAdapterConfigFlushRetry(t *testing.T) {
+	var c adapterConfig
+	h := &fakeIPHelper{fail: map[string]bool{"flush": true}}
+	cfg := adapterSettings(t, []string{"100.101.102.103/32"}, []string{"10.1.0.0/16"})
+	if err := c.apply(t.Logf, h, cfg, nil, nil); err == nil {
+		t.Fatal("apply succeeded; want error")
+	}
+
+	// A failed flush is tried again, and what was added after it
+	// is added again, since the flush removes it.
+	h = &fakeIPHelper{}
+	if err := c.apply(t.Logf, h, cfg, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"flush", "addaddr 100.101.102.103/32", "addroute 10.1.0.0/16 via 100.101.102.103"}
+	if fmt.Sprint(h.calls) != fmt.Sprint(want) {
+		t.Errorf("calls\n%q\nwant\n%q", h.calls, want)
+	}
+
+	// Once flushed, the adapter isn't flushed again.
+	h = &fakeIPHelper{}
+	if err := c.apply(t.Logf, h, cfg, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(h.calls) != 0 {
+		t.Errorf("calls %q; want none", h.calls)
+	}
+}
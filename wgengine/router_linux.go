@@ -5,271 +5,2647 @@
 package wgengine
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/tailscale/wireguard-go/device"
-	"github.com/tailscale/wireguard-go/tun"
 	"github.com/tailscale/wireguard-go/wgcfg"
-	"tailscale.com/atomicfile"
-	"tailscale.com/logger"
+	"golang.org/x/sys/unix"
 	"tailscale.com/wgengine/monitor"
 )
 
+// errRouterClosed is returned by the methods of a closed router.
+var errRouterClosed = errors.New("router is closed")
+
+// errNotNetAdmin is returned by Up when the process doesn't have the
+// privileges it needs to configure the network.
+var errNotNetAdmin = errors.New("tailscaled must run with CAP_NET_ADMIN/root to configure the network")
+
 type linuxRouter struct {
 	logf       func(fmt string, args ...interface{})
 	tunname    string
 	mon        *monitor.Mon
 	netChanged func()
-	local      wgcfg.CIDR
+	runner     commandRunner
+
+	// wgdev, if non-nil, is the WireGuard device whose peers'
+	// allowed IPs SetRoutes checks its routes against.
+	wgdev wgDevice
+
+	// nl, if non-nil, is used to add and remove addresses and
+	// routes. Otherwise they're configured by running ip(8).
+	nl *rtnetlink
+
+	// mtu is the MTU to set on the tun device. If zero, it's
+	// sized for the last path MTU passed to SetPathMTU, failing
+	// that for the egress interface's MTU if probePathMTU is set,
+	// and failing that defaultTunMTU is used.
+	mtu          int
+	probePathMTU bool
+
+	// txQueueLen, if non-zero, is the transmit queue length to set
+	// on the tun device, so that bursts on busy subnet routers
+	// aren't dropped. Otherwise the kernel's default is kept.
+	txQueueLen int
+
+	// tunIndex, if non-zero, is the interface index of the tun
+	// device, which the engine had just created when the router
+	// was made. Up notices the device being made again, with a new
+	// index, and follows it.
+	tunIndex int
+
+	// tunWait is how long Up waits for the tun device to appear,
+	// as the kernel may not have finished registering it when the
+	// router is created. If zero, defaultTunWait is used.
+	tunWait time.Duration
+
+	// noARP is whether Up turns off ARP on the tun device. It's a
+	// point-to-point device, so ARP and neighbor discovery have
+	// nothing to do there but make noise.
+	noARP bool
+
+	// hostAddrs is whether the tun device's addresses are added as
+	// host addresses (/32 or /128), with the network of each, such
+	// as 100.64.0.0/10, added as a route through the tun device
+	// instead. Otherwise the kernel derives the on-link route for
+	// the network from the address's mask.
+	hostAddrs bool
+
+	// routeTable, if non-zero, is the routing table that routes
+	// are added to, instead of the main table. With fwmark also
+	// set, Up installs ip rules that look up routeTable for
+	// packets with that mark, for policy routing setups where
+	// only some traffic (as chosen by the firewall) goes via
+	// Tailscale. Close flushes the table.
+	routeTable int
+	fwmark     uint32
+
+	// routeMetric, if non-zero, is the metric that routes are
+	// added with. Giving them a higher metric than the system's
+	// own routes keeps Tailscale routes that overlap with local
+	// networks from taking over their traffic. Routes found
+	// with a different metric are replaced.
+	routeMetric int
+
+	// routeTailscaleRanges is whether SetRoutes also adds a route
+	// for each of the whole tailscaleRanges, so that every
+	// Tailscale address goes to the tun device, whichever peers
+	// are in the network map. Peers' routes are still added; being
+	// more specific, theirs win inside the ranges. A range that the
+	// on-link route of a local address already covers is left out,
+	// as peers' routes are.
+	routeTailscaleRanges bool
+
+	// routeOnlink is whether routes with a gateway are added
+	// "onlink", telling the kernel that the gateway is directly
+	// reachable through the tun device. Otherwise the kernel
+	// wants a route to the gateway as well, which there isn't
+	// when the local address is outside the route's subnet, such
+	// as for peers' on-link subnets.
+	routeOnlink bool
+
+	// noPrefSrc is whether routes are added without a preferred
+	// source address. Otherwise each route is added with the local
+	// address of its family as "src", so that packets this host
+	// sends through the tun device come from its Tailscale address
+	// and replies find their way back.
+	noPrefSrc bool
+
+	// skipConflictingRoutes is whether to leave out routes that
+	// would shadow a route of the system's own, such as one for
+	// the local network, rather than only warning about them.
+	skipConflictingRoutes bool
+
+	// allowedRoutes and deniedRoutes limit the routes that
+	// SetRoutes adds for peers' allowed IPs, whatever the peers
+	// advertise. If allowedRoutes is non-empty, only routes inside
+	// one of its networks are added; routes inside one of the
+	// deniedRoutes networks never are. Routes that aren't
+	// permitted are skipped with a warning.
+	allowedRoutes []wgcfg.CIDR
+	deniedRoutes  []wgcfg.CIDR
+
+	// routeRetries is how many times a route change that fails
+	// with a transient error, such as the kernel running short of
+	// buffer space, is retried, and routeRetryInterval is how long
+	// to wait before the first retry, doubling for each one after.
+	// If zero, defaultRouteRetries and defaultRouteRetryInterval
+	// are used. If routeRetries is negative, changes aren't
+	// retried.
+	routeRetries       int
+	routeRetryInterval time.Duration
+
+	// flushConntrack is whether SetRoutes deletes the conntrack
+	// entries for connections to the routes it removes, which the
+	// kernel would otherwise keep forwarding down their old path
+	// until they time out. It needs conntrack(8); without it, the
+	// entries are left to time out.
+	flushConntrack bool
+
+	// advertiseRoutes is whether this node routes traffic from
+	// the tun device to other networks, as a subnet router does.
+	// If set, Up installs firewall rules that allow forwarding
+	// that traffic and masquerade it out of egressIface.
+	// Plain clients, which only talk to Tailscale addresses
+	// themselves, don't need these rules.
+	advertiseRoutes bool
+
+	// egressIface is the interface that traffic forwarded from
+	// the tun device is masqueraded out of. If empty, the
+	// interface that owns the default route is used.
+	egressIface string
+
+	// snatSource, if non-zero, is the IPv4 address that traffic
+	// forwarded from the tun device is SNATed to, instead of being
+	// masqueraded. On gateways whose egress address doesn't change,
+	// SNAT saves looking the address up for every connection.
+	snatSource wgcfg.IP
+
+	// nat66 is whether IPv6 traffic forwarded from the tun device
+	// is masqueraded too, once there are IPv6 routes. IPv6 subnets
+	// usually have addresses that route back without it, and
+	// hiding them behind one address breaks end-to-end
+	// connectivity, so it's only for networks that need it.
+	nat66 bool
+
+	// fastPath, if non-nil, is tried by Up before the firewall
+	// rules for advertised routes. While it's attached, it does
+	// their forwarding and NAT, and the rules aren't installed.
+	fastPath FastPath
+
+	// dnsConfig applies DNS settings to the system. If nil, the
+	// router leaves DNS alone.
+	dnsConfig dnsConfigurator
+
+	// dnsMode is the mode NewRouter detected and made dnsConfig
+	// for, which String reports. If empty, String names the
+	// backend of dnsConfig instead.
+	dnsMode dnsMode
+
+	// procNetUDP is the UDP socket table that DNS detection looks
+	// for systemd-resolved's stub listener in. If empty, it's
+	// /proc/net/udp.
+	procNetUDP string
+
+	// splitDNS is whether the DNS servers are only used for names
+	// under the search domains, with other names resolved by the
+	// system's own servers. Only systemd-resolved can do this;
+	// with the other DNS systems, the servers are used for every
+	// name.
+	splitDNS bool
+
+	// dnsDefaultRoute is whether, with systemd-resolved, the tun
+	// link is made the default route for DNS, so that its servers
+	// answer every name, not only those under its domains.
+	// Otherwise other links keep their own DNS servers for the
+	// other names. It has no effect with splitDNS.
+	dnsDefaultRoute bool
+
+	// resolvConf is the resolv.conf that DNS settings are written
+	// to when no other system manages DNS. If empty, it's
+	// defaultResolvConf.
+	resolvConf string
+
+	// keepDNSOnClose is whether Close leaves the DNS settings in
+	// place rather than restoring the system's, so that a
+	// tailscaled restarting for an upgrade hands them over to the
+	// next one without DNS flapping back and forth. The next
+	// router's settings replace them as usual, and it restores the
+	// original settings that this one backed up.
+	keepDNSOnClose bool
+
+	// dnsTimeout is how long each of the commands that configure
+	// DNS, such as systemctl(1) and resolvectl(1), may take before
+	// it's killed, so that a hung init system or DNS daemon can't
+	// hold up SetRoutes or Close. If zero, it's defaultDNSTimeout.
+	dnsTimeout time.Duration
+
+	// repairRoutes is whether Up starts watching rtnetlink for
+	// the tun device's addresses and routes being deleted by
+	// something else, and adds them back; see startWatch.
+	// dialRouteEvents, if non-nil, replaces dialRouteEvents for
+	// it. stopWatch, if non-nil, stops the running watcher, which
+	// watches the interface with index watchIndex. ownDeletes
+	// counts the routes the router deleted itself whose events the
+	// watcher hasn't seen yet; it's guarded by opMu.
+	repairRoutes    bool
+	dialRouteEvents func() (routeEventConn, error)
+	stopWatch       func()
+	watchIndex      int
+	ownDeletes      map[wgcfg.CIDR]int
+
+	// onRoutesChanged, if non-nil, is called after a successful
+	// SetRoutes that changed the tun device's routes, with the
+	// routes that were added and removed. It's called without
+	// any of the router's locks held, so it may call back into
+	// the router; calls for concurrent SetRoutes may arrive out
+	// of order.
+	onRoutesChanged func(added, removed []wgcfg.CIDR)
+
+	// setRoutesDelay, if non-zero, is how long SetRoutes waits
+	// before applying its settings, so that a burst of calls
+	// during network map churn is applied once: each call replaces
+	// the pending settings and restarts the wait, and the latest
+	// settings are applied when it ends, or setRoutesMaxDelay
+	// after the burst began. If zero, setRoutesMaxDelay is ten
+	// times setRoutesDelay.
+	setRoutesDelay    time.Duration
+	setRoutesMaxDelay time.Duration
+
+	// debounceMu guards pending, the burst of SetRoutes calls
+	// waiting to be applied, and debounceTimer, which applies it.
+	debounceMu    sync.Mutex
+	pending       *routesBatch
+	debounceTimer *time.Timer
+
+	// binPaths maps the names of the programs that the router
+	// runs, such as "ip" and "iptables", to the paths to run them
+	// from. Programs not in it are looked up in PATH. NewRouter
+	// fills it in from linuxPrograms, so that a restricted PATH
+	// later on doesn't matter.
+	binPaths map[string]string
+
+	// netns, if non-empty, is the name of the network namespace
+	// that the tun device is in. The router's commands are run in
+	// it with "ip netns exec", and rtnetlink isn't used, as its
+	// socket is in tailscaled's own namespace.
+	netns string
+
+	// netAdmin, if non-nil, reports whether the process may
+	// configure the network, so that Up can fail with one clear
+	// error rather than with every command it runs. NewRouter sets
+	// it to hasNetAdmin.
+	netAdmin func() (bool, error)
+
+	// dryRun is whether to only log the changes the router would
+	// make to the system, rather than making them: commands are
+	// logged instead of run, rtnetlink isn't used, and DNS
+	// settings are logged instead of applied.
+	dryRun bool
+
+	// opMu is held by Up, SetRoutes, SetPathMTU, Reload and Close,
+	// and by applyPending for debounced SetRoutes calls, so that
+	// only one of them changes the system at a time. It guards tunIndex,
+	// stopWatch, watchIndex and ownDeletes above, and every field
+	// below except those in the mu group. Status and String don't
+	// take it, so they never wait for commands to run.
+	opMu   sync.Mutex
+	closed bool // whether Close has been called
+	dnsSet bool // whether DNS settings may need restoring
+
+	// mu guards firewall, fastPathOn, local, routes, dnsServers
+	// and dnsDomains, which Status and String read while the tun
+	// device is being configured. They are only written with both
+	// opMu and mu held, so code holding opMu may read them
+	// without mu.
+	mu         sync.Mutex
+	firewall   firewallMode // if empty, Up picks one from what's installed
+	fastPathOn bool         // whether fastPath is attached
+	local      []wgcfg.CIDR // addresses of the tun device
 	routes     map[wgcfg.CIDR]struct{}
+	dnsServers []net.IP // last DNS settings applied by dnsConfig
+	dnsDomains []string
+
+	rules       []iptablesRule    // rules added by Up, removed by Close
+	chains      []iptablesRule    // chains holding rules, one rule from each
+	policyRules []string          // ip(8) families with fwmark rules
+	sysctls     map[string]string // original values of changed sysctls
+	arpOff      bool              // whether Up turned off ARP
+	pathMTU     int               // last path MTU from SetPathMTU
+	linkUp      bool              // whether Up brought the tun device up
+	v6Disabled  bool              // whether Up found IPv6 disabled
+
+	// vias is the gateway that each route in routes was added
+	// with, for when setRoutes can't read the kernel's routes.
+	vias map[wgcfg.CIDR]wgcfg.IP
+
+	// blackholes is the type ("blackhole" or "unreachable") of
+	// each of the blackhole routes that setRoutes added. They're
+	// not on the tun device, so the kernel's routes for it don't
+	// include them.
+	blackholes map[wgcfg.CIDR]string
+
+	// settings is a copy of what was last passed to SetRoutes, for
+	// Reload and repair to apply again.
+	settings RouteSettings
+
+	resolvedChecked bool // whether isResolved is known
+	isResolved      bool // whether systemd-resolved is running
+	noConntrack     bool // whether conntrack(8) is missing
+}
+
+// linuxPrograms are the programs that the Linux router runs. Only ip
+// is required: the router copes without the others, or can do
+// without the features that need them.
+var linuxPrograms = []program{
+	{name: "ip", required: true},
+	{name: "iptables"},
+	{name: "ip6tables"},
+	{name: "nft"},
+	{name: "sysctl"},
+	{name: "systemctl"},
+	{name: "service"},
+	{name: "resolvectl"},
+	{name: "nmcli"},
+	{name: "conntrack"},
 }
 
-func NewUserspaceRouter(logf logger.Logf, tunname string, dev *device.Device, tuntap tun.Device, netChanged func()) Router {
-	mon, err := monitor.New(logf, netChanged)
+func newUserspaceRouter(opts RouterOptions) (Router, error) {
+	r, err := newLinuxRouter(opts)
 	if err != nil {
-		log.Fatalf("rtnlmon.New() failed: %v", err)
+		return nil, err
 	}
-
-	r := linuxRouter{
-		logf:       logf,
-		tunname:    tunname,
-		mon:        mon,
-		netChanged: netChanged,
+	if r.binPaths, err = resolveBinPaths(linuxPrograms, opts.BinPaths); err != nil {
+		return nil, err
+	}
+	if r.mon, err = monitor.New(r.logf, r.netChanged); err != nil {
+		return nil, fmt.Errorf("rtnlmon.New() failed: %v", err)
+	}
+	r.runner = execRunner{}
+	r.netAdmin = hasNetAdmin
+	if iface, err := net.InterfaceByName(r.tunname); err == nil && r.netns == "" {
+		r.tunIndex = iface.Index
 	}
-	return &r
+	if r.dnsMode == "" {
+		r.dnsMode = r.detectDNSMode(context.Background())
+	}
+	r.dnsConfig = r.newDNSConfigurator(r.dnsMode)
+	if r.nl, err = dialRtnetlink(); err != nil {
+		r.logf("%v; falling back to ip(8)", err)
+	}
+	return r, nil
 }
 
-func cmd(args ...string) *exec.Cmd {
-	if len(args) == 0 {
-		log.Fatalf("exec.Cmd(%#v) invalid; need argv[0]\n", args)
+// newLinuxRouter returns a linuxRouter with the settings in opts,
+// which it checks. It doesn't look at the system, so it's left to
+// newUserspaceRouter to set up how the router runs commands and
+// watches the network, and to detect the DNS mode if opts doesn't
+// give one.
+func newLinuxRouter(opts RouterOptions) (*linuxRouter, error) {
+	if err := checkTunName(opts.TunName); err != nil {
+		return nil, err
+	}
+	firewall := firewallMode(opts.Firewall)
+	switch firewall {
+	case "", firewallIPTables, firewallNFTables, firewallNone:
+	default:
+		return nil, fmt.Errorf("unknown firewall %q", opts.Firewall)
+	}
+	mode, err := parseDNSMode(opts.DNSMode)
+	if err != nil {
+		return nil, err
+	}
+	r := &linuxRouter{
+		logf:                  opts.Logf,
+		tunname:               opts.TunName,
+		netChanged:            opts.NetChanged,
+		mtu:                   opts.MTU,
+		probePathMTU:          opts.ProbePathMTU,
+		txQueueLen:            opts.TxQueueLen,
+		noARP:                 opts.NoARP,
+		hostAddrs:             opts.HostAddrs,
+		routeTable:            opts.RouteTable,
+		fwmark:                opts.FwMark,
+		routeMetric:           opts.RouteMetric,
+		routeOnlink:           opts.RouteOnlink,
+		routeTailscaleRanges:  opts.RouteTailscaleRanges,
+		repairRoutes:          opts.RepairRoutes,
+		noPrefSrc:             opts.NoPrefSrc,
+		skipConflictingRoutes: opts.SkipConflictingRoutes,
+		allowedRoutes:         append([]wgcfg.CIDR(nil), opts.AllowedRoutes...),
+		deniedRoutes:          append([]wgcfg.CIDR(nil), opts.DeniedRoutes...),
+		routeRetries:          opts.RouteRetries,
+		routeRetryInterval:    opts.RouteRetryInterval,
+		flushConntrack:        opts.FlushConntrack,
+		advertiseRoutes:       opts.AdvertiseRoutes,
+		egressIface:           opts.EgressIface,
+		snatSource:            opts.SNATSource,
+		nat66:                 opts.NAT66,
+		fastPath:              opts.FastPath,
+		firewall:              firewall,
+		dnsMode:               mode,
+		splitDNS:              opts.SplitDNS,
+		dnsDefaultRoute:       opts.DNSDefaultRoute,
+		resolvConf:            opts.ResolvConf,
+		keepDNSOnClose:        opts.KeepDNSOnClose,
+		dnsTimeout:            opts.DNSTimeout,
+		setRoutesDelay:        opts.SetRoutesDelay,
+		setRoutesMaxDelay:     opts.SetRoutesMaxDelay,
+		netns:                 opts.Netns,
+		dryRun:                opts.DryRun,
 	}
-	return exec.Command(args[0], args[1:]...)
+	if opts.Device != nil {
+		r.wgdev = opts.Device
+	}
+	return r, nil
 }
 
-func (r *linuxRouter) Up() error {
-	out, err := cmd("ip", "link", "set", r.tunname, "up").CombinedOutput()
+// capNetAdmin is the bit for CAP_NET_ADMIN in a capability set.
+const capNetAdmin = 1 << 12
+
+// hasNetAdmin reports whether the process has CAP_NET_ADMIN in its
+// effective capabilities, as root normally does.
+func hasNetAdmin() (bool, error) {
+	status, err := ioutil.ReadFile("/proc/self/status")
 	if err != nil {
-		// TODO: this should return an error; why is it calling log.Fatalf?
-		// Audit callers to make sure they're handling errors.
-		log.Fatalf("running ip link failed: %v\n%s", err, out)
+		return false, err
+	}
+	caps, err := parseCapEff(status)
+	if err != nil {
+		return false, err
+	}
+	return caps&capNetAdmin != 0, nil
+}
+
+// parseCapEff returns the effective capability set from the contents
+// of /proc/<pid>/status.
+func parseCapEff(status []byte) (uint64, error) {
+	for _, line := range strings.Split(string(status), "\n") {
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		return strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+	}
+	return 0, errors.New("no CapEff in process status")
+}
+
+// waitForTun waits for the tun device to exist, for up to
+// r.tunWait. Errors other than the device missing are returned
+// straight away.
+func (r *linuxRouter) waitForTun(ctx context.Context) error {
+	wait := r.tunWait
+	if wait == 0 {
+		wait = defaultTunWait
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		err := r.ip(ctx, "link", "show", "dev", r.tunname)
+		if !isInterfaceGone(err) {
+			return err
+		}
+		if time.Now().Add(tunPollInterval).After(deadline) {
+			return fmt.Errorf("tun device %s didn't appear within %v: %v", r.tunname, wait, err)
+		}
+		t := time.NewTimer(tunPollInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
 	}
+}
 
-	// TODO(apenwarr): This never cleans up after itself!
-	out, err = cmd("iptables",
-		"-A", "FORWARD",
-		"-i", r.tunname,
-		"-j", "ACCEPT").CombinedOutput()
+// checkTun makes sure that the device named r.tunname is a tun
+// device. One of another kind belongs to some other program, and
+// configuring it would be acting on the wrong device, so that's an
+// error. A tun device with a new interface index was deleted and made
+// again, as by a driver reload; the router forgets what it had
+// configured on the old one and carries on with the new one. A
+// persistent tun device may have been left behind by an earlier
+// tailscaled, so before the router first configures it, the addresses
+// and routes it still has from then are flushed. If the device can't
+// be inspected, as with an ip(8) too old for -j, that's only logged.
+func (r *linuxRouter) checkTun(ctx context.Context) error {
+	args := []string{"ip", "-j", "-d", "link", "show", "dev", r.tunname}
+	out, err := r.commands().Run(ctx, args...)
 	if err != nil {
-		r.logf("iptables forward failed: %v\n%s", err, out)
-	}
-	// TODO(apenwarr): hardcoded eth0 interface is obviously not right.
-	out, err = cmd("iptables",
-		"-t", "nat",
-		"-A", "POSTROUTING",
-		"-o", "eth0",
-		"-j", "MASQUERADE").CombinedOutput()
+		r.logf("checking tun device failed: %v", commandError(args, err, out))
+		return nil
+	}
+	link, err := parseTunLink(out)
 	if err != nil {
-		r.logf("iptables nat failed: %v\n%s", err, out)
+		r.logf("checking tun device failed: %v", err)
+		return nil
+	}
+	if link.kind != "" && link.kind != "tun" {
+		return fmt.Errorf("%s is a %s device, not a tun device; is another program using the name?", r.tunname, link.kind)
+	}
+	if r.tunIndex == 0 {
+		// In a network namespace, or if the device didn't exist
+		// yet when the router was made, this is the first look.
+		r.tunIndex = link.index
+	}
+	switch {
+	case link.index != r.tunIndex:
+		r.logf("tun device %s has interface index %d, not %d, so it was made again; flushing it and starting over", r.tunname, link.index, r.tunIndex)
+		r.tunIndex = link.index
+		r.mu.Lock()
+		r.local = nil
+		r.routes = nil
+		r.mu.Unlock()
+		r.vias = nil
+	case link.persist && len(r.local) == 0 && len(r.routes) == 0:
+		r.logf("tun device %s is persistent, so it may be left over from an earlier run; flushing its old addresses and routes", r.tunname)
+	default:
+		return nil
+	}
+	if err := r.ip(ctx, "addr", "flush", "dev", r.tunname, "scope", "global"); err != nil {
+		r.logf("flushing addresses failed: %v", err)
+	}
+	for _, family := range r.ipFamilies() {
+		if err := r.ip(ctx, family, "route", "flush", "dev", r.tunname, "proto", strconv.Itoa(routeProto)); err != nil {
+			r.logf("flushing routes failed: %v", err)
+		}
 	}
 	return nil
 }
 
-func (r *linuxRouter) SetRoutes(rs RouteSettings) error {
-	var errq error
+// tunLink is what checkTun needs to know about a network device.
+type tunLink struct {
+	index   int
+	kind    string // such as "tun", or "" if the kernel doesn't say
+	persist bool   // whether it's a persistent tun device
+}
 
-	if rs.LocalAddr != r.local {
-		if r.local != (wgcfg.CIDR{}) {
-			addrdel := []string{"ip", "addr",
-				"del", r.local.String(),
-				"dev", r.tunname}
-			out, err := cmd(addrdel...).CombinedOutput()
-			if err != nil {
-				r.logf("addr del failed: %v: %v\n%s", addrdel, err, out)
-				if errq == nil {
-					errq = err
-				}
-			}
+// parseTunLink returns the tunLink for the device in out, the output
+// of "ip -j -d link show dev".
+func parseTunLink(out []byte) (tunLink, error) {
+	var links []struct {
+		Index    int `json:"ifindex"`
+		LinkInfo struct {
+			Kind string `json:"info_kind"`
+			Data struct {
+				Persist bool `json:"persist"`
+			} `json:"info_data"`
+		} `json:"linkinfo"`
+	}
+	if err := json.Unmarshal(out, &links); err != nil {
+		return tunLink{}, fmt.Errorf("parsing ip -j output: %v", err)
+	}
+	if len(links) != 1 {
+		return tunLink{}, fmt.Errorf("ip -j output has %d interfaces; want 1", len(links))
+	}
+	l := links[0]
+	link := tunLink{index: l.Index, kind: l.LinkInfo.Kind}
+	link.persist = link.kind == "tun" && l.LinkInfo.Data.Persist
+	return link, nil
+}
+
+// defaultTunMTU is the tun device MTU used when none is configured.
+// It's the IPv6 minimum MTU, so that WireGuard packets carrying a
+// full-size tun packet still fit on any path the underlay takes.
+const defaultTunMTU = 1280
+
+// defaultTunWait is how long Up waits for the tun device if
+// linuxRouter.tunWait isn't set, and tunPollInterval is how often it
+// looks for it.
+const (
+	defaultTunWait  = 5 * time.Second
+	tunPollInterval = 50 * time.Millisecond
+)
+
+func (r *linuxRouter) Up(ctx context.Context) error {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	err := errRouterClosed
+	if !r.closed {
+		if err = r.up(ctx); err != nil {
+			r.undoUp(ctx)
+		} else {
+			r.checkWatch()
+		}
+	}
+	countResult("up", err)
+	return err
+}
+
+// undoUp rolls back what a failed up did, so that Up can be retried
+// from where it started: the tun device is brought down again, and
+// the firewall rules, policy rules, ARP and sysctl changes are
+// undone. Reload doesn't use it, as bringing the device down would
+// take the routes added since Up with it.
+func (r *linuxRouter) undoUp(ctx context.Context) {
+	if r.linkUp {
+		if err := r.ip(ctx, "link", "set", r.tunname, "down"); err != nil {
+			r.logf("bringing tun device down failed: %v", err)
+		}
+		r.linkUp = false
+	}
+	if r.firewall == firewallNFTables || len(r.rules) > 0 || len(r.chains) > 0 {
+		// nft may have made the table before a rule failed.
+		r.delRules(ctx)
+	}
+	r.detachFastPath(ctx)
+	r.delPolicyRules(ctx)
+	r.restoreSysctls(ctx)
+	if r.arpOff {
+		if err := r.ip(ctx, "link", "set", r.tunname, "arp", "on"); err != nil {
+			r.logf("turning ARP back on failed: %v", err)
 		}
-		addradd := []string{"ip", "addr",
-			"add", rs.LocalAddr.String(),
-			"dev", r.tunname}
-		out, err := cmd(addradd...).CombinedOutput()
+		r.arpOff = false
+	}
+}
+
+func (r *linuxRouter) up(ctx context.Context) error {
+	if r.netAdmin != nil && !r.dryRun {
+		ok, err := r.netAdmin()
 		if err != nil {
-			r.logf("addr add failed: %v: %v\n%s", addradd, err, out)
-			if errq == nil {
-				errq = err
-			}
+			r.logf("checking for CAP_NET_ADMIN failed: %v", err)
+		} else if !ok {
+			return errNotNetAdmin
 		}
 	}
+	if err := r.waitForTun(ctx); err != nil {
+		return err
+	}
 
-	newRoutes := make(map[wgcfg.CIDR]struct{})
-	for _, peer := range rs.Cfg.Peers {
-		for _, route := range peer.AllowedIPs {
-			newRoutes[route] = struct{}{}
+	// With IPv6 disabled, every IPv6 command would fail, so they're
+	// left out instead, logged once here.
+	r.v6Disabled = r.isV6Disabled(ctx)
+	if r.v6Disabled {
+		r.logf("IPv6 is disabled on this host; skipping IPv6 addresses, routes and firewall rules")
+	}
+	if !r.dryRun {
+		if err := r.checkTun(ctx); err != nil {
+			return err
 		}
 	}
-	for route := range r.routes {
-		if _, keep := newRoutes[route]; !keep {
-			net := route.IPNet()
-			nip := net.IP.Mask(net.Mask)
-			nstr := fmt.Sprintf("%v/%d", nip, route.Mask)
-			addrdel := []string{"ip", "route",
-				"del", nstr,
-				"via", r.local.IP.String(),
-				"dev", r.tunname}
-			out, err := cmd(addrdel...).CombinedOutput()
-			if err != nil {
-				r.logf("addr del failed: %v: %v\n%s", addrdel, err, out)
-				if errq == nil {
-					errq = err
-				}
-			}
+
+	if err := r.ip(ctx, "link", "set", r.tunname, "mtu", strconv.Itoa(r.tunMTU(ctx))); err != nil {
+		return fmt.Errorf("setting tun MTU failed: %v", err)
+	}
+	if r.txQueueLen != 0 {
+		if err := r.ip(ctx, "link", "set", r.tunname, "txqueuelen", strconv.Itoa(r.txQueueLen)); err != nil {
+			return fmt.Errorf("setting tun txqueuelen failed: %v", err)
 		}
 	}
-	for route := range newRoutes {
-		if _, exists := r.routes[route]; !exists {
-			net := route.IPNet()
-			nip := net.IP.Mask(net.Mask)
-			nstr := fmt.Sprintf("%v/%d", nip, route.Mask)
-			addradd := []string{"ip", "route",
-				"add", nstr,
-				"via", rs.LocalAddr.IP.String(),
-				"dev", r.tunname}
-			out, err := cmd(addradd...).CombinedOutput()
-			if err != nil {
-				r.logf("addr add failed: %v: %v\n%s", addradd, err, out)
-				if errq == nil {
-					errq = err
-				}
-			}
+
+	// Routes on the tun device come only from SetRoutes. Don't let
+	// router advertisements add others, such as a default route.
+	// This is best effort: the key can be missing even when IPv6
+	// looks enabled.
+	if !r.v6Disabled {
+		if err := r.setSysctl(ctx, "net/ipv6/conf/"+r.tunname+"/accept_ra", "0"); err != nil {
+			r.logf("disabling router advertisements failed: %v", err)
 		}
 	}
 
-	r.local = rs.LocalAddr
-	r.routes = newRoutes
+	if r.noARP {
+		if err := r.ip(ctx, "link", "set", r.tunname, "arp", "off"); err != nil {
+			return fmt.Errorf("turning off ARP failed: %v", err)
+		}
+		r.arpOff = true
+	}
 
-	// TODO: this:
-	if false {
-		if err := r.replaceResolvConf(rs.DNS, rs.DNSDomains); err != nil {
-			errq = fmt.Errorf("replacing resolv.conf failed: %v", err)
+	if err := r.ip(ctx, "link", "set", r.tunname, "up"); err != nil {
+		return err
+	}
+	r.linkUp = true
+
+	if r.routeTable != 0 && r.fwmark != 0 {
+		if err := r.addPolicyRules(ctx); err != nil {
+			return err
 		}
 	}
-	return errq
+
+	if !r.advertiseRoutes {
+		return nil
+	}
+	if r.fastPath != nil {
+		r.attachFastPath(ctx)
+	}
+	if r.firewall == "" {
+		fw := r.detectFirewall(ctx)
+		r.mu.Lock()
+		r.firewall = fw
+		r.mu.Unlock()
+		r.logf("using %s for firewall rules", r.firewall)
+	}
+	if err := r.addFirewall(ctx, false); err != nil {
+		return err
+	}
+
+	// Traffic from the subnets behind other subnet routers comes
+	// in on the tun device with sources that the kernel would
+	// route elsewhere, so strict reverse path filtering drops it.
+	// The kernel uses the larger of the "all" and per-device
+	// settings, so loosening the tun device's is enough; changing
+	// "all" would loosen every other interface too.
+	if err := r.changeSysctl(ctx, "net/ipv4/conf/"+r.tunname+"/rp_filter", "2"); err != nil {
+		r.logf("loosening rp_filter failed: %v", err)
+	}
+
+	// The FORWARD rules are no use if the kernel won't forward.
+	keys := []string{"net/ipv4/ip_forward", "net/ipv6/conf/all/forwarding"}
+	if r.v6Disabled {
+		keys = keys[:1]
+	}
+	for _, key := range keys {
+		if err := r.changeSysctl(ctx, key, "1"); err != nil {
+			r.logf("enabling IP forwarding failed: %v", err)
+		}
+	}
+	return nil
 }
 
-func (r *linuxRouter) Close() error {
-	var ret error
-	r.mon.Close()
-	if err := r.restoreResolvConf(); err != nil {
-		r.logf("failed to restore system resolv.conf: %v", err)
-		if ret == nil {
-			ret = err
+// tunMTU returns the MTU to set on the tun device, as described for
+// linuxRouter.mtu.
+func (r *linuxRouter) tunMTU(ctx context.Context) int {
+	switch {
+	case r.mtu != 0:
+		return r.mtu
+	case r.pathMTU != 0:
+		return tunMTUForPath(r.pathMTU)
+	case r.probePathMTU:
+		mtu, err := r.egressMTU(ctx)
+		if err != nil {
+			r.logf("probing path MTU failed, using %d: %v", defaultTunMTU, err)
+			return defaultTunMTU
 		}
+		return tunMTUForPath(mtu)
 	}
-	// TODO(apenwarr): clean up iptables etc.
-	return ret
+	return defaultTunMTU
 }
 
-const (
-	tsConf     = "/etc/resolv.tailscale.conf"
-	backupConf = "/etc/resolv.pre-tailscale-backup.conf"
-	resolvConf = "/etc/resolv.conf"
-)
+// egressMTU returns the MTU of the egress interface, or the interface
+// with the default route, as the best guess at the underlay's path
+// MTU short of measuring it.
+func (r *linuxRouter) egressMTU(ctx context.Context) (int, error) {
+	egress := r.egressIface
+	if egress == "" {
+		var err error
+		if egress, err = r.defaultRouteInterface(ctx); err != nil {
+			return 0, err
+		}
+	}
+	args := []string{"ip", "-o", "link", "show", "dev", egress}
+	out, err := r.commands().Run(ctx, args...)
+	if err != nil {
+		return 0, commandError(args, err, out)
+	}
+	f := strings.Fields(string(out))
+	for i := 0; i+1 < len(f); i++ {
+		if f[i] == "mtu" {
+			return strconv.Atoi(f[i+1])
+		}
+	}
+	return 0, fmt.Errorf("no MTU for %s in %q", egress, out)
+}
 
-func (r *linuxRouter) replaceResolvConf(servers []net.IP, domains []string) error {
-	if len(servers) == 0 {
-		return r.restoreResolvConf()
+// SetPathMTU implements PathMTUSetter. A configured MTU takes
+// precedence, and is left alone. Before Up, the path MTU is only
+// remembered, for Up to use.
+func (r *linuxRouter) SetPathMTU(ctx context.Context, pathMTU int) error {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	if r.closed {
+		return errRouterClosed
+	}
+	if r.mtu != 0 {
+		return nil
 	}
+	mtu := tunMTUForPath(pathMTU)
+	if !r.linkUp || (r.pathMTU != 0 && mtu == tunMTUForPath(r.pathMTU)) {
+		r.pathMTU = pathMTU
+		return nil
+	}
+	if err := r.ip(ctx, "link", "set", r.tunname, "mtu", strconv.Itoa(mtu)); err != nil {
+		return fmt.Errorf("setting tun MTU failed: %v", err)
+	}
+	r.logf("path MTU is %d; set tun MTU to %d", pathMTU, mtu)
+	r.pathMTU = pathMTU
+	return nil
+}
 
-	// First write the tsConf file.
-	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "# resolv.conf(5) file generated by tailscale\n")
-	fmt.Fprintf(buf, "#     DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n")
-	for _, ns := range servers {
-		fmt.Fprintf(buf, "nameserver %s\n", ns)
+// RepairFirewall installs again whichever of the firewall rules for
+// advertised routes are missing, such as after a firewalld reload
+// flushed them, without touching the tun device's addresses and
+// routes. It's cheap enough to call whenever a watcher sees the
+// firewall change, and installs nothing twice.
+func (r *linuxRouter) RepairFirewall(ctx context.Context) error {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	err := errRouterClosed
+	if !r.closed {
+		err = r.repairFirewall(ctx)
 	}
-	if len(domains) > 0 {
-		fmt.Fprintf(buf, "search "+strings.Join(domains, " ")+"\n")
+	countResult("repairfirewall", err)
+	return err
+}
+
+func (r *linuxRouter) repairFirewall(ctx context.Context) error {
+	if !r.linkUp || !r.advertiseRoutes || r.firewall == "" || r.firewall == firewallNone {
+		// Up hasn't installed any rules.
+		return nil
 	}
-	f, err := ioutil.TempFile(filepath.Dir(tsConf), filepath.Base(tsConf)+".*")
-	if err != nil {
-		return err
+	v6 := r.hasV6Firewall()
+	if r.firewall == firewallNFTables {
+		// nft can't check for a rule, so the table is emptied
+		// and filled again.
+		if err := r.nftFlushTables(ctx); err != nil {
+			return err
+		}
+		r.rules = nil
+	} else {
+		// Put back the chains and their jumps; addRule then
+		// checks for each of the rules in them.
+		for _, c := range r.chains {
+			chain := iptablesChains[c.chain]
+			ipt := func(args ...string) error {
+				return r.iptables(ctx, append(c.cmd(), args...)...)
+			}
+			if ipt("-C", c.chain, "-j", chain) == nil {
+				continue
+			}
+			// Failing to create the chain means it's still there.
+			ipt("-N", chain)
+			if err := ipt("-A", c.chain, "-j", chain); err != nil {
+				return err
+			}
+		}
 	}
-	f.Close()
-	if err := atomicfile.WriteFile(f.Name(), buf.Bytes(), 0644); err != nil {
+	if err := r.addFirewall(ctx, false); err != nil {
 		return err
 	}
-	os.Chmod(f.Name(), 0644) // ioutil.TempFile creates the file with 0600
-	if err := os.Rename(f.Name(), tsConf); err != nil {
-		return err
+	if v6 {
+		return r.addFirewall(ctx, true)
 	}
+	return nil
+}
 
-	if linkPath, err := os.Readlink(resolvConf); err != nil {
-		// Remove any old backup that may exist.
-		os.Remove(backupConf)
+// isV6Disabled reports whether IPv6 is disabled on the host, by
+// sysctl or by the kernel being built or booted without it.
+func (r *linuxRouter) isV6Disabled(ctx context.Context) bool {
+	val, err := r.getSysctl(ctx, "net/ipv6/conf/all/disable_ipv6")
+	if err != nil {
+		// sysctl can't stat the key without IPv6 at all.
+		return strings.Contains(err.Error(), "cannot stat")
+	}
+	return val == "1"
+}
 
-		// Backup the existing /etc/resolv.conf file.
-		contents, err := ioutil.ReadFile(resolvConf)
-		if os.IsNotExist(err) {
-			// No existing /etc/resolve.conf file to backup.
-			// Nothing to do.
-			return nil
-		} else if err != nil {
+// ipFamilies returns the ip(8) address family flags that the router
+// configures.
+func (r *linuxRouter) ipFamilies() []string {
+	if r.v6Disabled {
+		return []string{"-4"}
+	}
+	return []string{"-4", "-6"}
+}
+
+// addPolicyRules installs the ip rules that send packets marked with
+// fwmark to the router's routing table.
+func (r *linuxRouter) addPolicyRules(ctx context.Context) error {
+	for _, family := range r.ipFamilies() {
+		err := r.ip(ctx, family, "rule", "add",
+			"fwmark", fmt.Sprintf("%#x", r.fwmark),
+			"table", strconv.Itoa(r.routeTable))
+		if err != nil {
 			return err
 		}
-		if err := atomicfile.WriteFile(backupConf, contents, 0644); err != nil {
-			return err
+		r.policyRules = append(r.policyRules, family)
+	}
+	return nil
+}
+
+// delPolicyRules removes the ip rules added by addPolicyRules, and
+// flushes the router's routing table.
+func (r *linuxRouter) delPolicyRules(ctx context.Context) error {
+	var errq error
+	for _, family := range r.policyRules {
+		table := strconv.Itoa(r.routeTable)
+		err := r.ip(ctx, family, "rule", "del",
+			"fwmark", fmt.Sprintf("%#x", r.fwmark),
+			"table", table)
+		if err != nil {
+			r.logf("ip rule del failed: %v", err)
+			if errq == nil {
+				errq = err
+			}
 		}
-	} else if linkPath != tsConf {
-		// Backup the existing symlink.
-		os.Remove(backupConf)
-		if err := os.Symlink(linkPath, backupConf); err != nil {
-			return err
+		if err := r.ip(ctx, family, "route", "flush", "table", table); err != nil {
+			r.logf("ip route flush failed: %v", err)
+			if errq == nil {
+				errq = err
+			}
 		}
-	} else {
-		// Nothing to do, resolvConf already points to tsConf.
-		return nil
 	}
+	r.policyRules = nil
+	return errq
+}
 
-	os.Remove(resolvConf)
-	if err := os.Symlink(tsConf, resolvConf); err != nil {
+// addFirewall installs the rules that let traffic be forwarded from
+// the tun device, and replies to it back in, for one IP family. For
+// IPv4, it also masquerades that traffic out of the egress interface,
+// or SNATs it to snatSource; for IPv6, only with nat66.
+//
+// Only failing to allow forwarding is returned, as a subnet router
+// that can't forward is broken. The other failures are logged: the
+// rules aren't needed everywhere, such as where the FORWARD policy is
+// ACCEPT or the other networks route back to Tailscale addresses.
+func (r *linuxRouter) addFirewall(ctx context.Context, v6 bool) error {
+	if r.firewall == firewallNone || r.fastPathOn {
 		return nil
 	}
-
-	out, _ := exec.Command("service", "systemd-resolved", "restart").CombinedOutput()
-	if len(out) > 0 {
-		r.logf("service systemd-resolved restart: %s", out)
+	err := r.addRule(ctx, iptablesRule{
+		v6:    v6,
+		chain: "FORWARD",
+		spec:  []string{"-i", r.tunname, "-j", "ACCEPT"},
+	})
+	if err != nil {
+		return fmt.Errorf("iptables forward failed: %v", err)
+	}
+	// Accept the replies too, in case the FORWARD policy is DROP.
+	// Only replies: the rule above doesn't let other networks
+	// start connections into the tailnet, and neither does this.
+	err = r.addRule(ctx, iptablesRule{
+		v6:    v6,
+		chain: "FORWARD",
+		spec:  []string{"-o", r.tunname, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	})
+	if err != nil {
+		r.logf("iptables forward replies failed: %v", err)
+	}
+	if v6 && !r.nat66 {
+		return nil
+	}
+	egress := r.egressIface
+	if egress == "" {
+		egress, err = r.defaultRouteInterface(ctx)
+		if err != nil {
+			r.logf("skipping iptables nat: %v", err)
+			return nil
+		}
+	}
+	nat := []string{"-o", egress, "-j", "MASQUERADE"}
+	if r.snatSource != (wgcfg.IP{}) && !v6 {
+		nat = []string{"-o", egress, "-j", "SNAT", "--to-source", r.snatSource.String()}
+	}
+	err = r.addRule(ctx, iptablesRule{
+		v6:    v6,
+		table: "nat",
+		chain: "POSTROUTING",
+		spec:  nat,
+	})
+	if err != nil {
+		r.logf("iptables nat failed: %v", err)
 	}
 	return nil
 }
 
-func (r *linuxRouter) restoreResolvConf() error {
-	if _, err := os.Stat(backupConf); err != nil {
-		if os.IsNotExist(err) {
-			return nil // no backup resolve.conf to restore
+// iptablesRule is a firewall rule installed by the router.
+type iptablesRule struct {
+	v6    bool     // whether the rule is for ip6tables
+	table string   // if empty, the default "filter" table
+	chain string   // built-in chain the rule applies to
+	spec  []string // rule specification, like "-j", "ACCEPT"
+}
+
+// iptablesChains maps the built-in chains that the router uses to
+// the chain of its own that holds its rules for them. Keeping the
+// rules in their own chains, with a single jump from the built-in
+// chain, keeps them apart from the user's rules, and lets Close
+// remove them all without having to match each one.
+var iptablesChains = map[string]string{
+	"FORWARD":     "ts-forward",
+	"POSTROUTING": "ts-postrouting",
+}
+
+// cmd returns the start of the iptables command line for rule's
+// family and table.
+func (rule iptablesRule) cmd() []string {
+	args := []string{"iptables"}
+	if rule.v6 {
+		args[0] = "ip6tables"
+	}
+	if rule.table != "" {
+		args = append(args, "-t", rule.table)
+	}
+	return args
+}
+
+// args returns the iptables command line that performs op (such as
+// "-A" or "-D") on rule, in the router's chain for rule.chain.
+func (rule iptablesRule) args(op string) []string {
+	return append(append(rule.cmd(), op, iptablesChains[rule.chain]), rule.spec...)
+}
+
+// sameChain reports whether rule and other are in the same chain.
+func (rule iptablesRule) sameChain(other iptablesRule) bool {
+	return rule.v6 == other.v6 && rule.table == other.table && rule.chain == other.chain
+}
+
+// equal reports whether rule and other are the same rule.
+func (rule iptablesRule) equal(other iptablesRule) bool {
+	return rule.sameChain(other) && strings.Join(rule.spec, " ") == strings.Join(other.spec, " ")
+}
+
+// firewallMode is the system used to install firewall rules.
+type firewallMode string
+
+const (
+	firewallIPTables firewallMode = "iptables"
+	firewallNFTables firewallMode = "nftables"
+	firewallNone     firewallMode = "none" // neither is installed
+)
+
+// detectFirewall reports which firewall system to use. iptables is
+// preferred when it's installed, since on nftables systems it's
+// usually the iptables-nft shim and plays well with other tools.
+// With neither installed, as in minimal containers, it warns once
+// and returns firewallNone, for which no rules are installed.
+func (r *linuxRouter) detectFirewall(ctx context.Context) firewallMode {
+	_, iptErr := r.commands().Run(ctx, "iptables", "--version")
+	if iptErr == nil {
+		return firewallIPTables
+	}
+	if _, err := r.commands().Run(ctx, "nft", "--version"); err == nil {
+		return firewallNFTables
+	} else if isNotInstalled(err) && isNotInstalled(iptErr) {
+		r.logf("WARNING: neither iptables nor nft is installed; skipping firewall and NAT setup, so traffic for advertised routes may not be forwarded")
+		return firewallNone
+	}
+	return firewallIPTables
+}
+
+// addRule appends rule to the router's chain for it, creating that
+// chain first if needed, and remembers it so that Close can remove
+// it again.
+//
+// With iptables, a rule that an earlier Up already added is checked
+// for with "-C" and only appended again if it's gone, so that Up can
+// be rerun without piling up duplicate rules. The router's chains
+// hold only its own rules, so the others need no check.
+func (r *linuxRouter) addRule(ctx context.Context, rule iptablesRule) error {
+	if r.firewall == firewallNFTables {
+		if err := r.nftAddRule(ctx, rule); err != nil {
+			return err
 		}
-		return err
+		r.rules = append(r.rules, rule)
+		return nil
 	}
-	if ln, err := os.Readlink(resolvConf); err != nil {
+	if err := r.addChain(ctx, rule); err != nil {
 		return err
-	} else if ln != tsConf {
-		return fmt.Errorf("resolve.conf is not a symlink to %s", tsConf)
 	}
-	if err := os.Rename(backupConf, resolvConf); err != nil {
-		return err
+	for _, have := range r.rules {
+		if have.equal(rule) {
+			if r.iptables(ctx, rule.args("-C")...) == nil {
+				return nil
+			}
+			return r.iptables(ctx, rule.args("-A")...)
+		}
 	}
-	os.Remove(tsConf) // best effort removal of tsConf file
-	out, _ := exec.Command("service", "systemd-resolved", "restart").CombinedOutput()
-	if len(out) > 0 {
-		r.logf("service systemd-resolved restart: %s", out)
+	if err := r.iptables(ctx, rule.args("-A")...); err != nil {
+		return err
 	}
+	r.rules = append(r.rules, rule)
 	return nil
 }
+
+// addChain creates the router's chain for rule, and jumps to it from
+// the built-in chain, unless an earlier rule already did. A chain
+// left behind by a previous run that didn't get to clean up is
+// flushed and reused.
+func (r *linuxRouter) addChain(ctx context.Context, rule iptablesRule) error {
+	for _, c := range r.chains {
+		if c.sameChain(rule) {
+			return nil
+		}
+	}
+	chain := iptablesChains[rule.chain]
+	if chain == "" {
+		return fmt.Errorf("no chain for built-in chain %q", rule.chain)
+	}
+	ipt := func(args ...string) error {
+		return r.iptables(ctx, append(rule.cmd(), args...)...)
+	}
+	fresh := ipt("-N", chain) == nil
+	if !fresh {
+		if err := ipt("-F", chain); err != nil {
+			return err
+		}
+	}
+	if fresh || ipt("-C", rule.chain, "-j", chain) != nil {
+		if err := ipt("-A", rule.chain, "-j", chain); err != nil {
+			return err
+		}
+	}
+	r.chains = append(r.chains, iptablesRule{v6: rule.v6, table: rule.table, chain: rule.chain})
+	return nil
+}
+
+// delRules deletes all the rules added by addRule, by removing the
+// jumps to the router's chains, then flushing and deleting them.
+func (r *linuxRouter) delRules(ctx context.Context) error {
+	if r.firewall == firewallNFTables {
+		return r.nftDelRules(ctx)
+	}
+	var errq error
+	for i := len(r.chains) - 1; i >= 0; i-- {
+		c := r.chains[i]
+		chain := iptablesChains[c.chain]
+		for _, args := range [][]string{
+			{"-D", c.chain, "-j", chain},
+			{"-F", chain},
+			{"-X", chain},
+		} {
+			if err := r.iptables(ctx, append(c.cmd(), args...)...); err != nil {
+				r.logf("iptables del failed: %v", err)
+				if errq == nil {
+					errq = err
+				}
+			}
+		}
+	}
+	r.chains = nil
+	r.rules = nil
+	return errq
+}
+
+// iptables runs the iptables (or ip6tables) command line args.
+func (r *linuxRouter) iptables(ctx context.Context, args ...string) error {
+	if out, err := r.commands().Run(ctx, args...); err != nil {
+		return commandError(args, err, out)
+	}
+	return nil
+}
+
+// kernelState returns the addresses and routes that the kernel has
+// for the tun device. Only routes with our routeProto are returned;
+// those that the kernel or other programs added are left alone.
+// Routes whose metric isn't r.routeMetric are returned in stale
+// rather than routes. The gateway of each route is returned in
+// gateways, with the zero IP for routes that have none.
+func (r *linuxRouter) kernelState(ctx context.Context) (addrs []wgcfg.CIDR, routes, stale map[wgcfg.CIDR]struct{}, gateways map[wgcfg.CIDR]wgcfg.IP, err error) {
+	args := []string{"ip", "-o", "addr", "show", "dev", r.tunname}
+	out, err := r.commands().Run(ctx, args...)
+	if err != nil {
+		return nil, nil, nil, nil, commandError(args, err, out)
+	}
+	if addrs, err = parseAddrs(out); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	// The kernel usually has the routes of the last SetRoutes, so
+	// size the maps for them rather than growing them route by
+	// route.
+	routes = make(map[wgcfg.CIDR]struct{}, len(r.routes))
+	stale = make(map[wgcfg.CIDR]struct{})
+	gateways = make(map[wgcfg.CIDR]wgcfg.IP, len(r.routes))
+	for _, family := range r.ipFamilies() {
+		args := []string{"ip", family, "route", "show", "dev", r.tunname, "proto", strconv.Itoa(routeProto)}
+		if r.routeTable != 0 {
+			args = append(args, "table", strconv.Itoa(r.routeTable))
+		}
+		out, err := r.commands().Run(ctx, args...)
+		if err != nil {
+			return nil, nil, nil, nil, commandError(args, err, out)
+		}
+		if err := parseRoutes(out, family == "-6", r.routeMetric, routes, stale, gateways); err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+	return addrs, routes, stale, gateways, nil
+}
+
+// parseAddrs returns the addresses in out, the output of
+// "ip -o addr show". Link-local addresses are skipped.
+func parseAddrs(out []byte) ([]wgcfg.CIDR, error) {
+	var addrs []wgcfg.CIDR
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		for i := 0; i < len(f)-1; i++ {
+			if f[i] != "inet" && f[i] != "inet6" {
+				continue
+			}
+			addr, err := wgcfg.ParseCIDR(f[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("parsing %q: %v", line, err)
+			}
+			if !addr.IP.IP().IsLinkLocalUnicast() {
+				addrs = append(addrs, *addr)
+			}
+			break
+		}
+	}
+	return addrs, nil
+}
+
+// TunState implements TunStateReader.
+func (r *linuxRouter) TunState(ctx context.Context) (TunState, error) {
+	args := []string{"ip", "-j", "addr", "show", "dev", r.tunname}
+	out, err := r.commands().Run(ctx, args...)
+	if err != nil {
+		return TunState{}, commandError(args, err, out)
+	}
+	return parseTunState(out)
+}
+
+// parseTunState returns the MTU and addresses of the interface in
+// out, the output of "ip -j addr show dev".
+func parseTunState(out []byte) (TunState, error) {
+	var links []struct {
+		MTU      int `json:"mtu"`
+		AddrInfo []struct {
+			Local     string `json:"local"`
+			PrefixLen int    `json:"prefixlen"`
+		} `json:"addr_info"`
+	}
+	if err := json.Unmarshal(out, &links); err != nil {
+		return TunState{}, fmt.Errorf("parsing ip -j output: %v", err)
+	}
+	if len(links) != 1 {
+		return TunState{}, fmt.Errorf("ip -j output has %d interfaces; want 1", len(links))
+	}
+	st := TunState{MTU: links[0].MTU}
+	for _, a := range links[0].AddrInfo {
+		addr, err := wgcfg.ParseCIDR(fmt.Sprintf("%s/%d", a.Local, a.PrefixLen))
+		if err != nil {
+			return TunState{}, fmt.Errorf("parsing address %q: %v", a.Local, err)
+		}
+		st.Addrs = append(st.Addrs, *addr)
+	}
+	return st, nil
+}
+
+// defaultV6Metric is the metric that the kernel gives IPv6 routes
+// added without one.
+const defaultV6Metric = 1024
+
+// parseRoutes adds the routes in out, the output of
+// "ip route show" for IPv6 if v6 is set or IPv4 otherwise, to
+// routes, or to stale if their metric isn't metric, and their
+// gateways to gateways. Routes that the kernel added itself are
+// skipped.
+func parseRoutes(out []byte, v6 bool, metric int, routes, stale map[wgcfg.CIDR]struct{}, gateways map[wgcfg.CIDR]wgcfg.IP) error {
+	if v6 && metric == 0 {
+		metric = defaultV6Metric
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || strings.Contains(line, "proto kernel") {
+			continue
+		}
+		dst := f[0]
+		switch {
+		case dst == "default" && v6:
+			dst = "::/0"
+		case dst == "default":
+			dst = "0.0.0.0/0"
+		case strings.Contains(dst, "/"):
+		case v6:
+			dst += "/128"
+		default:
+			dst += "/32"
+		}
+		route, err := wgcfg.ParseCIDR(dst)
+		if err != nil {
+			return fmt.Errorf("parsing %q: %v", line, err)
+		}
+		got := 0
+		var gw wgcfg.IP
+		for i := 0; i < len(f)-1; i++ {
+			switch f[i] {
+			case "metric":
+				if got, err = strconv.Atoi(f[i+1]); err != nil {
+					return fmt.Errorf("parsing %q: %v", line, err)
+				}
+			case "via":
+				ip := wgcfg.ParseIP(f[i+1])
+				if ip == nil {
+					return fmt.Errorf("parsing %q: bad gateway %q", line, f[i+1])
+				}
+				gw = *ip
+			}
+		}
+		gateways[*route] = gw
+		if got != metric {
+			stale[*route] = struct{}{}
+			continue
+		}
+		routes[*route] = struct{}{}
+	}
+	return nil
+}
+
+// hasV6Firewall reports whether the router has installed any IPv6
+// firewall rules.
+func (r *linuxRouter) hasV6Firewall() bool {
+	for _, rule := range r.rules {
+		if rule.v6 {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultRouteInterface returns the name of the interface that owns
+// the default route.
+func (r *linuxRouter) defaultRouteInterface(ctx context.Context) (string, error) {
+	args := []string{"ip", "route", "show", "default"}
+	out, err := r.commands().Run(ctx, args...)
+	if err != nil {
+		return "", commandError(args, err, out)
+	}
+	return parseDefaultRouteInterface(out)
+}
+
+// parseDefaultRouteInterface returns the device of the first default
+// route in out, which is the output of "ip route show default".
+func parseDefaultRouteInterface(out []byte) (string, error) {
+	for _, line := range strings.Split(string(out), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 || f[0] != "default" {
+			continue
+		}
+		for i := 1; i < len(f)-1; i++ {
+			if f[i] == "dev" {
+				return f[i+1], nil
+			}
+		}
+	}
+	return "", errors.New("no default route found")
+}
+
+func (r *linuxRouter) SetRoutes(ctx context.Context, rs RouteSettings) error {
+	if err := rs.Validate(); err != nil {
+		return fmt.Errorf("invalid route settings: %v", err)
+	}
+	if r.setRoutesDelay > 0 {
+		return r.debounce(ctx, rs)
+	}
+	r.opMu.Lock()
+	added, removed, err := r.applyRoutes(ctx, rs)
+	r.opMu.Unlock()
+	return r.routesApplied(added, removed, err)
+}
+
+// applyRoutes applies rs, with opMu held, and returns the routes that
+// it added and removed if onRoutesChanged needs them.
+func (r *linuxRouter) applyRoutes(ctx context.Context, rs RouteSettings) (added, removed []wgcfg.CIDR, err error) {
+	if r.closed {
+		return nil, nil, errRouterClosed
+	}
+	old := r.routes
+	r.settings = rs.clone()
+	err = r.setRoutes(ctx, rs)
+	if err == nil && r.onRoutesChanged != nil {
+		removed, added = routeChanges(old, r.routes)
+	}
+	return added, removed, err
+}
+
+// routesApplied reports the result of applyRoutes, once opMu is
+// released, and returns err.
+func (r *linuxRouter) routesApplied(added, removed []wgcfg.CIDR, err error) error {
+	countResult("setroutes", err)
+	if len(added) > 0 || len(removed) > 0 {
+		r.onRoutesChanged(added, removed)
+	}
+	return err
+}
+
+// routesBatch is a burst of SetRoutes calls that are applied once.
+type routesBatch struct {
+	rs    RouteSettings // the latest call's settings
+	calls int           // number of calls in the burst
+	start time.Time     // when the first call was made
+	done  chan struct{} // closed once rs is applied
+	err   error         // result of applying rs, set before done is closed
+}
+
+// debounce makes rs the pending settings and restarts the wait for
+// the burst to end. It returns the result of applying the pending
+// settings, which may be those of a later call, or ctx.Err() if ctx
+// is done first; the settings are applied either way.
+func (r *linuxRouter) debounce(ctx context.Context, rs RouteSettings) error {
+	r.debounceMu.Lock()
+	b := r.pending
+	if b == nil {
+		b = &routesBatch{start: time.Now(), done: make(chan struct{})}
+		r.pending = b
+	}
+	b.rs = rs.clone()
+	b.calls++
+	maxDelay := r.setRoutesMaxDelay
+	if maxDelay == 0 {
+		maxDelay = 10 * r.setRoutesDelay
+	}
+	wait := r.setRoutesDelay
+	if left := maxDelay - time.Since(b.start); left < wait {
+		wait = left
+	}
+	// If the timer has already fired, applyPending either took an
+	// earlier burst or will take this one; a new timer finds
+	// nothing pending in the latter case.
+	if r.debounceTimer == nil || !r.debounceTimer.Stop() {
+		r.debounceTimer = time.AfterFunc(wait, r.applyPending)
+	} else {
+		r.debounceTimer.Reset(wait)
+	}
+	r.debounceMu.Unlock()
+
+	select {
+	case <-b.done:
+		return b.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// applyPending applies the pending burst of SetRoutes calls, if any.
+// It runs from debounceTimer, so it doesn't depend on any caller's
+// context. The burst is taken with opMu held, so that bursts are
+// applied in order.
+func (r *linuxRouter) applyPending() {
+	r.opMu.Lock()
+	r.debounceMu.Lock()
+	b := r.pending
+	r.pending = nil
+	r.debounceMu.Unlock()
+	if b == nil {
+		r.opMu.Unlock()
+		return
+	}
+	if b.calls > 1 {
+		r.logf("applying the last of %d SetRoutes calls", b.calls)
+	}
+	added, removed, err := r.applyRoutes(context.Background(), b.rs)
+	r.opMu.Unlock()
+	b.err = r.routesApplied(added, removed, err)
+	close(b.done)
+}
+
+func (r *linuxRouter) setRoutes(ctx context.Context, rs RouteSettings) error {
+	var errs MultiError
+
+	// Start from what the kernel actually has, rather than what we
+	// last asked for, so that we converge even if something else
+	// changed the tun device or we're cleaning up after a crash.
+	addrs, routes, stale, gateways, err := r.kernelState(ctx)
+	if isInterfaceGone(err) {
+		return r.interfaceGone()
+	}
+	if err != nil {
+		r.logf("reading tun state failed, using cached state: %v", err)
+		addrs, routes = r.local, r.routes
+		gateways = make(map[wgcfg.CIDR]wgcfg.IP, len(r.vias))
+		for route, via := range r.vias {
+			gateways[route] = routeGateway(route, via)
+		}
+	}
+	r.mu.Lock()
+	r.routes = routes
+	r.mu.Unlock()
+
+	if r.v6Disabled {
+		var v4 []wgcfg.CIDR
+		for _, addr := range rs.LocalAddrs {
+			if addr.IP.Is4() {
+				v4 = append(v4, addr)
+			}
+		}
+		rs.LocalAddrs = v4
+	}
+	local := rs.LocalAddrs
+	if r.hostAddrs {
+		local = make([]wgcfg.CIDR, len(rs.LocalAddrs))
+		for i, addr := range rs.LocalAddrs {
+			local[i] = hostCIDR(addr.IP)
+		}
+	}
+	delAddrs, addAddrs := addrChanges(addrs, local)
+	for _, addr := range delAddrs {
+		err := r.delAddr(ctx, addr)
+		countResult("addr_del_"+metricFamily(addr), err)
+		if isInterfaceGone(err) {
+			return r.interfaceGone()
+		}
+		if err != nil {
+			r.logf("addr del failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	for _, addr := range addAddrs {
+		err := r.addAddr(ctx, addr)
+		if isFileExists(err) {
+			// kernelState missed it, or it was added since.
+			err = nil
+		}
+		countResult("addr_add_"+metricFamily(addr), err)
+		if isInterfaceGone(err) {
+			return r.interfaceGone()
+		}
+		if err != nil {
+			r.logf("addr add failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+
+	// Routes are keyed by their network address, so that peers
+	// advertising the same network with different host bits share
+	// one route. Every route points at the tun device and WireGuard
+	// picks the peer, so the first peer in config order wins and
+	// later duplicates are only reported.
+	hops := make(map[wgcfg.CIDR]wgcfg.IP, len(rs.NextHops))
+	for dst, via := range rs.NextHops {
+		hops[networkCIDR(dst)] = via
+	}
+	// Between network maps, only a few peers change, so the last
+	// routes are a good guess at how many there'll be.
+	newRoutes := make(map[wgcfg.CIDR]struct{}, len(r.vias))
+	vias := make(map[wgcfg.CIDR]wgcfg.IP, len(r.vias))
+	owners := make(map[wgcfg.CIDR]wgcfg.Key, len(r.vias))
+	for _, peer := range rs.Cfg.Peers {
+		for _, allowed := range peer.AllowedIPs {
+			dst := networkCIDR(allowed)
+			if r.v6Disabled && dst.IP.Is6() {
+				continue
+			}
+			if isLinkScope(dst) {
+				r.logf("WARNING: route %v from peer %v is link-local or multicast; skipping it", dst, peer.PublicKey.ShortString())
+				continue
+			}
+			if !r.routePermitted(dst) {
+				r.logf("WARNING: route %v from peer %v is not permitted; skipping it", dst, peer.PublicKey.ShortString())
+				continue
+			}
+			if _, hop := hops[dst]; !hop && !r.hostAddrs {
+				if subnet, ok := onLinkSubnet(rs.LocalAddrs, dst); ok {
+					r.logf("route %v from peer %v is covered by the on-link subnet %v; skipping it", dst, peer.PublicKey.ShortString(), subnet)
+					continue
+				}
+			}
+			for _, route := range r.kernelRoutes(dst) {
+				if owner, dup := owners[route]; dup {
+					if owner != peer.PublicKey {
+						r.logf("route %v advertised by peers %v and %v, using %v", route, owner.ShortString(), peer.PublicKey.ShortString(), owner.ShortString())
+					}
+					continue
+				}
+				owners[route] = peer.PublicKey
+				newRoutes[route] = struct{}{}
+				via, ok := hops[dst]
+				if !ok {
+					via = localIP(rs.LocalAddrs, route)
+				}
+				vias[route] = via
+			}
+		}
+	}
+	if r.routeTailscaleRanges {
+		for _, dst := range tailscaleRanges {
+			if _, dup := newRoutes[dst]; dup || (r.v6Disabled && dst.IP.Is6()) || !r.routePermitted(dst) {
+				continue
+			}
+			if _, ok := onLinkSubnet(rs.LocalAddrs, dst); ok && !r.hostAddrs {
+				continue
+			}
+			newRoutes[dst] = struct{}{}
+			vias[dst] = localIP(rs.LocalAddrs, dst)
+		}
+	}
+	if r.hostAddrs {
+		// The routes that the kernel would otherwise have added
+		// for the addresses' networks.
+		for _, addr := range rs.LocalAddrs {
+			dst := networkCIDR(addr)
+			if _, dup := newRoutes[dst]; dup || dst == hostCIDR(addr.IP) {
+				continue
+			}
+			newRoutes[dst] = struct{}{}
+			vias[dst] = addr.IP
+		}
+	}
+	if r.wgdev != nil {
+		r.checkAllowedIPs(rs)
+	}
+	if r.advertiseRoutes && !r.hasV6Firewall() {
+		for route := range newRoutes {
+			if route.IP.Is6() {
+				if err := r.addFirewall(ctx, true); err != nil {
+					r.logf("%v", err)
+				}
+				break
+			}
+		}
+	}
+	// Routes are added before the old ones are deleted, so that
+	// traffic moving to a new, overlapping route always has one.
+	// The exception is routes with the wrong metric, which are
+	// deleted first: deletes don't give a metric, so they'd
+	// otherwise be as likely to hit the new route to the same
+	// destination.
+	var ops []routeOp
+	for _, route := range sortedCIDRs(stale) {
+		ops = append(ops, routeOp{dst: route, table: r.routeTable})
+	}
+	// New routes are checked against the system's own, unless
+	// they're in a table of their own.
+	var sysRoutes []systemRoute
+	haveSysRoutes := false
+	for _, route := range sortedCIDRs(newRoutes) {
+		_, exists := r.routes[route]
+		if !exists && r.routeTable == 0 {
+			if !haveSysRoutes {
+				if sysRoutes, err = r.systemRoutes(ctx); err != nil {
+					r.logf("checking for conflicting routes failed: %v", err)
+				}
+				haveSysRoutes = true
+			}
+			if conflict := shadowedRoute(sysRoutes, route); conflict != "" {
+				if r.skipConflictingRoutes {
+					r.logf("WARNING: route %v would shadow system route %q; skipping it", route, conflict)
+					delete(newRoutes, route)
+					delete(vias, route)
+					continue
+				}
+				r.logf("WARNING: route %v shadows system route %q", route, conflict)
+			}
+		}
+		// If the gateway changed, replace the route in place
+		// rather than deleting and adding it.
+		replace := exists && gateways[route] != routeGateway(route, vias[route])
+		if !exists || replace {
+			var src wgcfg.IP
+			if !r.noPrefSrc {
+				src = localIP(rs.LocalAddrs, route)
+			}
+			ops = append(ops, routeOp{add: true, replace: replace, dst: route, via: vias[route], src: src, onlink: r.routeOnlink, table: r.routeTable, metric: r.routeMetric})
+		}
+	}
+	for _, route := range sortedCIDRs(r.routes) {
+		if _, keep := newRoutes[route]; !keep {
+			ops = append(ops, routeOp{dst: route, table: r.routeTable})
+		}
+	}
+	blackholes := r.blackholeRoutes(rs)
+	for _, dst := range sortedBlackholes(blackholes) {
+		kind := blackholes[dst]
+		if old, exists := r.blackholes[dst]; !exists || old != kind {
+			ops = append(ops, routeOp{add: true, replace: exists, kind: kind, dst: dst, table: r.routeTable, metric: r.routeMetric})
+		}
+	}
+	for _, dst := range sortedBlackholes(r.blackholes) {
+		kind := r.blackholes[dst]
+		if _, keep := blackholes[dst]; !keep {
+			ops = append(ops, routeOp{kind: kind, dst: dst, table: r.routeTable})
+		}
+	}
+	var removed []wgcfg.CIDR
+	for i, err := range r.applyRouteOps(ctx, ops) {
+		if ops[i].add {
+			countResult("route_add_"+metricFamily(ops[i].dst), err)
+		} else {
+			countResult("route_del_"+metricFamily(ops[i].dst), err)
+		}
+		if err == nil {
+			if _, keep := newRoutes[ops[i].dst]; !ops[i].add && !keep && ops[i].kind == "" {
+				removed = append(removed, ops[i].dst)
+			}
+			continue
+		}
+		if ops[i].kind != "" {
+			// Keep track of the blackhole routes that are
+			// actually there, so that the next setRoutes
+			// retries the rest and Close removes them all.
+			switch {
+			case !ops[i].add:
+				blackholes[ops[i].dst] = ops[i].kind
+			case ops[i].replace:
+				blackholes[ops[i].dst] = r.blackholes[ops[i].dst]
+			default:
+				delete(blackholes, ops[i].dst)
+			}
+		}
+		if isInterfaceGone(err) {
+			return r.interfaceGone()
+		}
+		if ops[i].add {
+			r.logf("route add failed: %v", err)
+		} else {
+			r.logf("route del failed: %v", err)
+		}
+		errs = append(errs, &RouteOpError{Add: ops[i].add, Dst: ops[i].dst, Err: err})
+	}
+	if r.flushConntrack && len(removed) > 0 {
+		r.deleteConntrack(ctx, removed)
+	}
+
+	r.mu.Lock()
+	r.local = append([]wgcfg.CIDR(nil), local...)
+	r.routes = newRoutes
+	r.mu.Unlock()
+	r.vias = vias
+	r.blackholes = blackholes
+
+	// Only touch DNS when it changes: rewriting resolv.conf
+	// restarts systemd-resolved, which we don't want to do on
+	// every network map update. If only the search domains
+	// changed, they're set alone where the configurator can.
+	if dns := r.dns(); dns != nil && (!sameIPs(rs.DNS, r.dnsServers) || !sameStrings(rs.DNSDomains, r.dnsDomains)) {
+		if len(rs.DNS) > 0 {
+			// Even if SetDNS fails, it may have changed
+			// something.
+			r.dnsSet = true
+		}
+		var err error
+		if ds, ok := dns.(dnsDomainSetter); ok && len(rs.DNS) > 0 && sameIPs(rs.DNS, r.dnsServers) {
+			err = ds.SetDNSDomains(ctx, rs.DNSDomains)
+		} else {
+			err = dns.SetDNS(ctx, rs.DNS, rs.DNSDomains)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("setting DNS failed: %v", err))
+		} else {
+			r.dnsSet = len(rs.DNS) > 0
+			r.mu.Lock()
+			r.dnsServers = append([]net.IP(nil), rs.DNS...)
+			r.dnsDomains = append([]string(nil), rs.DNSDomains...)
+			r.mu.Unlock()
+		}
+	}
+	return errs.errOrNil()
+}
+
+// tailscaleRanges are the networks that Tailscale addresses come
+// from: the CGNAT range for IPv4, and Tailscale's ULA prefix for
+// IPv6.
+var tailscaleRanges = mustParseCIDRs("100.64.0.0/10", "fd7a:115c:a1e0::/48")
+
+// sortedBlackholes returns the networks of blackholes, sorted as by
+// sortedCIDRs.
+func sortedBlackholes(blackholes map[wgcfg.CIDR]string) []wgcfg.CIDR {
+	ret := make([]wgcfg.CIDR, 0, len(blackholes))
+	for dst := range blackholes {
+		ret = append(ret, dst)
+	}
+	sortCIDRs(ret)
+	return ret
+}
+
+// blackholeRoutes returns the type of each of the blackhole routes
+// that rs asks for, keyed by network.
+func (r *linuxRouter) blackholeRoutes(rs RouteSettings) map[wgcfg.CIDR]string {
+	kind := "blackhole"
+	if rs.RejectBlackholes {
+		kind = "unreachable"
+	}
+	ret := make(map[wgcfg.CIDR]string, len(rs.Blackholes))
+	for _, dst := range rs.Blackholes {
+		if r.v6Disabled && dst.IP.Is6() {
+			continue
+		}
+		ret[networkCIDR(dst)] = kind
+	}
+	return ret
+}
+
+// onLinkSubnet returns the network of the local address in addrs
+// whose on-link route, which the kernel adds along with the address,
+// already takes packets for dst to the tun device, if any. Host
+// routes, for peers' own addresses, don't count, so that each peer
+// keeps a route of its own.
+func onLinkSubnet(addrs []wgcfg.CIDR, dst wgcfg.CIDR) (wgcfg.CIDR, bool) {
+	if dst == hostCIDR(dst.IP) {
+		return wgcfg.CIDR{}, false
+	}
+	for _, addr := range addrs {
+		if subnet := networkCIDR(addr); cidrContains(subnet, dst) {
+			return subnet, true
+		}
+	}
+	return wgcfg.CIDR{}, false
+}
+
+// routePermitted reports whether allowedRoutes and deniedRoutes let
+// SetRoutes add a route to dst.
+func (r *linuxRouter) routePermitted(dst wgcfg.CIDR) bool {
+	for _, denied := range r.deniedRoutes {
+		if cidrContains(denied, dst) {
+			return false
+		}
+	}
+	if len(r.allowedRoutes) == 0 {
+		return true
+	}
+	for _, allowed := range r.allowedRoutes {
+		if cidrContains(allowed, dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteConntrack deletes the conntrack entries for connections to
+// the removed routes. It's best effort, so failures are only logged,
+// and once conntrack(8) turns out to be missing it isn't tried again.
+func (r *linuxRouter) deleteConntrack(ctx context.Context, removed []wgcfg.CIDR) {
+	if r.noConntrack {
+		return
+	}
+	for _, route := range removed {
+		family := "ipv4"
+		if route.IP.Is6() {
+			family = "ipv6"
+		}
+		ipnet := route.IPNet()
+		args := []string{"conntrack", "-D", "-f", family, "-d", networkCIDR(route).IP.String(), "--mask-dst", net.IP(ipnet.Mask).String()}
+		out, err := r.commands().Run(ctx, args...)
+		if isNotInstalled(err) {
+			r.logf("conntrack not installed; not flushing connections to removed routes")
+			r.noConntrack = true
+			return
+		}
+		// conntrack exits non-zero when there was nothing to
+		// delete.
+		if err != nil && !strings.Contains(string(out), " 0 flow entries") {
+			r.logf("conntrack flush for %v failed: %v", route, commandError(args, err, out))
+		}
+	}
+}
+
+// wgDevice is the part of the WireGuard device that the router uses.
+type wgDevice interface {
+	IpcGetOperation(w *bufio.Writer) *device.IPCError
+}
+
+// checkAllowedIPs warns about differences between the routes in rs
+// and the allowed IPs of the WireGuard device's peers: a route with no
+// peer to take its packets, or allowed IPs with no route to them,
+// means that the kernel and WireGuard disagree about where packets go.
+func (r *linuxRouter) checkAllowedIPs(rs RouteSettings) {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	if err := r.wgdev.IpcGetOperation(w); err != nil {
+		r.logf("reading WireGuard allowed IPs failed: %v", err)
+		return
+	}
+	w.Flush()
+	devIPs, err := parseAllowedIPs(b.String())
+	if err != nil {
+		r.logf("reading WireGuard allowed IPs failed: %v", err)
+		return
+	}
+	routes := make(map[wgcfg.CIDR]struct{})
+	for _, peer := range rs.Cfg.Peers {
+		for _, allowed := range peer.AllowedIPs {
+			routes[networkCIDR(allowed)] = struct{}{}
+		}
+	}
+	notRouted, noPeer := routeChanges(devIPs, routes)
+	for _, route := range noPeer {
+		r.logf("WARNING: route %v isn't in any WireGuard peer's allowed IPs", route)
+	}
+	for _, ip := range notRouted {
+		r.logf("WARNING: WireGuard allowed IPs %v have no route", ip)
+	}
+}
+
+// parseAllowedIPs returns the networks of the allowed IPs in uapi,
+// the output of a WireGuard UAPI get operation.
+func parseAllowedIPs(uapi string) (map[wgcfg.CIDR]struct{}, error) {
+	ips := make(map[wgcfg.CIDR]struct{})
+	for _, line := range strings.Split(uapi, "\n") {
+		v := strings.TrimPrefix(line, "allowed_ip=")
+		if v == line {
+			continue
+		}
+		ip, err := wgcfg.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %q: %v", line, err)
+		}
+		ips[networkCIDR(*ip)] = struct{}{}
+	}
+	return ips, nil
+}
+
+// systemRoute is a route in the main table of the system's own.
+type systemRoute struct {
+	dst  wgcfg.CIDR
+	line string // as listed by "ip route show"
+}
+
+// systemRoutes returns the routes in the main table that are on
+// devices other than the tun device. Default routes are left out: a
+// route to anywhere takes traffic from them, as that's what it's for.
+func (r *linuxRouter) systemRoutes(ctx context.Context) ([]systemRoute, error) {
+	var ret []systemRoute
+	for _, family := range r.ipFamilies() {
+		args := []string{"ip", family, "route", "show", "table", "main"}
+		out, err := r.commands().Run(ctx, args...)
+		if err != nil {
+			return nil, commandError(args, err, out)
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			f := strings.Fields(line)
+			if len(f) == 0 || f[0] == "default" {
+				continue
+			}
+			dev := ""
+			for i := 1; i < len(f)-1; i++ {
+				if f[i] == "dev" {
+					dev = f[i+1]
+					break
+				}
+			}
+			if dev == "" || dev == r.tunname {
+				continue
+			}
+			dst := f[0]
+			if !strings.Contains(dst, "/") {
+				if family == "-6" {
+					dst += "/128"
+				} else {
+					dst += "/32"
+				}
+			}
+			cidr, err := wgcfg.ParseCIDR(dst)
+			if err != nil || cidr.Mask == 0 {
+				continue // such as "unreachable 10.0.0.0/8"
+			}
+			ret = append(ret, systemRoute{dst: *cidr, line: strings.TrimSpace(line)})
+		}
+	}
+	return ret, nil
+}
+
+// shadowedRoute returns the first of routes that a route to dst would
+// take traffic away from: one for the same network, or a larger one
+// containing it. It returns "" if there isn't one.
+func shadowedRoute(routes []systemRoute, dst wgcfg.CIDR) string {
+	for _, sr := range routes {
+		if cidrContains(sr.dst, dst) {
+			return sr.line
+		}
+	}
+	return ""
+}
+
+// isInterfaceGone reports whether err, from configuring the tun
+// device, is because the device no longer exists.
+func isInterfaceGone(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, unix.ENODEV) { // rtnetlink
+		return true
+	}
+	// ip(8) only says so in its output, and net.InterfaceByName,
+	// which rtnetlink looks the device up with, has no exported
+	// error for it.
+	msg := err.Error()
+	return strings.Contains(msg, "Cannot find device") || // ip addr/route
+		strings.Contains(msg, "does not exist") || // ip addr show
+		strings.Contains(msg, "no such network interface") // net.InterfaceByName
+}
+
+// interfaceGone forgets the state of the tun device, which has been
+// deleted out from under the router, and returns ErrInterfaceGone.
+func (r *linuxRouter) interfaceGone() error {
+	r.logf("tun device %s is gone", r.tunname)
+	r.mu.Lock()
+	r.local = nil
+	r.routes = nil
+	r.mu.Unlock()
+	r.vias = nil
+	return ErrInterfaceGone
+}
+
+func (r *linuxRouter) Reload(ctx context.Context) error {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	err := errRouterClosed
+	if !r.closed {
+		err = r.reload(ctx)
+	}
+	countResult("reload", err)
+	return err
+}
+
+// reload runs up again, and reapplies the last routes and DNS
+// settings with setRoutes, which only adds what's missing from the
+// kernel.
+func (r *linuxRouter) reload(ctx context.Context) error {
+	// Forget the firewall rules, so that up adds them again. For
+	// iptables, addChain flushes and reuses the chains that are
+	// still there; for nftables, nftFlushTables does the same.
+	if r.firewall == firewallNFTables {
+		if err := r.nftFlushTables(ctx); err != nil {
+			return err
+		}
+	}
+	r.rules, r.chains = nil, nil
+	if len(r.policyRules) > 0 {
+		// Failures are logged; the rules may well be gone.
+		r.delPolicyRules(ctx)
+	}
+	if err := r.up(ctx); err != nil {
+		return err
+	}
+	r.checkWatch()
+
+	rs := r.lastSettings()
+	// Forget the DNS settings and blackhole routes too, so that
+	// they're applied again.
+	r.mu.Lock()
+	r.dnsServers, r.dnsDomains = nil, nil
+	r.mu.Unlock()
+	r.blackholes = nil
+	return r.setRoutes(ctx, rs)
+}
+
+// lastSettings returns the RouteSettings that SetRoutes was last
+// called with, for setRoutes to apply again. Before then, they're
+// empty.
+func (r *linuxRouter) lastSettings() RouteSettings {
+	if r.settings.Cfg == nil {
+		return RouteSettings{Cfg: new(wgcfg.Config)}
+	}
+	return r.settings.clone()
+}
+
+func (r *linuxRouter) Status() RouterStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return routerStatus(r.local, r.routes, r.dnsServers, r.dnsDomains)
+}
+
+// String describes the router's configuration, for bug reports.
+func (r *linuxRouter) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	firewall := r.firewall
+	if firewall == "" {
+		firewall = "undetected"
+	}
+	commands := "ip"
+	if r.netlink() != nil {
+		commands = "rtnetlink"
+	}
+	dns := string(r.dnsMode)
+	if dns == "" {
+		dns = dnsBackend(r.dnsConfig)
+	}
+	if r.fastPathOn {
+		firewall = "ebpf"
+	}
+	s := fmt.Sprintf("tun=%s firewall=%s commands=%s addrs=%v routes=%d dns=%s",
+		r.tunname, firewall, commands, r.local, len(r.routes), dns)
+	if r.dryRun {
+		s += " dryrun"
+	}
+	return s
+}
+
+func (r *linuxRouter) CheckHealth(ctx context.Context) error {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	err := errRouterClosed
+	if !r.closed {
+		err = r.checkHealth(ctx)
+	}
+	countResult("checkhealth", err)
+	return err
+}
+
+// checkHealth compares the kernel's addresses, routes and firewall
+// rules with the ones the router installed. All the routes are
+// checked, since one "ip route show" per family lists them all.
+func (r *linuxRouter) checkHealth(ctx context.Context) error {
+	addrs, routes, stale, _, err := r.kernelState(ctx)
+	if isInterfaceGone(err) {
+		return ErrInterfaceGone
+	}
+	if err != nil {
+		return err
+	}
+	var errs MultiError
+	for _, addr := range r.local {
+		found := false
+		for _, a := range addrs {
+			if a == addr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("address %v missing from %s", addr, r.tunname))
+		}
+	}
+	for _, route := range sortedCIDRs(r.routes) {
+		_, ok := routes[route]
+		if _, wrongMetric := stale[route]; !ok && !wrongMetric {
+			errs = append(errs, fmt.Errorf("route %v missing from %s", route, r.tunname))
+		}
+	}
+	if r.firewall == firewallNFTables {
+		listed := make(map[string]bool)
+		for _, rule := range r.rules {
+			args := []string{"list", "chain", rule.nftFamily(), nftTable, strings.ToLower(rule.chain)}
+			key := strings.Join(args, " ")
+			if listed[key] {
+				continue
+			}
+			listed[key] = true
+			if err := r.nft(ctx, args...); err != nil {
+				errs = append(errs, fmt.Errorf("firewall chain missing: %v", err))
+			}
+		}
+	} else {
+		for _, c := range r.chains {
+			if err := r.iptables(ctx, append(c.cmd(), "-C", c.chain, "-j", iptablesChains[c.chain])...); err != nil {
+				errs = append(errs, fmt.Errorf("firewall chain missing: %v", err))
+			}
+		}
+		for _, rule := range r.rules {
+			if err := r.iptables(ctx, rule.args("-C")...); err != nil {
+				errs = append(errs, fmt.Errorf("firewall rule missing: %v", err))
+			}
+		}
+	}
+	return errs.errOrNil()
+}
+
+// addAddr adds addr to the tun device.
+func (r *linuxRouter) addAddr(ctx context.Context, addr wgcfg.CIDR) error {
+	if nl := r.netlink(); nl != nil {
+		return nl.addAddr(ctx, r.tunname, addr)
+	}
+	return r.ip(ctx, "addr", "add", addr.String(), "dev", r.tunname)
+}
+
+// delAddr removes addr from the tun device.
+func (r *linuxRouter) delAddr(ctx context.Context, addr wgcfg.CIDR) error {
+	if nl := r.netlink(); nl != nil {
+		return nl.delAddr(ctx, r.tunname, addr)
+	}
+	return r.ip(ctx, "addr", "del", addr.String(), "dev", r.tunname)
+}
+
+// hostCIDR returns the CIDR holding just ip.
+func hostCIDR(ip wgcfg.IP) wgcfg.CIDR {
+	if ip.Is4() {
+		return wgcfg.CIDR{IP: ip, Mask: 32}
+	}
+	return wgcfg.CIDR{IP: ip, Mask: 128}
+}
+
+// kernelRoutes returns the routes to install for the network dst.
+//
+// A default route, from a peer that's an exit node, is split into
+// the two halves of the address space. Being more specific, they
+// take precedence over the system's default route without replacing
+// it, so it's still there for the host's own traffic once the routes
+// are removed. They also catch WireGuard's own packets to peers that
+// are only reachable through the default route; keeping those out
+// of the tunnel takes policy routing (routeTable and fwmark), where
+// routes go in a table that only marked traffic uses, and a default
+// route is installed as is.
+func (r *linuxRouter) kernelRoutes(dst wgcfg.CIDR) []wgcfg.CIDR {
+	if dst.Mask != 0 || (r.routeTable != 0 && r.fwmark != 0) {
+		return []wgcfg.CIDR{dst}
+	}
+	lo, hi := dst, dst
+	lo.Mask, hi.Mask = 1, 1
+	if dst.IP.Is4() {
+		hi.IP.Addr[12] = 0x80
+	} else {
+		hi.IP.Addr[0] = 0x80
+	}
+	return []wgcfg.CIDR{lo, hi}
+}
+
+// routeOp is a change to one of the tun device's routes.
+type routeOp struct {
+	add     bool       // whether to add the route, rather than delete it
+	dst     wgcfg.CIDR // route destination
+	via     wgcfg.IP   // gateway when adding; see routeGateway
+	src     wgcfg.IP   // preferred source when adding; see routeSrc
+	onlink  bool       // whether the gateway is on the tun device's link
+	replace bool       // when adding, whether to replace a route to dst
+	table   int        // routing table; if zero, the main table
+	metric  int        // metric when adding; if zero, the kernel default
+
+	// kind, if non-empty, is the type of a route that isn't
+	// through the tun device, such as "blackhole".
+	kind string
+}
+
+// routeProto is the routing protocol that routes are added with, so
+// that "ip route show" attributes them to Tailscale (as "proto 84")
+// on hosts shared with other routing software. It's a number that
+// iproute2 and the routing daemons don't use.
+const routeProto = 84
+
+// args returns the ip(8) arguments that apply op to dev.
+func (op routeOp) args(dev string) []string {
+	if op.kind != "" {
+		return op.typedArgs()
+	}
+	args := []string{"route", "del", canonicalCIDR(op.dst)}
+	if op.add {
+		args[1] = "add"
+		if op.replace {
+			args[1] = "replace"
+		}
+		if via := routeGateway(op.dst, op.via); via != (wgcfg.IP{}) {
+			args = append(args, "via", via.String())
+			if op.onlink {
+				args = append(args, "onlink")
+			}
+		}
+	}
+	args = append(args, "dev", dev)
+	if src := op.routeSrc(); src != (wgcfg.IP{}) {
+		args = append(args, "src", src.String())
+	}
+	if op.add {
+		args = append(args, "proto", strconv.Itoa(routeProto))
+	}
+	if op.table != 0 {
+		args = append(args, "table", strconv.Itoa(op.table))
+	}
+	if op.add && op.metric != 0 {
+		args = append(args, "metric", strconv.Itoa(op.metric))
+	}
+	return args
+}
+
+// typedArgs returns the ip(8) arguments that apply op, whose route is
+// of type op.kind.
+func (op routeOp) typedArgs() []string {
+	args := []string{"route", "del", op.kind, canonicalCIDR(op.dst)}
+	if op.add {
+		args[1] = "add"
+		if op.replace {
+			args[1] = "replace"
+		}
+		args = append(args, "proto", strconv.Itoa(routeProto))
+	}
+	if op.table != 0 {
+		args = append(args, "table", strconv.Itoa(op.table))
+	}
+	if op.add && op.metric != 0 {
+		args = append(args, "metric", strconv.Itoa(op.metric))
+	}
+	return args
+}
+
+// routeSrc returns the preferred source address to add op's route
+// with, or the zero IP if there's none: when deleting, or when op.src
+// isn't in the same address family as the destination.
+func (op routeOp) routeSrc() wgcfg.IP {
+	if !op.add || op.src.Is4() != op.dst.IP.Is4() {
+		return wgcfg.IP{}
+	}
+	return op.src
+}
+
+func (r *linuxRouter) applyRouteOp(ctx context.Context, op routeOp) error {
+	if nl := r.netlink(); nl != nil && op.kind == "" {
+		return nl.applyRoute(ctx, r.tunname, op)
+	}
+	return r.ip(ctx, op.args(r.tunname)...)
+}
+
+// Defaults for linuxRouter.routeRetries and routeRetryInterval.
+const (
+	defaultRouteRetries       = 3
+	defaultRouteRetryInterval = 50 * time.Millisecond
+)
+
+// applyRouteOps applies ops, and returns the error for each of them
+// (nil on success). Ops that fail with a transient error are retried,
+// with backoff. Adding a route that's already there succeeds.
+func (r *linuxRouter) applyRouteOps(ctx context.Context, ops []routeOp) []error {
+	retries, interval := r.routeRetries, r.routeRetryInterval
+	if retries == 0 {
+		retries = defaultRouteRetries
+	}
+	if interval == 0 {
+		interval = defaultRouteRetryInterval
+	}
+	errs := r.applyRouteOpsOnce(ctx, ops)
+	if r.stopWatch != nil {
+		defer func() { r.noteOwnDeletes(ops, errs) }()
+	}
+	for attempt := 0; ; attempt++ {
+		var retry []int
+		for i, err := range errs {
+			switch {
+			case ops[i].add && isFileExists(err):
+				errs[i] = nil
+			case isTransient(err):
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 || attempt >= retries {
+			return errs
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return errs
+		case <-t.C:
+		}
+		interval *= 2
+
+		r.logf("retrying %d route changes", len(retry))
+		again := make([]routeOp, len(retry))
+		for j, i := range retry {
+			again[j] = ops[i]
+		}
+		for j, err := range r.applyRouteOpsOnce(ctx, again) {
+			errs[retry[j]] = err
+		}
+	}
+}
+
+// isTransient reports whether err is one that the kernel returns
+// when it's briefly too busy to make a change, so that the change
+// is worth retrying.
+func isTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "device or resource busy") || // EBUSY
+		strings.Contains(msg, "no buffer space available") // ENOBUFS
+}
+
+// applyRouteOpsOnce applies ops, and returns the error for each of
+// them (nil on success). Without rtnetlink, all of the ops are
+// applied by a single ip(8) process, rather than starting one per
+// route, which matters on nodes with hundreds of peers.
+func (r *linuxRouter) applyRouteOpsOnce(ctx context.Context, ops []routeOp) []error {
+	errs := make([]error, len(ops))
+	if r.netlink() != nil || len(ops) < 2 {
+		for i, op := range ops {
+			errs[i] = r.applyRouteOp(ctx, op)
+		}
+		return errs
+	}
+
+	var batch bytes.Buffer
+	for _, op := range ops {
+		fmt.Fprintln(&batch, strings.Join(op.args(r.tunname), " "))
+	}
+	// With -force, ip keeps going after a failed line, and reports
+	// which ones failed.
+	args := []string{"ip", "-force", "-batch", "-"}
+	out, err := r.commands().RunStdin(ctx, batch.Bytes(), args...)
+	if err == nil {
+		return errs
+	}
+	failed := parseBatchErrors(out)
+	if len(failed) == 0 {
+		// Couldn't tell which lines failed; blame them all.
+		for i := range errs {
+			errs[i] = commandError(args, err, out)
+		}
+		return errs
+	}
+	for line, msg := range failed {
+		if line < 1 || line > len(ops) {
+			continue
+		}
+		args := append([]string{"ip"}, ops[line-1].args(r.tunname)...)
+		errs[line-1] = fmt.Errorf("%v: %s", args, msg)
+	}
+	return errs
+}
+
+// parseBatchErrors parses out, the output of "ip -force -batch -",
+// and returns the error messages that it reports, keyed by the
+// 1-based line number of the batch command that failed.
+func parseBatchErrors(out []byte) map[int]string {
+	const prefix = "Command failed -:"
+	failed := make(map[int]string)
+	var msg []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			if line != "" {
+				msg = append(msg, line)
+			}
+			continue
+		}
+		if n, err := strconv.Atoi(strings.TrimPrefix(line, prefix)); err == nil {
+			failed[n] = strings.Join(msg, "; ")
+		}
+		msg = nil
+	}
+	return failed
+}
+
+// routeGateway returns the gateway to use for a route to dst via
+// the local address via. A route can't have a gateway of another
+// address family, so if dst and via differ, the zero IP is returned
+// and the route goes straight out of the (point-to-point) tun device.
+func routeGateway(dst wgcfg.CIDR, via wgcfg.IP) wgcfg.IP {
+	if dst.IP.Is4() != via.Is4() {
+		return wgcfg.IP{}
+	}
+	return via
+}
+
+// commands returns the commandRunner to configure the system with.
+func (r *linuxRouter) commands() commandRunner {
+	if r.dryRun {
+		return dryRunner{logf: r.logf}
+	}
+	runner := r.runner
+	if r.netns != "" {
+		ip := "ip"
+		if path, ok := r.binPaths["ip"]; ok {
+			ip = path
+		}
+		runner = netnsRunner{runner: runner, ns: r.netns, ip: ip}
+	}
+	if len(r.binPaths) > 0 {
+		return binPathRunner{runner: runner, paths: r.binPaths}
+	}
+	return runner
+}
+
+// defaultDNSTimeout is how long DNS commands may take if
+// linuxRouter.dnsTimeout isn't set.
+const defaultDNSTimeout = 10 * time.Second
+
+// dnsCommands returns the commandRunner to configure DNS with, which
+// times commands out after r.dnsTimeout.
+func (r *linuxRouter) dnsCommands() commandRunner {
+	timeout := r.dnsTimeout
+	if timeout == 0 {
+		timeout = defaultDNSTimeout
+	}
+	return timeoutRunner{runner: r.commands(), timeout: timeout}
+}
+
+// netlink returns the rtnetlink connection to configure the system
+// with, or nil if ip(8) should be used instead.
+func (r *linuxRouter) netlink() *rtnetlink {
+	if r.dryRun || r.netns != "" {
+		return nil
+	}
+	return r.nl
+}
+
+// dns returns the dnsConfigurator to apply DNS settings with, or nil
+// if DNS should be left alone.
+func (r *linuxRouter) dns() dnsConfigurator {
+	if r.dryRun && r.dnsConfig != nil {
+		return dryRunDNS{logf: r.logf}
+	}
+	return r.dnsConfig
+}
+
+// changeSysctl sets the kernel parameter key to val, first saving
+// its original value for restoreSysctls.
+func (r *linuxRouter) changeSysctl(ctx context.Context, key, val string) error {
+	if _, saved := r.sysctls[key]; !saved {
+		old, err := r.getSysctl(ctx, key)
+		if err != nil {
+			return err
+		}
+		if r.sysctls == nil {
+			r.sysctls = make(map[string]string)
+		}
+		r.sysctls[key] = old
+	}
+	return r.setSysctl(ctx, key, val)
+}
+
+// restoreSysctls puts back the original values of the kernel
+// parameters changed by changeSysctl.
+func (r *linuxRouter) restoreSysctls(ctx context.Context) error {
+	var errq error
+	for key, old := range r.sysctls {
+		if old == "" {
+			continue // never known, as in a dry run
+		}
+		if err := r.setSysctl(ctx, key, old); err != nil {
+			r.logf("restoring sysctl failed: %v", err)
+			if errq == nil {
+				errq = err
+			}
+		}
+	}
+	r.sysctls = nil
+	return errq
+}
+
+// getSysctl returns the value of the kernel parameter key.
+func (r *linuxRouter) getSysctl(ctx context.Context, key string) (string, error) {
+	args := []string{"sysctl", "-n", key}
+	out, err := r.commands().Run(ctx, args...)
+	if err != nil {
+		return "", commandError(args, err, out)
+	}
+	return string(bytes.TrimSpace(out)), nil
+}
+
+// setSysctl sets the kernel parameter key to val. key is in the
+// slash-separated form, which works even when it includes a device
+// name with a dot in it.
+func (r *linuxRouter) setSysctl(ctx context.Context, key, val string) error {
+	args := []string{"sysctl", "-q", "-w", key + "=" + val}
+	if out, err := r.commands().Run(ctx, args...); err != nil {
+		return commandError(args, err, out)
+	}
+	return nil
+}
+
+// ip runs ip(8) with args.
+func (r *linuxRouter) ip(ctx context.Context, args ...string) error {
+	args = append([]string{"ip"}, args...)
+	if out, err := r.commands().Run(ctx, args...); err != nil {
+		return commandError(args, err, out)
+	}
+	return nil
+}
+
+func (r *linuxRouter) Close(ctx context.Context) error {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.close(ctx)
+	countResult("close", err)
+	return err
+}
+
+func (r *linuxRouter) close(ctx context.Context) error {
+	var errs MultiError
+	if r.mon != nil {
+		r.mon.Close()
+	}
+	if r.stopWatch != nil {
+		// Before the router's own deletions below.
+		r.stopWatch()
+		r.stopWatch, r.watchIndex, r.ownDeletes = nil, 0, nil
+	}
+	// Undo SetRoutes, removing the routes before the addresses
+	// they go via. If the device is gone, so are they.
+	var ops []routeOp
+	for _, route := range sortedCIDRs(r.routes) {
+		ops = append(ops, routeOp{dst: route, table: r.routeTable})
+	}
+	for _, dst := range sortedBlackholes(r.blackholes) {
+		ops = append(ops, routeOp{kind: r.blackholes[dst], dst: dst, table: r.routeTable})
+	}
+	for _, err := range r.applyRouteOps(ctx, ops) {
+		if err != nil && !isInterfaceGone(err) {
+			r.logf("route del failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	for _, addr := range r.local {
+		if err := r.delAddr(ctx, addr); err != nil && !isInterfaceGone(err) {
+			r.logf("addr del failed: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	r.mu.Lock()
+	r.local, r.routes = nil, nil
+	r.mu.Unlock()
+	r.vias, r.blackholes = nil, nil
+	if r.nl != nil {
+		r.nl.Close()
+	}
+	if err := r.delRules(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.detachFastPath(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.delPolicyRules(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.restoreSysctls(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if r.arpOff {
+		// If the device is gone, so is its setting.
+		if err := r.ip(ctx, "link", "set", r.tunname, "arp", "on"); err != nil && !isInterfaceGone(err) {
+			r.logf("turning ARP back on failed: %v", err)
+			errs = append(errs, err)
+		}
+		r.arpOff = false
+	}
+	// Only restore DNS if we changed it, so that closing a router
+	// that never got that far doesn't touch the system's settings.
+	if dns := r.dns(); dns != nil && r.dnsSet {
+		if r.keepDNSOnClose {
+			r.logf("leaving DNS settings in place for the next router")
+		} else if err := dns.RestoreDNS(ctx); err != nil {
+			r.logf("failed to restore system DNS: %v", err)
+			errs = append(errs, err)
+		}
+	}
+	return errs.errOrNil()
+}
@@ -0,0 +1,3454 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/tailscale/wireguard-go/device"
+	"github.com/tailscale/wireguard-go/tun"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/sys/unix"
+)
+
+func TestLinuxRouterUpError(t *testing.T) {
+	r := &linuxRouter{
+		logf:    t.Logf,
+		tunname: "tailscale0",
+		runner:  failingRunner{},
+		tunWait: time.Millisecond,
+	}
+	if err := r.Up(context.Background()); err == nil {
+		t.Fatal("Up succeeded; want error")
+	}
+}
+
+func TestLinuxRouterNotNetAdmin(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	r.netAdmin = func() (bool, error) { return false, nil }
+	if err := r.Up(context.Background()); err != errNotNetAdmin {
+		t.Errorf("unprivileged Up = %v; want %v", err, errNotNetAdmin)
+	}
+	if len(fake.cmds) != 0 {
+		t.Errorf("unprivileged Up ran %q", fake.cmds)
+	}
+
+	// A dry run doesn't need the privileges.
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, dryRun: true}
+	r.netAdmin = func() (bool, error) { return false, nil }
+	if err := r.Up(context.Background()); err != nil {
+		t.Errorf("unprivileged dry run Up: %v", err)
+	}
+
+	// Nor does Up give up when it can't tell.
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	r.netAdmin = func() (bool, error) { return false, errors.New("no /proc") }
+	if err := r.Up(context.Background()); err != nil {
+		t.Errorf("Up without a capability check: %v", err)
+	}
+}
+
+func TestParseCapEff(t *testing.T) {
+	const status = "Name:\ttailscaled\nCapInh:\t0000000000000000\nCapPrm:\t0000003fffffffff\nCapEff:\t0000000000001000\n"
+	caps, err := parseCapEff([]byte(status))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps != capNetAdmin {
+		t.Errorf("CapEff = %#x; want %#x", caps, capNetAdmin)
+	}
+	if _, err := parseCapEff([]byte("Name:\ttailscaled\n")); err == nil {
+		t.Error("no error for status without CapEff")
+	}
+}
+
+func TestLinuxRouterWaitForTun(t *testing.T) {
+	const show = "ip link show dev tailscale0"
+	fake := &flakyRunner{failures: map[string]int{show: 2}}
+	fake.outputs = map[string]string{show: `Device "tailscale0" does not exist.`}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, show); n != 3 {
+		t.Errorf("looked for the tun device %d times; want 3", n)
+	}
+	if !fake.ran("ip link set tailscale0 up") {
+		t.Errorf("tun device not brought up; ran %q", fake.cmds)
+	}
+
+	// It never appears.
+	fake = &flakyRunner{failures: map[string]int{show: 1000}}
+	fake.outputs = map[string]string{show: `Device "tailscale0" does not exist.`}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, tunWait: 3 * tunPollInterval}
+	err := r.Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "tun device tailscale0 didn't appear") {
+		t.Errorf("Up = %v; want an error saying the tun device didn't appear", err)
+	}
+	if n := countPrefix(fake.cmds, "ip link set "); n != 0 {
+		t.Errorf("configured the missing tun device anyway: %q", fake.cmds)
+	}
+}
+
+// tunLinkJSON returns what "ip -j -d link show dev tailscale0" says
+// about a tun device with interface index index.
+func tunLinkJSON(index int, persist bool) string {
+	return fmt.Sprintf(`[{"ifindex":%d,"ifname":"tailscale0","flags":["POINTOPOINT","MULTICAST","NOARP","UP","LOWER_UP"],"mtu":1280,"linkinfo":{"info_kind":"tun","info_data":{"type":"tun","pi":false,"vnet_hdr":true,"multi_queue":false,"persist":%v}}}]`, index, persist)
+}
+
+func TestLinuxRouterStaleTun(t *testing.T) {
+	const show = "ip -j -d link show dev tailscale0"
+	flushes := []string{
+		"ip addr flush dev tailscale0 scope global",
+		"ip -4 route flush dev tailscale0 proto 84",
+		"ip -6 route flush dev tailscale0 proto 84",
+	}
+
+	// A tun device left behind by an earlier run, which the engine
+	// has opened again, has its leftovers flushed.
+	fake := &fakeRunner{outputs: map[string]string{show: tunLinkJSON(5, true)}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, tunIndex: 5}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range flushes {
+		if !fake.ran(c) {
+			t.Errorf("didn't run %q; ran %q", c, fake.cmds)
+		}
+	}
+	// Once the router has configured it, Reload leaves it alone.
+	if err := r.SetRoutes(context.Background(), peerSettings(t, "100.101.102.103/10")); err != nil {
+		t.Fatal(err)
+	}
+	fake.cmds = nil
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, "ip addr flush "); n != 0 {
+		t.Errorf("Reload flushed the tun device's addresses; ran %q", fake.cmds)
+	}
+
+	// A device of another kind belongs to another program, and
+	// isn't touched.
+	wireguard := `[{"ifindex":5,"ifname":"tailscale0","mtu":1420,"linkinfo":{"info_kind":"wireguard"}}]`
+	fake = &fakeRunner{outputs: map[string]string{show: wireguard}}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, tunIndex: 5}
+	if err := r.Up(context.Background()); err == nil || !strings.Contains(err.Error(), "is a wireguard device") {
+		t.Errorf("Up = %v; want an error for the wireguard device", err)
+	}
+	if n := countPrefix(fake.cmds, "ip link set ") + countPrefix(fake.cmds, "ip addr flush "); n != 0 {
+		t.Errorf("configured another program's device: ran %q", fake.cmds)
+	}
+}
+
+func TestLinuxRouterRecreatedTun(t *testing.T) {
+	const show = "ip -j -d link show dev tailscale0"
+	fake := &fakeRunner{outputs: map[string]string{show: tunLinkJSON(5, false)}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, tunIndex: 5}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device is deleted and made again, so it has a new index.
+	// The router flushes it and configures it from scratch.
+	fake.cmds = nil
+	fake.outputs[show] = tunLinkJSON(9, false)
+	if err := r.Reload(ctx); err != nil {
+		t.Fatalf("Reload of the recreated device: %v", err)
+	}
+	if r.tunIndex != 9 {
+		t.Errorf("tunIndex = %d; want the new device's 9", r.tunIndex)
+	}
+	for _, want := range []string{
+		"ip addr flush dev tailscale0 scope global",
+		"ip -4 route flush dev tailscale0 proto 84",
+		"ip link set tailscale0 up",
+		"ip addr add 100.101.102.103/10 dev tailscale0",
+		"ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("didn't run %q; ran %q", want, fake.cmds)
+		}
+	}
+}
+
+func TestLinuxRouterBlackholes(t *testing.T) {
+	const (
+		add4 = "ip route add blackhole 10.99.0.0/16 proto 84"
+		add6 = "ip route add blackhole fd7a:dead::/32 proto 84"
+	)
+	fake := &fakeRunner{fail: map[string]bool{add6: true}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, routeRetries: -1}
+	ctx := context.Background()
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32"})
+	rs.Blackholes = []wgcfg.CIDR{mustCIDR(t, "10.99.1.2/16"), mustCIDR(t, "fd7a:dead::/32")}
+	if err := r.SetRoutes(ctx, rs); err == nil {
+		t.Error("SetRoutes succeeded with a failing route add")
+	}
+	for _, want := range []string{add4, add6} {
+		if !fake.ran(want) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+
+	// The failed one is tried again.
+	fake.fail, fake.cmds = nil, nil
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if got := countPrefix(fake.cmds, "ip route add blackhole "); got != 1 || !fake.ran(add6) {
+		t.Errorf("ran %q; want only %q of the blackhole routes", fake.cmds, add6)
+	}
+
+	// Rejecting instead replaces the routes, and dropped networks
+	// are removed.
+	fake.cmds = nil
+	rs.Blackholes, rs.RejectBlackholes = rs.Blackholes[:1], true
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip route replace unreachable 10.99.0.0/16 proto 84",
+		"ip route del blackhole fd7a:dead::/32",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+
+	fake.cmds = nil
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ip route del unreachable 10.99.0.0/16"; !fake.ran(want) {
+		t.Errorf("Close did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+func TestLinuxRouterFailedRoutes(t *testing.T) {
+	const add = "ip route add 10.2.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"
+	fake := &fakeRunner{fail: map[string]bool{add: true}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, routeRetries: -1}
+	rs := peerSettings(t, "100.101.102.103/32", []string{"10.1.0.0/16", "10.2.0.0/16"})
+	err := r.SetRoutes(context.Background(), rs)
+	if _, ok := err.(MultiError); !ok {
+		t.Fatalf("SetRoutes = %v (%T); want a MultiError", err, err)
+	}
+	adds, dels := FailedRoutes(err)
+	if fmt.Sprint(adds) != "[10.2.0.0/16]" || len(dels) != 0 {
+		t.Errorf("FailedRoutes = %v, %v; want [10.2.0.0/16], []", adds, dels)
+	}
+	if !strings.Contains(err.Error(), add) {
+		t.Errorf("error %q doesn't name the failed command", err)
+	}
+	if adds, dels := FailedRoutes(nil); adds != nil || dels != nil {
+		t.Errorf("FailedRoutes(nil) = %v, %v", adds, dels)
+	}
+}
+
+func TestLinuxRouterCommandOrder(t *testing.T) {
+	// Routes are applied in order of address, then mask length,
+	// whatever order the peers give them in; map iteration order
+	// would differ from run to run.
+	want := []string{
+		"ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add 10.2.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add 10.3.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add 100.64.0.9/32 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add 192.168.7.0/24 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add fd7a::/64 via fd7a:115c:a1e0::1 dev tailscale0 src fd7a:115c:a1e0::1 proto 84",
+		"ip route add blackhole 10.98.0.0/16 proto 84",
+		"ip route add blackhole 10.99.0.0/16 proto 84",
+	}
+	wantDel := []string{
+		"ip route add 10.0.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route del 10.1.0.0/16 dev tailscale0",
+		"ip route del 10.3.0.0/16 dev tailscale0",
+		"ip route del 192.168.7.0/24 dev tailscale0",
+		"ip route del blackhole 10.98.0.0/16",
+		"ip route del blackhole 10.99.0.0/16",
+	}
+	routeCmds := func(cmds []string) []string {
+		var ret []string
+		for _, c := range cmds {
+			if strings.HasPrefix(c, "ip route add ") || strings.HasPrefix(c, "ip route del ") {
+				ret = append(ret, c)
+			}
+		}
+		return ret
+	}
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		fake := &fakeRunner{}
+		r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, routeRetries: -1}
+		rs := peerSettings(t, "100.101.102.103/32",
+			[]string{"10.3.0.0/16", "fd7a::/64", "100.64.0.9/32"},
+			[]string{"10.1.0.0/16", "192.168.7.0/24", "10.2.0.0/16"})
+		rs.LocalAddrs = append(rs.LocalAddrs, mustCIDR(t, "fd7a:115c:a1e0::1/128"))
+		rs.Blackholes = []wgcfg.CIDR{mustCIDR(t, "10.99.0.0/16"), mustCIDR(t, "10.98.0.0/16")}
+		if err := r.SetRoutes(ctx, rs); err != nil {
+			t.Fatal(err)
+		}
+		if got := routeCmds(fake.cmds); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("SetRoutes ran\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+
+		// The kernel now has what the first call added.
+		fake.cmds = nil
+		fake.outputs = map[string]string{
+			"ip -o addr show dev tailscale0": "" +
+				"5: tailscale0    inet 100.101.102.103/32 scope global tailscale0\n" +
+				"5: tailscale0    inet6 fd7a:115c:a1e0::1/128 scope global\n",
+			"ip -4 route show dev tailscale0 proto 84": "" +
+				"10.1.0.0/16 via 100.101.102.103 src 100.101.102.103\n" +
+				"10.2.0.0/16 via 100.101.102.103 src 100.101.102.103\n" +
+				"10.3.0.0/16 via 100.101.102.103 src 100.101.102.103\n" +
+				"100.64.0.9 via 100.101.102.103 src 100.101.102.103\n" +
+				"192.168.7.0/24 via 100.101.102.103 src 100.101.102.103\n",
+			"ip -6 route show dev tailscale0 proto 84": "fd7a::/64 via fd7a:115c:a1e0::1 src fd7a:115c:a1e0::1 metric 1024 pref medium\n",
+		}
+		rs = peerSettings(t, "100.101.102.103/32",
+			[]string{"fd7a::/64", "100.64.0.9/32", "10.2.0.0/16", "10.0.0.0/16"})
+		rs.LocalAddrs = append(rs.LocalAddrs, mustCIDR(t, "fd7a:115c:a1e0::1/128"))
+		if err := r.SetRoutes(ctx, rs); err != nil {
+			t.Fatal(err)
+		}
+		if got := routeCmds(fake.cmds); fmt.Sprint(got) != fmt.Sprint(wantDel) {
+			t.Fatalf("second SetRoutes ran\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(wantDel, "\n"))
+		}
+	}
+}
+
+func TestLinuxRouterTailscaleRanges(t *testing.T) {
+	const (
+		route4 = "ip route add 100.64.0.0/10 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"
+		route6 = "ip route add fd7a:115c:a1e0::/48 via fd7a:115c:a1e0::1 dev tailscale0 src fd7a:115c:a1e0::1 proto 84"
+	)
+	ctx := context.Background()
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, routeRetries: -1, routeTailscaleRanges: true}
+	rs := peerSettings(t, "100.101.102.103/32", []string{"100.64.0.1/32", "fd7a:115c:a1e0::2/128"})
+	rs.LocalAddrs = append(rs.LocalAddrs, mustCIDR(t, "fd7a:115c:a1e0::1/128"))
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	// The peers keep their own routes alongside the ranges'.
+	for _, want := range []string{route4, route6} {
+		if !fake.ran(want) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+	if n := countPrefix(fake.cmds, "ip route add 100.64.0.1/32 "); n != 1 {
+		t.Errorf("did not add the peer's route; ran %q", fake.cmds)
+	}
+
+	// A local address's on-link route already covers the range.
+	fake = &fakeRunner{}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, routeRetries: -1, routeTailscaleRanges: true}
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10")); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, "ip route add 100.64.0.0/10 "); n != 0 {
+		t.Errorf("added a route the on-link one covers; ran %q", fake.cmds)
+	}
+	if n := countPrefix(fake.cmds, "ip route add fd7a:115c:a1e0::/48 "); n != 1 {
+		t.Errorf("did not add the IPv6 range; ran %q", fake.cmds)
+	}
+
+	fake.cmds = nil
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ip route del fd7a:115c:a1e0::/48 dev tailscale0"; !fake.ran(want) {
+		t.Errorf("Close did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+func TestLinuxRouterLinkScopeRoutes(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, routeRetries: -1}
+	rs := peerSettings(t, "100.101.102.103/32", []string{
+		"100.64.0.1/32", "169.254.0.0/16", "169.254.169.254/32", "224.0.0.251/32",
+		"fe80::/64", "ff02::fb/128", "2001:db8::/64",
+	})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range fake.cmds {
+		for _, skip := range []string{"169.254.", "224.", "fe80:", "ff02:"} {
+			if strings.HasPrefix(c, "ip route add "+skip) {
+				t.Errorf("added link-local or multicast route: %q", c)
+			}
+		}
+	}
+	st := r.Status()
+	if got, want := fmt.Sprint(st.Routes), "[100.64.0.1/32 2001:db8::/64]"; got != want {
+		t.Errorf("routes = %s; want %s", got, want)
+	}
+}
+
+func TestLinuxRouterPathMTU(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	var _ PathMTUSetter = r
+
+	// Before Up, the measured value is kept for Up to use.
+	if err := r.SetPathMTU(ctx, 9000); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ip link set tailscale0 mtu 8920"; !fake.ran(want) {
+		t.Errorf("Up didn't run %q; ran %q", want, fake.cmds)
+	}
+	tests := []struct {
+		pathMTU int
+		want    string // command run, if any
+	}{
+		{1500, "ip link set tailscale0 mtu 1420"},
+		{1500, ""}, // unchanged
+		{1300, "ip link set tailscale0 mtu 1280"},
+		{1200, ""}, // still clamped to 1280
+		{65535, "ip link set tailscale0 mtu 8920"},
+	}
+	for _, tt := range tests {
+		fake.cmds = nil
+		if err := r.SetPathMTU(ctx, tt.pathMTU); err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		if tt.want != "" {
+			want = []string{tt.want}
+		}
+		if fmt.Sprint(fake.cmds) != fmt.Sprint(want) {
+			t.Errorf("SetPathMTU(%d) ran %q; want %q", tt.pathMTU, fake.cmds, want)
+		}
+	}
+
+	// A configured MTU wins.
+	fake = &fakeRunner{}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, mtu: 1400}
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fake.cmds = nil
+	if err := r.SetPathMTU(ctx, 9000); err != nil || len(fake.cmds) != 0 {
+		t.Errorf("SetPathMTU with a configured MTU = %v, ran %q", err, fake.cmds)
+	}
+
+	// Probing uses the egress interface's MTU, falling back to the
+	// default when it can't be found.
+	fake = &fakeRunner{outputs: map[string]string{
+		"ip route show default":    "default via 192.168.1.1 dev eth0 proto dhcp metric 100\n",
+		"ip -o link show dev eth0": "2: eth0: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 9000 qdisc mq state UP mode DEFAULT group default qlen 1000\\    link/ether 52:54:00:12:34:56 brd ff:ff:ff:ff:ff:ff\n",
+	}}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, probePathMTU: true}
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ip link set tailscale0 mtu 8920"; !fake.ran(want) {
+		t.Errorf("didn't run %q; ran %q", want, fake.cmds)
+	}
+	fake = &fakeRunner{fail: map[string]bool{"ip route show default": true}}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, probePathMTU: true}
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ip link set tailscale0 mtu 1280"; !fake.ran(want) {
+		t.Errorf("didn't fall back with %q; ran %q", want, fake.cmds)
+	}
+}
+
+func TestLinuxRouterTxQueueLen(t *testing.T) {
+	for _, qlen := range []int{0, 5000} {
+		fake := &fakeRunner{}
+		r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, txQueueLen: qlen}
+		if err := r.Up(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		n := countPrefix(fake.cmds, "ip link set tailscale0 txqueuelen ")
+		if qlen == 0 && n != 0 {
+			t.Errorf("changed the kernel's default txqueuelen; ran %q", fake.cmds)
+		}
+		if want := "ip link set tailscale0 txqueuelen 5000"; qlen != 0 && (n != 1 || !fake.ran(want)) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+}
+
+func TestLinuxRouterEgressInterface(t *testing.T) {
+	tests := []struct {
+		name   string
+		egress string
+		routes string
+		want   string
+	}{
+		{
+			name:   "explicit",
+			egress: "ens5",
+			routes: "default via 10.0.0.1 dev eth0\n",
+			want:   "iptables -t nat -A ts-postrouting -o ens5 -j MASQUERADE",
+		},
+		{
+			name:   "autodetect",
+			routes: "default via 192.168.1.1 dev wlp2s0 proto dhcp metric 600\n",
+			want:   "iptables -t nat -A ts-postrouting -o wlp2s0 -j MASQUERADE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeRunner{outputs: map[string]string{
+				"ip route show default": tt.routes,
+			}}
+			r := &linuxRouter{
+				logf:            t.Logf,
+				tunname:         "tailscale0",
+				runner:          fake,
+				egressIface:     tt.egress,
+				advertiseRoutes: true,
+			}
+			if err := r.Up(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !fake.ran(tt.want) {
+				t.Errorf("%q not run; ran:\n%s", tt.want, strings.Join(fake.cmds, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseTunState(t *testing.T) {
+	const out = `[{"ifindex":5,"ifname":"tailscale0","flags":["POINTOPOINT","MULTICAST","NOARP","UP","LOWER_UP"],"mtu":1200,"qdisc":"fq_codel","operstate":"UNKNOWN","group":"default","txqlen":500,"link_type":"none","addr_info":[{"family":"inet","local":"100.101.102.103","prefixlen":10,"scope":"global","label":"tailscale0","valid_life_time":4294967295,"preferred_life_time":4294967295},{"family":"inet6","local":"fd7a:115c:a1e0::1","prefixlen":128,"scope":"global","valid_life_time":4294967295,"preferred_life_time":4294967295}]}]`
+	st, err := parseTunState([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.MTU != 1200 {
+		t.Errorf("MTU = %d; want 1200", st.MTU)
+	}
+	want := []wgcfg.CIDR{mustCIDR(t, "100.101.102.103/10"), mustCIDR(t, "fd7a:115c:a1e0::1/128")}
+	if fmt.Sprint(st.Addrs) != fmt.Sprint(want) {
+		t.Errorf("addrs = %v; want %v", st.Addrs, want)
+	}
+
+	for _, bad := range []string{"", "[]", `[{"mtu":1280,"addr_info":[{"local":"bogus","prefixlen":10}]}]`} {
+		if _, err := parseTunState([]byte(bad)); err == nil {
+			t.Errorf("parseTunState(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestLinuxRouterTunState(t *testing.T) {
+	fake := &fakeRunner{outputs: map[string]string{
+		"ip -j addr show dev tailscale0": `[{"ifname":"tailscale0","mtu":1280,"addr_info":[{"local":"100.101.102.103","prefixlen":10}]}]`,
+	}}
+	var r TunStateReader = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	st, err := r.TunState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.MTU != 1280 || len(st.Addrs) != 1 || st.Addrs[0] != mustCIDR(t, "100.101.102.103/10") {
+		t.Errorf("TunState = %+v", st)
+	}
+}
+
+func TestParseDefaultRouteInterface(t *testing.T) {
+	if _, err := parseDefaultRouteInterface([]byte("10.0.0.0/8 dev eth1\n")); err == nil {
+		t.Error("found an interface without a default route")
+	}
+	got, err := parseDefaultRouteInterface([]byte("default dev ppp0 scope link\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "ppp0" {
+		t.Errorf("got %q; want ppp0", got)
+	}
+}
+
+func TestLinuxRouterCloseDeletesRules(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+		advertiseRoutes: true,
+	}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"iptables -N ts-forward",
+		"iptables -A FORWARD -j ts-forward",
+		"iptables -A ts-forward -i tailscale0 -j ACCEPT",
+		"iptables -A ts-forward -o tailscale0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"iptables -t nat -N ts-postrouting",
+		"iptables -t nat -A POSTROUTING -j ts-postrouting",
+		"iptables -t nat -A ts-postrouting -o eth0 -j MASQUERADE",
+	}
+	if got := iptablesCmds(fake.cmds); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Up ran\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	fake.cmds = nil
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{
+		"iptables -t nat -D POSTROUTING -j ts-postrouting",
+		"iptables -t nat -F ts-postrouting",
+		"iptables -t nat -X ts-postrouting",
+		"iptables -D FORWARD -j ts-forward",
+		"iptables -F ts-forward",
+		"iptables -X ts-forward",
+	}
+	if got := iptablesCmds(fake.cmds); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Close ran\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLinuxRouterReuseChains(t *testing.T) {
+	// The chains are left over from a run that didn't clean up,
+	// and the jump from FORWARD is still there.
+	fake := &fakeRunner{fail: map[string]bool{
+		"iptables -N ts-forward":                           true,
+		"iptables -t nat -N ts-postrouting":                true,
+		"iptables -t nat -C POSTROUTING -j ts-postrouting": true,
+	}}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+		advertiseRoutes: true,
+	}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"iptables -N ts-forward",
+		"iptables -F ts-forward",
+		"iptables -C FORWARD -j ts-forward",
+		"iptables -A ts-forward -i tailscale0 -j ACCEPT",
+		"iptables -A ts-forward -o tailscale0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"iptables -t nat -N ts-postrouting",
+		"iptables -t nat -F ts-postrouting",
+		"iptables -t nat -C POSTROUTING -j ts-postrouting",
+		"iptables -t nat -A POSTROUTING -j ts-postrouting",
+		"iptables -t nat -A ts-postrouting -o eth0 -j MASQUERADE",
+	}
+	if got := iptablesCmds(fake.cmds); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Up ran\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLinuxRouterUpRollback(t *testing.T) {
+	const forward = "iptables -A ts-forward -i tailscale0 -j ACCEPT"
+	fake := &fakeRunner{fail: map[string]bool{forward: true}}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+		advertiseRoutes: true,
+		noARP:           true,
+		routeTable:      52,
+		fwmark:          0x80000,
+	}
+	err := r.Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "iptables forward failed") {
+		t.Fatalf("Up = %v; want the forwarding rule's error", err)
+	}
+	link := strings.Index(strings.Join(fake.cmds, "\n"), "ip link set tailscale0 up")
+	for _, want := range []string{
+		"ip link set tailscale0 down",
+		"iptables -D FORWARD -j ts-forward",
+		"iptables -X ts-forward",
+		"ip -4 rule del fwmark 0x80000 table 52",
+		"ip -6 rule del fwmark 0x80000 table 52",
+		"ip link set tailscale0 arp on",
+	} {
+		if !fake.ran(want) || strings.Index(strings.Join(fake.cmds, "\n"), want) < link {
+			t.Errorf("didn't roll back with %q; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	if r.linkUp || r.arpOff || len(r.chains) > 0 || len(r.policyRules) > 0 {
+		t.Errorf("state not rolled back: linkUp=%v arpOff=%v chains=%v policyRules=%v", r.linkUp, r.arpOff, r.chains, r.policyRules)
+	}
+
+	// Once the firewall works, Up can be retried.
+	fake.fail, fake.cmds = nil, nil
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, "ip link set tailscale0 down"); n != 0 {
+		t.Errorf("brought the tun device down after a successful Up")
+	}
+}
+
+// iptablesCmds returns the iptables and ip6tables commands in cmds.
+func iptablesCmds(cmds []string) []string {
+	var ret []string
+	for _, c := range cmds {
+		if strings.HasPrefix(c, "iptables ") || strings.HasPrefix(c, "ip6tables ") {
+			ret = append(ret, c)
+		}
+	}
+	return ret
+}
+
+// countRules returns the number of commands in cmds that add a
+// firewall rule to one of the router's chains.
+func countRules(cmds []string) int {
+	n := 0
+	for _, c := range iptablesCmds(cmds) {
+		if strings.Contains(c, " -A ts-") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLinuxRouterNFTables(t *testing.T) {
+	ipt := &fakeRunner{}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          ipt,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+		advertiseRoutes: true,
+	}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	nft := &fakeRunner{}
+	r = &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          nft,
+		egressIface:     "eth0",
+		firewall:        firewallNFTables,
+		advertiseRoutes: true,
+	}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"nft add table ip tailscale",
+		"nft flush table ip tailscale",
+		"nft add chain ip tailscale forward { type filter hook forward priority 0; }",
+		"nft add rule ip tailscale forward iifname tailscale0 accept",
+		"nft add rule ip tailscale forward oifname tailscale0 ct state related,established accept",
+		"nft add chain ip tailscale postrouting { type nat hook postrouting priority 100; }",
+		"nft add rule ip tailscale postrouting oifname eth0 masquerade",
+	} {
+		if !nft.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(nft.cmds, "\n"))
+		}
+	}
+	if got, want := countPrefix(nft.cmds, "nft add rule "), countRules(ipt.cmds); got != want {
+		t.Errorf("nftables added %d rules; iptables added %d", got, want)
+	}
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := "nft delete table ip tailscale"; !nft.ran(want) {
+		t.Errorf("Close did not run %q", want)
+	}
+}
+
+func TestLinuxRouterNFTablesLeftover(t *testing.T) {
+	// The add commands succeed whether or not a crashed run left
+	// the table and its rules behind, so the table is flushed
+	// before the first rule goes in.
+	fake := &fakeRunner{}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		egressIface:     "eth0",
+		firewall:        firewallNFTables,
+		advertiseRoutes: true,
+	}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range fake.cmds {
+		if strings.HasPrefix(c, "nft ") && !strings.HasPrefix(c, "nft add chain ") {
+			got = append(got, c)
+		}
+	}
+	want := []string{
+		"nft add table ip tailscale",
+		"nft flush table ip tailscale",
+		"nft add rule ip tailscale forward iifname tailscale0 accept",
+		"nft add rule ip tailscale forward oifname tailscale0 ct state related,established accept",
+		"nft add rule ip tailscale postrouting oifname eth0 masquerade",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ran:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLinuxRouterSNAT(t *testing.T) {
+	for _, fw := range []firewallMode{firewallIPTables, firewallNFTables} {
+		fake := &fakeRunner{}
+		r := &linuxRouter{
+			logf:            t.Logf,
+			tunname:         "tailscale0",
+			runner:          fake,
+			egressIface:     "eth0",
+			firewall:        fw,
+			advertiseRoutes: true,
+			snatSource:      mustCIDR(t, "192.0.2.10/32").IP,
+		}
+		if err := r.Up(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		want := "iptables -t nat -A ts-postrouting -o eth0 -j SNAT --to-source 192.0.2.10"
+		if fw == firewallNFTables {
+			want = "nft add rule ip tailscale postrouting oifname eth0 snat to 192.0.2.10"
+		}
+		if !fake.ran(want) {
+			t.Errorf("%s: %q not run; ran:\n%s", fw, want, strings.Join(fake.cmds, "\n"))
+		}
+		for _, c := range fake.cmds {
+			if strings.Contains(strings.ToLower(c), "masquerade") {
+				t.Errorf("%s: ran %q with an SNAT source", fw, c)
+			}
+		}
+	}
+}
+
+func TestDetectFirewall(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, runner: fake}
+	if got := r.detectFirewall(context.Background()); got != firewallIPTables {
+		t.Errorf("with iptables installed, got %v; want %v", got, firewallIPTables)
+	}
+	fake.fail = map[string]bool{"iptables --version": true}
+	if got := r.detectFirewall(context.Background()); got != firewallNFTables {
+		t.Errorf("without iptables, got %v; want %v", got, firewallNFTables)
+	}
+}
+
+func TestLinuxRouterDualStack(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+		advertiseRoutes: true,
+	}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rs := peerSettings(t, "100.101.102.103/10",
+		[]string{"100.101.102.104/32", "fd7a:115c:a1e0:ab12:4843:cd96:6266:6668/128"},
+		[]string{"10.0.0.0/24", "2001:db8::/64"},
+	)
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip addr add 100.101.102.103/10 dev tailscale0",
+		"ip route add 100.101.102.104/32 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add 10.0.0.0/24 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add fd7a:115c:a1e0:ab12:4843:cd96:6266:6668/128 dev tailscale0 proto 84",
+		"ip route add 2001:db8::/64 dev tailscale0 proto 84",
+		"iptables -A ts-forward -i tailscale0 -j ACCEPT",
+		"iptables -A ts-forward -o tailscale0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"ip6tables -A ts-forward -i tailscale0 -j ACCEPT",
+		"ip6tables -A ts-forward -o tailscale0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ip6tables -X ts-forward"; !fake.ran(want) {
+		t.Errorf("Close did not run %q", want)
+	}
+}
+
+// TestLinuxRouterForwardReplies checks that forwarding works both
+// ways under a FORWARD policy of DROP: out of the tun device for
+// everything, and back into it for replies.
+func TestLinuxRouterV6Disabled(t *testing.T) {
+	for _, disabled := range []fakeResponse{
+		{prefix: "sysctl -n net/ipv6/conf/all/disable_ipv6", out: "1\n"},
+		{prefix: "sysctl -n net/ipv6/", out: "sysctl: cannot stat /proc/sys/net/ipv6/conf/all/disable_ipv6: No such file or directory\n", err: errors.New("exit status 255")},
+	} {
+		fake := &fakeRunner{script: []fakeResponse{disabled}}
+		r := &linuxRouter{
+			logf:            t.Logf,
+			tunname:         "tailscale0",
+			runner:          fake,
+			advertiseRoutes: true,
+			egressIface:     "eth0",
+			routeTable:      52,
+			fwmark:          0x80000,
+		}
+		ctx := context.Background()
+		if err := r.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "fd7a:1::/48"})
+		rs.LocalAddrs = append(rs.LocalAddrs, mustCIDR(t, "fd7a::1/48"))
+		if err := r.SetRoutes(ctx, rs); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range fake.cmds {
+			if strings.Contains(c, "ip6tables") || strings.Contains(c, "-6") || strings.Contains(c, "fd7a:") || strings.HasPrefix(c, "sysctl -q -w net/ipv6/") {
+				t.Errorf("%q: ran %q with IPv6 disabled", disabled.out, c)
+			}
+		}
+		if want := "ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84 table 52"; !fake.ran(want) {
+			t.Errorf("%q: did not run %q; ran:\n%s", disabled.out, want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+}
+
+func TestLinuxRouterForwardReplies(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		fake := &fakeRunner{}
+		r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, egressIface: "eth0", firewall: firewallIPTables}
+		r.addFirewall(context.Background(), v6)
+		ipt := "iptables"
+		if v6 {
+			ipt = "ip6tables"
+		}
+		for _, want := range []string{
+			ipt + " -A ts-forward -i tailscale0 -j ACCEPT",
+			ipt + " -A ts-forward -o tailscale0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		} {
+			if !fake.ran(want) {
+				t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+			}
+		}
+	}
+}
+
+func TestLinuxRouterAdvertiseRoutes(t *testing.T) {
+	for _, advertise := range []bool{false, true} {
+		fake := &fakeRunner{}
+		r := &linuxRouter{
+			logf:            t.Logf,
+			tunname:         "tailscale0",
+			runner:          fake,
+			egressIface:     "eth0",
+			firewall:        firewallIPTables,
+			advertiseRoutes: advertise,
+		}
+		if err := r.Up(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		rs := peerSettings(t, "100.101.102.103/10", []string{"2001:db8::/64"})
+		if err := r.SetRoutes(context.Background(), rs); err != nil {
+			t.Fatal(err)
+		}
+		got := countRules(fake.cmds)
+		if advertise && got != 5 {
+			t.Errorf("advertising routes, got %d firewall rules; want 5", got)
+		}
+		if n := len(iptablesCmds(fake.cmds)); !advertise && n != 0 {
+			t.Errorf("not advertising routes, got %d firewall commands; want 0", n)
+		}
+	}
+}
+
+// fakeFastPath is a FastPath that records what it's attached to.
+type fakeFastPath struct {
+	err      error    // if non-nil, Attach fails with it
+	attached []string // tun and egress of each Attach
+	detached int      // number of Detach calls
+}
+
+func (f *fakeFastPath) Attach(ctx context.Context, tun, egress string, snat wgcfg.IP) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.attached = append(f.attached, tun+" "+egress)
+	return nil
+}
+
+func (f *fakeFastPath) Detach(ctx context.Context) error {
+	f.detached++
+	return nil
+}
+
+func TestLinuxRouterFastPath(t *testing.T) {
+	ctx := context.Background()
+	for _, loadErr := range []error{nil, errors.New("loading BPF program: operation not permitted")} {
+		fake := &fakeRunner{}
+		fp := &fakeFastPath{err: loadErr}
+		r := &linuxRouter{
+			logf:            t.Logf,
+			tunname:         "tailscale0",
+			runner:          fake,
+			egressIface:     "eth0",
+			firewall:        firewallIPTables,
+			advertiseRoutes: true,
+			fastPath:        fp,
+		}
+		if err := r.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		rs := peerSettings(t, "100.101.102.103/10", []string{"2001:db8::/64"})
+		if err := r.SetRoutes(ctx, rs); err != nil {
+			t.Fatal(err)
+		}
+		rules := countRules(fake.cmds)
+		if loadErr != nil {
+			// It falls back to the firewall rules.
+			if rules != 5 || r.fastPathOn {
+				t.Errorf("with the fast path failing, got %d firewall rules, fastPathOn=%v; want 5, false", rules, r.fastPathOn)
+			}
+		} else {
+			if rules != 0 || fmt.Sprint(fp.attached) != "[tailscale0 eth0]" {
+				t.Errorf("with the fast path, got %d firewall rules, attached %q; want 0, [tailscale0 eth0]", rules, fp.attached)
+			}
+			if s := r.String(); !strings.Contains(s, "firewall=ebpf") {
+				t.Errorf("String() = %q; want firewall=ebpf", s)
+			}
+		}
+		if err := r.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		want := 1
+		if loadErr != nil {
+			want = 0
+		}
+		if fp.detached != want {
+			t.Errorf("Close detached %d times; want %d", fp.detached, want)
+		}
+	}
+}
+
+func TestLinuxRouterRepairFirewall(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeRunner{}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+		advertiseRoutes: true,
+	}
+	var _ FirewallRepairer = r
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"2001:db8::/64"})
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is missing, so nothing is added.
+	fake.cmds = nil
+	if err := r.RepairFirewall(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRules(fake.cmds); n != 0 {
+		t.Errorf("repairing intact rules added %d; ran:\n%s", n, strings.Join(fake.cmds, "\n"))
+	}
+
+	// Something flushed the IPv4 rules, and deleted the nat chain.
+	fake.cmds = nil
+	fake.fail = map[string]bool{
+		"iptables -C FORWARD -j ts-forward":                                                         true,
+		"iptables -C ts-forward -i tailscale0 -j ACCEPT":                                            true,
+		"iptables -C ts-forward -o tailscale0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT": true,
+		"iptables -t nat -C POSTROUTING -j ts-postrouting":                                          true,
+		"iptables -t nat -C ts-postrouting -o eth0 -j MASQUERADE":                                   true,
+		"iptables -N ts-forward":                                                                    true,
+	}
+	if err := r.RepairFirewall(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"iptables -A FORWARD -j ts-forward",
+		"iptables -t nat -N ts-postrouting",
+		"iptables -t nat -A POSTROUTING -j ts-postrouting",
+		"iptables -A ts-forward -i tailscale0 -j ACCEPT",
+		"iptables -A ts-forward -o tailscale0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+		"iptables -t nat -A ts-postrouting -o eth0 -j MASQUERADE",
+	}
+	for _, c := range want {
+		if !fake.ran(c) {
+			t.Errorf("did not run %q; ran:\n%s", c, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	if got := countRules(fake.cmds); got != 3 {
+		t.Errorf("added %d rules; want the 3 missing ones", got)
+	}
+	for _, c := range fake.cmds {
+		if strings.HasPrefix(c, "ip ") {
+			t.Errorf("touched the tun device: ran %q", c)
+		}
+	}
+}
+
+func TestLinuxRouterNAT66(t *testing.T) {
+	const masq6 = "ip6tables -t nat -A ts-postrouting -o eth0 -j MASQUERADE"
+	tests := []struct {
+		name   string
+		nat66  bool
+		routes []string
+		want   bool
+	}{
+		{"off", false, []string{"10.1.0.0/16", "2001:db8::/64"}, false},
+		{"no v6 routes", true, []string{"10.1.0.0/16"}, false},
+		{"on", true, []string{"10.1.0.0/16", "2001:db8::/64"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			fake := &fakeRunner{}
+			r := &linuxRouter{
+				logf:            t.Logf,
+				tunname:         "tailscale0",
+				runner:          fake,
+				egressIface:     "eth0",
+				snatSource:      mustCIDR(t, "192.0.2.10/32").IP,
+				firewall:        firewallIPTables,
+				advertiseRoutes: true,
+				nat66:           tt.nat66,
+			}
+			if err := r.Up(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", tt.routes)); err != nil {
+				t.Fatal(err)
+			}
+			if got := fake.ran(masq6); got != tt.want {
+				t.Errorf("ran %q = %v; want %v", masq6, got, tt.want)
+			}
+			if n := countPrefix(fake.cmds, "ip6tables -t nat "); !tt.want && n != 0 {
+				t.Errorf("ran %d ip6tables nat commands; want none", n)
+			}
+
+			fake.cmds = nil
+			if err := r.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if want := "ip6tables -t nat -X ts-postrouting"; tt.want && !fake.ran(want) {
+				t.Errorf("Close did not run %q; ran %q", want, fake.cmds)
+			}
+		})
+	}
+}
+
+func TestLinuxRouterUpTwice(t *testing.T) {
+	const forward = "iptables -A ts-forward -i tailscale0 -j ACCEPT"
+	ctx := context.Background()
+	fake := &fakeRunner{}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+		advertiseRoutes: true,
+	}
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rules := len(r.rules)
+
+	// The fake reports every rule as already present.
+	fake.cmds = nil
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRules(fake.cmds); n != 0 {
+		t.Errorf("Up again added %d rules; ran:\n%s", n, strings.Join(iptablesCmds(fake.cmds), "\n"))
+	}
+	if !fake.ran("iptables -C ts-forward -i tailscale0 -j ACCEPT") {
+		t.Errorf("Up again didn't check for the rules; ran:\n%s", strings.Join(iptablesCmds(fake.cmds), "\n"))
+	}
+	if len(r.rules) != rules {
+		t.Errorf("Up again recorded %d rules; want %d", len(r.rules), rules)
+	}
+
+	// A rule that went missing is added back, and only that one.
+	fake.cmds = nil
+	fake.fail = map[string]bool{"iptables -C ts-forward -i tailscale0 -j ACCEPT": true}
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRules(fake.cmds); n != 1 || !fake.ran(forward) {
+		t.Errorf("ran:\n%s\nwant only %q added", strings.Join(iptablesCmds(fake.cmds), "\n"), forward)
+	}
+	if len(r.rules) != rules {
+		t.Errorf("Up again recorded %d rules; want %d", len(r.rules), rules)
+	}
+}
+
+func TestLinuxRouterReconcile(t *testing.T) {
+	fake := &fakeRunner{outputs: map[string]string{
+		"ip -o addr show dev tailscale0": "" +
+			"5: tailscale0    inet 100.101.102.99/10 scope global tailscale0\\       valid_lft forever preferred_lft forever\n" +
+			"5: tailscale0    inet6 fe80::1/64 scope link \\       valid_lft forever preferred_lft forever\n",
+		"ip -4 route show dev tailscale0 proto 84": "" +
+			"10.9.0.0/16 via 100.101.102.99\n" +
+			"100.64.0.0/10 proto kernel scope link src 100.101.102.99\n" +
+			"100.101.102.1 via 100.101.102.99\n",
+		"ip -6 route show dev tailscale0 proto 84": "" +
+			"2001:db8::/64 metric 1024 pref medium\n" +
+			"fe80::/64 proto kernel metric 256 pref medium\n",
+	}}
+	r := &linuxRouter{
+		logf:    t.Logf,
+		tunname: "tailscale0",
+		runner:  fake,
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.101.102.1/32", "10.0.0.0/24"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip addr del 100.101.102.99/10 dev tailscale0",
+		"ip addr add 100.101.102.103/10 dev tailscale0",
+		"ip route del 10.9.0.0/16 dev tailscale0",
+		"ip route del 2001:db8::/64 dev tailscale0",
+		"ip route add 10.0.0.0/24 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		// The route is already there, but via the old address.
+		"ip route replace 100.101.102.1/32 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	for _, c := range fake.cmds {
+		if strings.Contains(c, "100.64.0.0/10") || strings.Contains(c, "fe80::") || strings.HasPrefix(c, "ip route add 100.101.102.1/32") {
+			t.Errorf("unexpected command %q", c)
+		}
+	}
+}
+
+func TestLinuxRouterBatchErrors(t *testing.T) {
+	fake := &fakeRunner{
+		outputs: map[string]string{
+			"ip route add 10.0.0.0/24 via 100.101.102.103 dev tailscale0 proto 84": "Error: Nexthop has invalid gateway.",
+		},
+		fail: map[string]bool{
+			"ip route add 10.0.0.0/24 via 100.101.102.103 dev tailscale0 proto 84": true,
+		},
+	}
+	r := &linuxRouter{
+		logf:    t.Logf,
+		tunname: "tailscale0",
+		runner:  fake,
+	}
+	ops := []routeOp{
+		{add: true, dst: mustCIDR(t, "10.0.0.0/24"), via: mustCIDR(t, "100.101.102.103/32").IP},
+		{add: true, dst: mustCIDR(t, "10.1.0.0/24"), via: mustCIDR(t, "100.101.102.103/32").IP},
+	}
+	errs := r.applyRouteOps(context.Background(), ops)
+	if countPrefix(fake.cmds, "ip -force -batch -") != 1 {
+		t.Errorf("ops not batched; ran:\n%s", strings.Join(fake.cmds, "\n"))
+	}
+	if errs[0] == nil || !strings.Contains(errs[0].Error(), "Nexthop has invalid gateway") {
+		t.Errorf("first op: got error %v; want the nexthop failure", errs[0])
+	}
+	if errs[1] != nil {
+		t.Errorf("second op: got error %v; want nil", errs[1])
+	}
+}
+
+// execTrueRunner runs true(1) in place of any command, and cat(1)
+// in place of any batch command, to measure the cost of starting
+// processes without needing root.
+type execTrueRunner struct{}
+
+func (execTrueRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	return exec.Command("true").CombinedOutput()
+}
+
+func (execTrueRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	c := exec.Command("cat")
+	c.Stdin = bytes.NewReader(stdin)
+	return c.CombinedOutput()
+}
+
+func BenchmarkLinuxRouterRoutes(b *testing.B) {
+	if _, err := exec.LookPath("true"); err != nil {
+		b.Skip("no true(1) to exec")
+	}
+	r := &linuxRouter{
+		logf:    b.Logf,
+		tunname: "tailscale0",
+		runner:  execTrueRunner{},
+	}
+	var ops []routeOp
+	for i := 0; i < 500; i++ {
+		ops = append(ops, routeOp{
+			add: true,
+			dst: wgcfg.CIDR{IP: wgcfg.IPv4(10, byte(i>>8), byte(i), 0), Mask: 24},
+			via: wgcfg.IPv4(100, 101, 102, 103),
+		})
+	}
+	b.Run("per-route", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, op := range ops {
+				r.applyRouteOp(context.Background(), op)
+			}
+		}
+	})
+	b.Run("batched", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			r.applyRouteOps(context.Background(), ops)
+		}
+	})
+}
+
+func TestLinuxRouterPolicyRouting(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{
+		logf:       t.Logf,
+		tunname:    "tailscale0",
+		runner:     fake,
+		routeTable: 52,
+		fwmark:     0x80000,
+	}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.0.0.0/24"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip -4 rule add fwmark 0x80000 table 52",
+		"ip -6 rule add fwmark 0x80000 table 52",
+		"ip -4 route show dev tailscale0 proto 84 table 52",
+		"ip route add 10.0.0.0/24 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84 table 52",
+		"ip -4 rule del fwmark 0x80000 table 52",
+		"ip -4 route flush table 52",
+		"ip -6 rule del fwmark 0x80000 table 52",
+		"ip -6 route flush table 52",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+}
+
+func TestExecRunner(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh(1) to exec")
+	}
+	out, err := execRunner{}.Run(context.Background(), "sh", "-c", "echo out; echo err >&2; exit 3")
+	if err == nil {
+		t.Error("failing command returned no error")
+	}
+	if got, want := string(out), "out\nerr\n"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+	out, err = execRunner{}.RunStdin(context.Background(), []byte("in\n"), "cat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), "in\n"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+}
+
+func TestLinuxRouterMTU(t *testing.T) {
+	tests := []struct {
+		mtu  int
+		want string
+	}{
+		{0, "ip link set tailscale0 mtu 1280"},
+		{1420, "ip link set tailscale0 mtu 1420"},
+	}
+	for _, tt := range tests {
+		fake := &fakeRunner{}
+		r := &linuxRouter{
+			logf:    t.Logf,
+			tunname: "tailscale0",
+			runner:  fake,
+			mtu:     tt.mtu,
+		}
+		if err := r.Up(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if !fake.ran(tt.want) {
+			t.Errorf("mtu %d: %q not run; ran:\n%s", tt.mtu, tt.want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+}
+
+func TestLinuxRouterInvalidSettings(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	rs := peerSettings(t, "", []string{"10.1.0.0/16"})
+	if err := r.SetRoutes(context.Background(), rs); err == nil || !strings.Contains(err.Error(), "invalid route settings") {
+		t.Errorf("SetRoutes = %v; want invalid route settings", err)
+	}
+	if len(fake.cmds) != 0 {
+		t.Errorf("ran %q for invalid settings", fake.cmds)
+	}
+}
+
+func TestLinuxRouterSetRoutesErrors(t *testing.T) {
+	fake := &fakeRunner{fail: map[string]bool{
+		"ip route add 10.0.0.0/24 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84": true,
+		"ip route add 10.1.0.0/24 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84": true,
+	}}
+	r := &linuxRouter{
+		logf:    t.Logf,
+		tunname: "tailscale0",
+		runner:  fake,
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.0.0.0/24", "10.1.0.0/24", "10.2.0.0/24"})
+	err := r.SetRoutes(context.Background(), rs)
+	merr, ok := err.(MultiError)
+	if !ok {
+		t.Fatalf("got error %#v; want a MultiError", err)
+	}
+	if len(merr) != 2 {
+		t.Fatalf("got %d errors; want 2: %v", len(merr), merr)
+	}
+	for _, want := range []string{"10.0.0.0/24", "10.1.0.0/24"} {
+		if !strings.Contains(merr.Error(), want) {
+			t.Errorf("error %q doesn't mention %s", merr, want)
+		}
+	}
+}
+
+// fakeDNS is a dnsConfigurator that records what it's asked to do.
+type fakeDNS struct {
+	sets     []string // servers and domains of each SetDNS call
+	restores int
+}
+
+func (f *fakeDNS) SetDNS(ctx context.Context, servers []net.IP, domains []string) error {
+	f.sets = append(f.sets, fmt.Sprintf("%v %v", servers, domains))
+	return nil
+}
+
+func (f *fakeDNS) RestoreDNS(ctx context.Context) error {
+	f.restores++
+	return nil
+}
+
+func TestLinuxRouterDNSOnlyOnChange(t *testing.T) {
+	dns := &fakeDNS{}
+	r := &linuxRouter{
+		logf:      t.Logf,
+		tunname:   "tailscale0",
+		runner:    &fakeRunner{},
+		dnsConfig: dns,
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	rs.DNSDomains = []string{"example.com"}
+	for i := 0; i < 3; i++ {
+		if err := r.SetRoutes(context.Background(), rs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dns.sets) != 1 {
+		t.Fatalf("DNS set %d times for unchanged settings, want 1: %q", len(dns.sets), dns.sets)
+	}
+	if want := "[100.100.100.100] [example.com]"; dns.sets[0] != want {
+		t.Errorf("DNS set to %q, want %q", dns.sets[0], want)
+	}
+
+	rs.DNSDomains = []string{"example.com", "example.net"}
+	for i := 0; i < 3; i++ {
+		if err := r.SetRoutes(context.Background(), rs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(dns.sets) != 2 {
+		t.Fatalf("DNS set %d times after one change, want 2: %q", len(dns.sets), dns.sets)
+	}
+
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if dns.restores != 1 {
+		t.Errorf("Close restored DNS %d times, want 1", dns.restores)
+	}
+}
+
+// namedTun is a fake tun device with the given name.
+type namedTun struct {
+	tun.Device
+	name string
+}
+
+func (t namedTun) Name() (string, error) { return t.name, nil }
+
+func TestNewRouterBadTunName(t *testing.T) {
+	for _, name := range []string{"", "tailscale0123456789"} {
+		tuntap := namedTun{NewFakeTun(), name}
+		tunname, err := tuntap.Name()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewRouter(RouterOptions{Logf: t.Logf, TunName: tunname, Tun: tuntap})
+		if err == nil {
+			r.Close(context.Background())
+			t.Errorf("NewRouter accepted tun name %q", name)
+		}
+	}
+}
+
+func TestNewLinuxRouterOptions(t *testing.T) {
+	netChanged := false
+	opts := RouterOptions{
+		Logf:                  t.Logf,
+		TunName:               "tailscale0",
+		Device:                new(device.Device),
+		Tun:                   NewFakeTun(),
+		NetChanged:            func() { netChanged = true },
+		MTU:                   1400,
+		ProbePathMTU:          true,
+		TxQueueLen:            5000,
+		NoARP:                 true,
+		HostAddrs:             true,
+		RouteTable:            52,
+		FwMark:                0x80000,
+		RouteMetric:           500,
+		RouteOnlink:           true,
+		RouteTailscaleRanges:  true,
+		NoPrefSrc:             true,
+		SkipConflictingRoutes: true,
+		AllowedRoutes:         []wgcfg.CIDR{mustCIDR(t, "10.0.0.0/8")},
+		DeniedRoutes:          []wgcfg.CIDR{mustCIDR(t, "10.9.0.0/16")},
+		RepairRoutes:          true,
+		KeepDNSOnClose:        true,
+		FlushConntrack:        true,
+		AdvertiseRoutes:       true,
+		EgressIface:           "eth0",
+		SNATSource:            mustCIDR(t, "192.168.1.2/32").IP,
+		NAT66:                 true,
+		FastPath:              &fakeFastPath{},
+		Firewall:              "nftables",
+		DNSMode:               "resolv.conf (appending)",
+		SplitDNS:              true,
+		DNSDefaultRoute:       true,
+		ResolvConf:            "/run/resolv.conf",
+		DNSTimeout:            time.Second,
+		SetRoutesDelay:        time.Millisecond,
+		SetRoutesMaxDelay:     time.Second,
+		RouteRetries:          5,
+		RouteRetryInterval:    time.Millisecond,
+		Netns:                 "ts",
+		BinPaths:              map[string]string{"ip": "/sbin/ip"},
+		DryRun:                true,
+	}
+	r, err := newLinuxRouter(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.netChanged()
+	if !netChanged {
+		t.Error("netChanged isn't opts.NetChanged")
+	}
+	if r.wgdev != opts.Device {
+		t.Error("wgdev isn't opts.Device")
+	}
+	if r.fastPath != opts.FastPath {
+		t.Error("fastPath isn't opts.FastPath")
+	}
+	if !r.repairRoutes {
+		t.Error("repairRoutes isn't opts.RepairRoutes")
+	}
+	if !r.keepDNSOnClose {
+		t.Error("keepDNSOnClose isn't opts.KeepDNSOnClose")
+	}
+	if r.routeRetries != 5 || r.routeRetryInterval != time.Millisecond {
+		t.Errorf("routeRetries, routeRetryInterval = %d, %v; want 5, 1ms", r.routeRetries, r.routeRetryInterval)
+	}
+	if r.setRoutesMaxDelay != time.Second {
+		t.Errorf("setRoutesMaxDelay = %v; want 1s", r.setRoutesMaxDelay)
+	}
+	if r.txQueueLen != 5000 {
+		t.Errorf("txQueueLen = %d; want 5000", r.txQueueLen)
+	}
+	got := fmt.Sprintf("%s %d %v %v %v %d %#x %d %v %v %v %v %v %v %v %v %s %v %v %s %s %v %v %s %v %v %s %v",
+		r.tunname, r.mtu, r.probePathMTU, r.noARP, r.hostAddrs, r.routeTable, r.fwmark, r.routeMetric,
+		r.routeOnlink, r.routeTailscaleRanges, r.noPrefSrc, r.skipConflictingRoutes, r.allowedRoutes, r.deniedRoutes,
+		r.flushConntrack, r.advertiseRoutes, r.egressIface, r.snatSource, r.nat66, r.firewall,
+		r.dnsMode, r.splitDNS, r.dnsDefaultRoute, r.resolvConf, r.dnsTimeout,
+		r.setRoutesDelay, r.netns, r.dryRun)
+	want := "tailscale0 1400 true true true 52 0x80000 500 true true true true [10.0.0.0/8] [10.9.0.0/16] true true eth0 192.168.1.2 true nftables resolv.conf (appending) true true /run/resolv.conf 1s 1ms ts true"
+	if got != want {
+		t.Errorf("router settings:\n got %s\nwant %s", got, want)
+	}
+
+	// The zero value of each setting is the default.
+	r, err = newLinuxRouter(RouterOptions{Logf: t.Logf, TunName: "tailscale0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.firewall != "" || r.dnsMode != "" || r.wgdev != nil || r.dryRun {
+		t.Errorf("zero options: firewall=%q dnsMode=%q wgdev=%v dryRun=%v", r.firewall, r.dnsMode, r.wgdev, r.dryRun)
+	}
+
+	for _, bad := range []RouterOptions{
+		{Logf: t.Logf, TunName: "tailscale0", Firewall: "pf"},
+		{Logf: t.Logf, TunName: "tailscale0", DNSMode: "dnsmasq"},
+		{Logf: t.Logf, TunName: ""},
+	} {
+		if _, err := newLinuxRouter(bad); err == nil {
+			t.Errorf("newLinuxRouter accepted %+v", bad)
+		}
+	}
+}
+
+func TestLinuxRouterRouteMetric(t *testing.T) {
+	fake := &fakeRunner{outputs: map[string]string{
+		"ip -o addr show dev tailscale0": "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n",
+		"ip -4 route show dev tailscale0 proto 84": "" +
+			"10.1.0.0/16 via 100.101.102.103 metric 500\n" +
+			"10.2.0.0/16 via 100.101.102.103\n",
+		"ip -6 route show dev tailscale0 proto 84": "fd7a::1 via 100.101.102.103 metric 1024 pref medium\n",
+	}}
+	r := &linuxRouter{
+		logf:        t.Logf,
+		tunname:     "tailscale0",
+		runner:      fake,
+		routeMetric: 500,
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16"}, []string{"fd7a::1/128"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		// Routes with the wrong metric are replaced.
+		"ip route del 10.2.0.0/16 dev tailscale0",
+		"ip route add 10.2.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84 metric 500",
+		"ip route del fd7a::1/128 dev tailscale0",
+		"ip route add fd7a::1/128 dev tailscale0 proto 84 metric 500",
+		"ip route add 10.3.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84 metric 500",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	if n := countPrefix(fake.cmds, "ip route add 10.1.0.0/16"); n != 0 {
+		t.Errorf("route with the right metric was re-added")
+	}
+}
+
+func TestLinuxRouterDuplicateRoutes(t *testing.T) {
+	fake := &fakeRunner{}
+	var logs []string
+	r := &linuxRouter{
+		logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+		tunname: "tailscale0",
+		runner:  fake,
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.0.0.0/24"}, []string{"10.0.0.1/24", "100.64.0.2/32"})
+	rs.Cfg.Peers[0].PublicKey[0] = 1
+	rs.Cfg.Peers[1].PublicKey[0] = 2
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, "ip route add 10.0.0.0/24 "); n != 1 {
+		t.Errorf("added 10.0.0.0/24 %d times, want 1; ran:\n%s", n, strings.Join(fake.cmds, "\n"))
+	}
+	if want := "ip route add 100.64.0.2/32 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"; !fake.ran(want) {
+		t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+	}
+	owner, dup := rs.Cfg.Peers[0].PublicKey.ShortString(), rs.Cfg.Peers[1].PublicKey.ShortString()
+	warned := false
+	for _, l := range logs {
+		if strings.Contains(l, "10.0.0.0/24") && strings.Contains(l, owner) && strings.Contains(l, dup) {
+			warned = true
+		}
+	}
+	if !warned {
+		t.Errorf("no warning naming both peers; logged %q", logs)
+	}
+}
+
+func TestLinuxRouterExitNode(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32", "0.0.0.0/0", "::/0"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip route add 0.0.0.0/1 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add 128.0.0.0/1 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add ::/1 dev tailscale0 proto 84",
+		"ip route add 8000::/1 dev tailscale0 proto 84",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	for _, c := range fake.cmds {
+		if strings.Contains(c, "/0 ") || strings.Contains(c, " default ") {
+			t.Errorf("replaced the default route: %q", c)
+		}
+	}
+
+	// With policy routing, the default route goes in its own table.
+	fake = &fakeRunner{}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, routeTable: 52, fwmark: 0x80000}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ip route add 0.0.0.0/0 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84 table 52"; !fake.ran(want) {
+		t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+	}
+}
+
+func TestLinuxRouterReload(t *testing.T) {
+	fake := &fakeRunner{}
+	dns := &fakeDNS{}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		dnsConfig:       dns,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+		advertiseRoutes: true,
+	}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32", "10.1.2.3/16"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Something removed the address, one of the routes and the
+	// jump to ts-forward, but left the chain itself.
+	fake.cmds = nil
+	fake.outputs = map[string]string{
+		"ip -4 route show dev tailscale0 proto 84": "100.64.0.1 via 100.101.102.103\n",
+	}
+	fake.fail = map[string]bool{
+		"iptables -N ts-forward":            true,
+		"iptables -C FORWARD -j ts-forward": true,
+		"iptables -t nat -N ts-postrouting": true,
+	}
+	if err := r.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip link set tailscale0 up",
+		"ip addr add 100.101.102.103/10 dev tailscale0",
+		"ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"iptables -F ts-forward",
+		"iptables -A FORWARD -j ts-forward",
+		"iptables -A ts-forward -i tailscale0 -j ACCEPT",
+		"iptables -t nat -F ts-postrouting",
+		"iptables -t nat -A ts-postrouting -o eth0 -j MASQUERADE",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	for _, notWant := range []string{
+		"ip route add 100.64.0.1/32 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"iptables -t nat -A POSTROUTING -j ts-postrouting",
+	} {
+		if fake.ran(notWant) {
+			t.Errorf("%q run, but was still there", notWant)
+		}
+	}
+	if len(dns.sets) != 2 {
+		t.Errorf("set DNS %d times, want 2", len(dns.sets))
+	}
+}
+
+func TestLinuxRouterMultipleAddrs(t *testing.T) {
+	fake := &fakeRunner{outputs: map[string]string{}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	ctx := context.Background()
+	rs := peerSettings(t, "100.101.102.103/32", []string{"100.64.0.1/32", "fd7a::2/128"})
+	rs.LocalAddrs = append(rs.LocalAddrs, mustCIDR(t, "fd7a::1/128"))
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip addr add 100.101.102.103/32 dev tailscale0",
+		"ip addr add fd7a::1/128 dev tailscale0",
+		"ip route add 100.64.0.1/32 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add fd7a::2/128 via fd7a::1 dev tailscale0 src fd7a::1 proto 84",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+
+	// Dropping the IPv4 address only removes that one.
+	fake.cmds = nil
+	fake.outputs["ip -o addr show dev tailscale0"] = "" +
+		"5: tailscale0    inet 100.101.102.103/32 scope global tailscale0\n" +
+		"5: tailscale0    inet6 fd7a::1/128 scope global \\       valid_lft forever preferred_lft forever\n"
+	rs.LocalAddrs = rs.LocalAddrs[1:]
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := countPrefix(fake.cmds, "ip addr "), 1; got != want {
+		t.Errorf("ran %d addr commands, want %d; ran:\n%s", got, want, strings.Join(fake.cmds, "\n"))
+	}
+	if want := "ip addr del 100.101.102.103/32 dev tailscale0"; !fake.ran(want) {
+		t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+	}
+}
+
+func TestLinuxRouterNextHops(t *testing.T) {
+	fake := &fakeRunner{outputs: map[string]string{}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	ctx := context.Background()
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.2.3/16"}, []string{"10.2.0.0/16"})
+	rs.NextHops = map[wgcfg.CIDR]wgcfg.IP{mustCIDR(t, "10.1.2.3/16"): mustCIDR(t, "100.64.0.2/32").IP}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip route add 10.1.0.0/16 via 100.64.0.2 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add 10.2.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+
+	// Changing a next hop replaces just that route.
+	fake.cmds = nil
+	fake.outputs["ip -o addr show dev tailscale0"] = "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n"
+	fake.outputs["ip -4 route show dev tailscale0 proto 84"] = "" +
+		"10.1.0.0/16 via 100.64.0.2\n" +
+		"10.2.0.0/16 via 100.101.102.103\n"
+	rs.NextHops = map[wgcfg.CIDR]wgcfg.IP{mustCIDR(t, "10.1.0.0/16"): mustCIDR(t, "100.64.0.3/32").IP}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ip route replace 10.1.0.0/16 via 100.64.0.3 dev tailscale0 src 100.101.102.103 proto 84",
+	}
+	var got []string
+	for _, c := range fake.cmds {
+		if strings.HasPrefix(c, "ip route ") {
+			got = append(got, c)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("route commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLinuxRouterForeignRoute(t *testing.T) {
+	// Another program has a static route on the tun device, which
+	// only shows up when routes aren't filtered by our proto.
+	fake := &fakeRunner{outputs: map[string]string{
+		"ip -o addr show dev tailscale0": "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n",
+		"ip -4 route show dev tailscale0": "" +
+			"10.1.0.0/16 via 100.101.102.103 proto 84\n" +
+			"192.168.50.0/24 via 100.101.102.103 proto static metric 10\n",
+		"ip -4 route show dev tailscale0 proto 84": "10.1.0.0/16 via 100.101.102.103\n",
+	}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.2.0.0/16"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.ran("ip route del 10.1.0.0/16 dev tailscale0") {
+		t.Errorf("our old route not deleted; ran:\n%s", strings.Join(fake.cmds, "\n"))
+	}
+	for _, c := range fake.cmds {
+		if strings.Contains(c, "192.168.50.0/24") {
+			t.Errorf("touched the other program's route: %q", c)
+		}
+	}
+	if _, ok := r.routes[mustCIDR(t, "192.168.50.0/24")]; ok {
+		t.Error("router took the other program's route as its own")
+	}
+}
+
+func TestLinuxRouterReplaceKernelRoute(t *testing.T) {
+	// The kernel's route has an old next hop that this router never
+	// saw, as after a restart.
+	fake := &fakeRunner{outputs: map[string]string{
+		"ip -o addr show dev tailscale0":           "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n",
+		"ip -4 route show dev tailscale0 proto 84": "10.1.0.0/16 via 100.64.0.2\n10.2.0.0/16 via 100.101.102.103\n",
+	}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "10.2.0.0/16"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"ip route replace 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+	}
+	var got []string
+	for _, c := range fake.cmds {
+		if strings.HasPrefix(c, "ip route ") {
+			got = append(got, c)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("route commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLinuxRouterHostAddrs(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, hostAddrs: true}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"ip addr add 100.101.102.103/32 dev tailscale0",
+		"ip route add 100.64.0.0/10 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	if fake.ran("ip addr add 100.101.102.103/10 dev tailscale0") {
+		t.Error("added the address with its network's mask")
+	}
+
+	// Once they're there, nothing needs doing.
+	fake.cmds = nil
+	fake.outputs = map[string]string{
+		"ip -o addr show dev tailscale0":           "5: tailscale0    inet 100.101.102.103/32 scope global tailscale0\n",
+		"ip -4 route show dev tailscale0 proto 84": "10.1.0.0/16 via 100.101.102.103\n100.64.0.0/10 via 100.101.102.103\n",
+	}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range fake.cmds {
+		if strings.HasPrefix(c, "ip addr add") || strings.HasPrefix(c, "ip addr del") || strings.HasPrefix(c, "ip route add") || strings.HasPrefix(c, "ip route del") {
+			t.Errorf("unexpected command %q", c)
+		}
+	}
+}
+
+func TestLinuxRouterOnRoutesChanged(t *testing.T) {
+	var got []string
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: &fakeRunner{}}
+	r.onRoutesChanged = func(added, removed []wgcfg.CIDR) {
+		// The router isn't locked.
+		r.Status()
+		got = append(got, fmt.Sprintf("added %v removed %v", added, removed))
+	}
+	ctx := context.Background()
+	for _, routes := range [][]string{
+		{"10.1.0.0/16", "10.2.0.0/16"},
+		{"10.1.0.0/16", "10.2.0.0/16"}, // no change, no call
+		{"10.2.0.0/16", "fd7a::/48"},
+	} {
+		if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", routes)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{
+		"added [10.1.0.0/16 10.2.0.0/16] removed []",
+		"added [fd7a::/48] removed [10.1.0.0/16]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("callbacks:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Nor is it called when SetRoutes fails.
+	got = nil
+	r.runner = failingRunner{}
+	r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", []string{"10.3.0.0/16"}))
+	if len(got) != 0 {
+		t.Errorf("called after a failed SetRoutes: %q", got)
+	}
+}
+
+func TestLinuxRouterBinPaths(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{
+		logf:     t.Logf,
+		tunname:  "tailscale0",
+		runner:   fake,
+		binPaths: map[string]string{"ip": "/opt/tailscale/ip"},
+	}
+	if err := r.SetRoutes(context.Background(), peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16"})); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"/opt/tailscale/ip addr add 100.101.102.103/10 dev tailscale0",
+		"/opt/tailscale/ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	if n := countPrefix(fake.cmds, "ip "); n != 0 {
+		t.Errorf("ran ip from PATH %d times", n)
+	}
+}
+
+// fakeWGDevice is a wgDevice whose UAPI get operation returns uapi.
+type fakeWGDevice struct {
+	uapi string
+}
+
+func (d fakeWGDevice) IpcGetOperation(w *bufio.Writer) *device.IPCError {
+	w.WriteString(d.uapi)
+	return nil
+}
+
+func TestLinuxRouterNetns(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		netns:           "blue",
+		binPaths:        map[string]string{"ip": "/sbin/ip", "iptables": "/usr/sbin/iptables"},
+		advertiseRoutes: true,
+		egressIface:     "eth0",
+	}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16"})); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"/sbin/ip netns exec blue /sbin/ip addr add 100.101.102.103/10 dev tailscale0",
+		"/sbin/ip netns exec blue /sbin/ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"/sbin/ip netns exec blue /usr/sbin/iptables -A ts-forward -i tailscale0 -j ACCEPT",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	for _, c := range fake.cmds {
+		if !strings.HasPrefix(c, "/sbin/ip netns exec blue ") {
+			t.Errorf("%q run outside the namespace", c)
+		}
+	}
+}
+
+func TestLinuxRouterCheckAllowedIPs(t *testing.T) {
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	dev := fakeWGDevice{uapi: "" +
+		"public_key=0000000000000000000000000000000000000000000000000000000000000001\n" +
+		"allowed_ip=100.64.0.1/32\n" +
+		"allowed_ip=10.1.2.3/16\n" +
+		"allowed_ip=10.9.0.0/16\n" +
+		"rx_bytes=0\n"}
+	r := &linuxRouter{logf: logf, tunname: "tailscale0", runner: &fakeRunner{}, wgdev: dev}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32", "10.1.0.0/16", "10.2.0.0/16"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	for _, l := range logs {
+		if strings.HasPrefix(l, "WARNING") {
+			warnings = append(warnings, l)
+		}
+	}
+	want := []string{
+		"WARNING: route 10.2.0.0/16 isn't in any WireGuard peer's allowed IPs",
+		"WARNING: WireGuard allowed IPs 10.9.0.0/16 have no route",
+	}
+	if strings.Join(warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warnings:\n%s\nwant:\n%s", strings.Join(warnings, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLinuxRouterReloadAllowedIPs(t *testing.T) {
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	dev := fakeWGDevice{uapi: "" +
+		"public_key=0000000000000000000000000000000000000000000000000000000000000001\n" +
+		"allowed_ip=10.1.0.0/16\n"}
+	r := &linuxRouter{
+		logf:                 logf,
+		tunname:              "tailscale0",
+		runner:               &fakeRunner{},
+		wgdev:                dev,
+		hostAddrs:            true,
+		routeTailscaleRanges: true,
+	}
+	ctx := context.Background()
+	rs := peerSettings(t, "100.101.102.103/24", []string{"10.1.0.0/16"})
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	// The routes that the router adds for its own address and for
+	// the Tailscale ranges aren't peers' allowed IPs.
+	if err := r.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range logs {
+		if strings.HasPrefix(l, "WARNING") {
+			t.Errorf("logged %q", l)
+		}
+	}
+}
+
+func TestLinuxRouterAddBeforeDelete(t *testing.T) {
+	fake := &fakeRunner{outputs: map[string]string{
+		"ip -o addr show dev tailscale0":           "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n",
+		"ip -4 route show dev tailscale0 proto 84": "10.1.0.0/16 via 100.101.102.103\n",
+	}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	// The new, larger route takes over from the old one.
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.0.0.0/8"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range fake.cmds {
+		if strings.HasPrefix(c, "ip route add ") || strings.HasPrefix(c, "ip route del ") {
+			got = append(got, c)
+		}
+	}
+	want := []string{
+		"ip route add 10.0.0.0/8 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route del 10.1.0.0/16 dev tailscale0",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("route commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestLinuxRouterOnlink(t *testing.T) {
+	for _, onlink := range []bool{false, true} {
+		fake := &fakeRunner{}
+		r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, routeOnlink: onlink}
+		rs := peerSettings(t, "100.101.102.103/32", []string{"10.1.0.0/16", "fd7a::/64"})
+		if err := r.SetRoutes(context.Background(), rs); err != nil {
+			t.Fatal(err)
+		}
+		want := "ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"
+		if onlink {
+			want = "ip route add 10.1.0.0/16 via 100.101.102.103 onlink dev tailscale0 src 100.101.102.103 proto 84"
+		}
+		if !fake.ran(want) {
+			t.Errorf("onlink=%v: %q not run; ran:\n%s", onlink, want, strings.Join(fake.cmds, "\n"))
+		}
+		// Routes without a gateway are on-link already.
+		if want := "ip route add fd7a::/64 dev tailscale0 proto 84"; !fake.ran(want) {
+			t.Errorf("onlink=%v: %q not run; ran:\n%s", onlink, want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+}
+
+func TestLinuxRouterConflictingRoutes(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		fake := &fakeRunner{outputs: map[string]string{
+			"ip -4 route show table main": "" +
+				"default via 192.168.1.1 dev eth0 proto dhcp metric 100\n" +
+				"100.64.0.0/10 dev tailscale0 scope link\n" +
+				"192.168.1.0/24 dev eth0 proto kernel scope link src 192.168.1.5\n",
+		}}
+		var logs []string
+		r := &linuxRouter{
+			logf: func(format string, args ...interface{}) {
+				logs = append(logs, fmt.Sprintf(format, args...))
+			},
+			tunname:               "tailscale0",
+			runner:                fake,
+			skipConflictingRoutes: skip,
+		}
+		rs := peerSettings(t, "100.101.102.103/10", []string{"192.168.1.0/25", "10.0.0.0/8", "100.64.0.1/32"})
+		if err := r.SetRoutes(context.Background(), rs); err != nil {
+			t.Fatal(err)
+		}
+		warnings := 0
+		for _, l := range logs {
+			if strings.Contains(l, "WARNING: route 192.168.1.0/25") && strings.Contains(l, "192.168.1.0/24 dev eth0") {
+				warnings++
+			} else if strings.Contains(l, "WARNING") {
+				t.Errorf("skip=%v: unexpected warning %q", skip, l)
+			}
+		}
+		if warnings != 1 {
+			t.Errorf("skip=%v: got %d warnings about 192.168.1.0/25, want 1; logs:\n%s", skip, warnings, strings.Join(logs, "\n"))
+		}
+		added := fake.ran("ip route add 192.168.1.0/25 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84")
+		if added == skip {
+			t.Errorf("skip=%v: added conflicting route = %v", skip, added)
+		}
+		if want := "ip route add 10.0.0.0/8 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"; !fake.ran(want) {
+			t.Errorf("skip=%v: %q not run; ran:\n%s", skip, want, strings.Join(fake.cmds, "\n"))
+		}
+		if got := countPrefix(fake.cmds, "ip -4 route show table main"); got != 1 {
+			t.Errorf("skip=%v: listed system routes %d times, want 1", skip, got)
+		}
+	}
+}
+
+func TestLinuxRouterString(t *testing.T) {
+	r := &linuxRouter{
+		logf:      t.Logf,
+		tunname:   "tailscale0",
+		runner:    &fakeRunner{},
+		dnsConfig: resolvedDNS{runner: &fakeRunner{}, tunname: "tailscale0"},
+		firewall:  firewallNFTables,
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32", "10.1.2.3/16"})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := r.SetRoutes(context.Background(), rs); err != nil {
+			t.Error(err)
+		}
+	}()
+	_ = r.String() // mustn't race with SetRoutes
+	<-done
+
+	got := r.String()
+	want := "tun=tailscale0 firewall=nftables commands=ip addrs=[100.101.102.103/10] routes=2 dns=systemd-resolved"
+	if got != want {
+		t.Errorf("String() = %q; want %q", got, want)
+	}
+}
+
+func TestLinuxRouterStatus(t *testing.T) {
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: &fakeRunner{}, dnsConfig: &fakeDNS{}}
+	if st := r.Status(); len(st.LocalAddrs) != 0 || len(st.Routes) != 0 || len(st.DNS) != 0 {
+		t.Errorf("new router has status %+v", st)
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32", "10.1.2.3/16"}, []string{"fd7a::1/128"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	rs.DNSDomains = []string{"example.com"}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	st := r.Status()
+	if fmt.Sprint(st.LocalAddrs) != fmt.Sprint(rs.LocalAddrs) {
+		t.Errorf("LocalAddrs = %v; want %v", st.LocalAddrs, rs.LocalAddrs)
+	}
+	if got, want := fmt.Sprint(st.Routes), "[10.1.0.0/16 100.64.0.1/32 fd7a::1/128]"; got != want {
+		t.Errorf("Routes = %v; want %v", got, want)
+	}
+	if !sameIPs(st.DNS, rs.DNS) || !sameStrings(st.DNSDomains, rs.DNSDomains) {
+		t.Errorf("DNS = %v %v; want %v %v", st.DNS, st.DNSDomains, rs.DNS, rs.DNSDomains)
+	}
+
+	// The snapshot is a copy.
+	st.DNS[0] = net.ParseIP("8.8.8.8")
+	if got := r.Status().DNS[0]; !got.Equal(rs.DNS[0]) {
+		t.Errorf("changing the snapshot changed the router's DNS to %v", got)
+	}
+}
+
+func TestLinuxRouterConcurrentClose(t *testing.T) {
+	fake := &fakeRunner{}
+	dns := &fakeDNS{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, dnsConfig: dns}
+	ctx := context.Background()
+	servers := []net.IP{net.ParseIP("100.100.100.100")}
+	rs := peerSettings(t, "100.101.102.103/10")
+	rs.DNS = servers
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				rs := peerSettings(t, "100.101.102.103/10", []string{fmt.Sprintf("10.%d.%d.0/24", i, j)})
+				rs.DNS = servers
+				if err := r.SetRoutes(ctx, rs); err != nil && err != errRouterClosed {
+					t.Errorf("SetRoutes: %v", err)
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				r.Status()
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := r.Close(ctx); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	if dns.restores != 1 {
+		t.Errorf("restored DNS %d times, want 1", dns.restores)
+	}
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10")); err != errRouterClosed {
+		t.Errorf("SetRoutes after Close = %v; want errRouterClosed", err)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+	if dns.restores != 1 {
+		t.Errorf("second Close restored DNS again")
+	}
+}
+
+func TestLinuxRouterCloseWithoutUp(t *testing.T) {
+	fake := &fakeRunner{}
+	dns := &fakeDNS{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, dnsConfig: dns}
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.cmds) != 0 {
+		t.Errorf("Close ran %q", fake.cmds)
+	}
+	if dns.restores != 0 {
+		t.Errorf("Close restored DNS that was never set")
+	}
+}
+
+func TestLinuxRouterUpCloseClose(t *testing.T) {
+	fake := &fakeRunner{}
+	dns := &fakeDNS{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, dnsConfig: dns, noARP: true}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if dns.restores != 1 {
+		t.Errorf("first Close restored DNS %d times; want 1", dns.restores)
+	}
+	if !fake.ran("ip link set tailscale0 arp on") {
+		t.Errorf("first Close didn't turn ARP back on; ran %q", fake.cmds)
+	}
+
+	fake.cmds = nil
+	if err := r.Close(ctx); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if len(fake.cmds) != 0 {
+		t.Errorf("second Close ran %q", fake.cmds)
+	}
+	if dns.restores != 1 {
+		t.Errorf("second Close restored DNS again")
+	}
+}
+
+func TestLinuxRouterCloseUndoesSetRoutes(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	ctx := context.Background()
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16"})); err != nil {
+		t.Fatal(err)
+	}
+	fake.cmds = nil
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range fake.cmds {
+		if strings.HasPrefix(c, "ip route del ") || strings.HasPrefix(c, "ip addr del ") {
+			got = append(got, c)
+		}
+	}
+	want := []string{
+		"ip route del 10.1.0.0/16 dev tailscale0",
+		"ip addr del 100.101.102.103/10 dev tailscale0",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Close ran:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if st := r.Status(); len(st.LocalAddrs) != 0 || len(st.Routes) != 0 {
+		t.Errorf("after Close, status is %+v", st)
+	}
+}
+
+func TestLinuxRouterCloseFlushesRoutes(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, routeRetries: -1}
+	ctx := context.Background()
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "10.2.0.0/16", "fd7a::/48"})
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+
+	// One delete failing doesn't stop the others.
+	const del2 = "ip route del 10.2.0.0/16 dev tailscale0"
+	fake.cmds = nil
+	fake.fail = map[string]bool{del2: true}
+	err := r.Close(ctx)
+	if errs, ok := err.(MultiError); !ok || len(errs) != 1 || !strings.Contains(errs[0].Error(), del2) {
+		t.Errorf("Close = %v; want just the failed delete", err)
+	}
+	for _, want := range []string{
+		"ip route del 10.1.0.0/16 dev tailscale0",
+		del2,
+		"ip route del fd7a::/48 dev tailscale0",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+		}
+	}
+	if n := countPrefix(fake.cmds, "ip route del "); n != 3 {
+		t.Errorf("Close deleted %d routes; want 3", n)
+	}
+	if len(r.routes) != 0 {
+		t.Errorf("routes left after Close: %v", r.routes)
+	}
+}
+
+func TestLinuxRouterLifecycle(t *testing.T) {
+	// A host that rejects the tun device's IPv6 settings, whose tun
+	// device still has its address from an earlier run.
+	fake := &fakeRunner{script: []fakeResponse{
+		{prefix: "sysctl -q -w net/ipv6/", err: errors.New("exit status 255")},
+		{prefix: "ip -o addr show dev tailscale0", out: "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n"},
+		{prefix: "ip -j -d link show dev tailscale0", out: tunLinkJSON(5, false)},
+	}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatalf("Up: %v", err)
+	}
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16"})); err != nil {
+		t.Fatalf("SetRoutes: %v", err)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	want := []string{
+		"ip link show dev tailscale0",
+		"sysctl -n net/ipv6/conf/all/disable_ipv6",
+		"ip -j -d link show dev tailscale0",
+		"ip link set tailscale0 mtu 1280",
+		"sysctl -q -w net/ipv6/conf/tailscale0/accept_ra=0",
+		"ip link set tailscale0 up",
+		"ip -o addr show dev tailscale0",
+		"ip -4 route show dev tailscale0 proto 84",
+		"ip -6 route show dev tailscale0 proto 84",
+		"ip -4 route show table main",
+		"ip -6 route show table main",
+		"ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"ip route del 10.1.0.0/16 dev tailscale0",
+		"ip addr del 100.101.102.103/10 dev tailscale0",
+	}
+	if got := strings.Join(fake.cmds, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("ran:\n%s\nwant:\n%s", got, strings.Join(want, "\n"))
+	}
+}
+
+func TestLinuxRouterFlushConntrack(t *testing.T) {
+	// The routes from an earlier SetRoutes.
+	kernel := []fakeResponse{
+		{prefix: "ip -o addr show dev tailscale0", out: "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n"},
+		{prefix: "ip -4 route show dev tailscale0 proto 84", out: "" +
+			"10.1.0.0/16 via 100.101.102.103\n" +
+			"10.2.0.0/16 via 100.101.102.103\n"},
+		{prefix: "ip -6 route show dev tailscale0 proto 84", out: "fd7a::/48 via 100.101.102.103\n"},
+	}
+	fake := &fakeRunner{script: kernel}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, flushConntrack: true}
+	ctx := context.Background()
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "10.2.0.0/16", "fd7a::/48"})
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, "conntrack "); n != 0 {
+		t.Errorf("flushed conntrack %d times without removing routes", n)
+	}
+
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16"})); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"conntrack -D -f ipv4 -d 10.2.0.0 --mask-dst 255.255.0.0",
+		"conntrack -D -f ipv6 -d fd7a:: --mask-dst ffff:ffff:ffff::",
+	} {
+		if !fake.ran(want) {
+			t.Errorf("did not run %q; ran %q", want, fake.cmds)
+		}
+	}
+	if n := countPrefix(fake.cmds, "conntrack "); n != 2 {
+		t.Errorf("flushed conntrack %d times; want 2", n)
+	}
+
+	// Without conntrack, routes are removed all the same, and it
+	// isn't looked for again.
+	fake = &fakeRunner{script: kernel, missing: map[string]bool{"conntrack": true}}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, flushConntrack: true}
+	for _, routes := range [][]string{{"10.1.0.0/16"}, nil} {
+		if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", routes)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countPrefix(fake.cmds, "conntrack "); n != 1 {
+		t.Errorf("ran conntrack %d times when it's missing; want 1", n)
+	}
+	if want := "ip route del 10.1.0.0/16 dev tailscale0"; !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+
+	// It's off by default.
+	fake = &fakeRunner{script: kernel}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10")); err != nil {
+		t.Fatal(err)
+	}
+	if n := countPrefix(fake.cmds, "conntrack "); n != 0 {
+		t.Errorf("flushed conntrack %d times when not enabled", n)
+	}
+}
+
+func TestLinuxRouterPermittedRoutes(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{
+		logf:          t.Logf,
+		tunname:       "tailscale0",
+		runner:        fake,
+		allowedRoutes: []wgcfg.CIDR{mustCIDR(t, "10.0.0.0/8"), mustCIDR(t, "fd7a::/16")},
+		deniedRoutes:  []wgcfg.CIDR{mustCIDR(t, "10.9.0.0/16")},
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{
+		"10.1.0.0/16",
+		"0.0.0.0/0",
+		"192.168.1.0/24",
+		"10.9.1.0/24",
+		"fd7a:1::/48",
+		"::/0",
+	})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, route := range r.Status().Routes {
+		got = append(got, route.String())
+	}
+	if want := []string{"10.1.0.0/16", "fd7a:1::/48"}; strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("routes = %q; want %q", got, want)
+	}
+	if n := countPrefix(fake.cmds, "ip route add "); n != 2 {
+		t.Errorf("added %d routes; want 2: %q", n, fake.cmds)
+	}
+}
+
+func TestLinuxRouterDebounce(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, setRoutesDelay: 50 * time.Millisecond}
+	ctx := context.Background()
+	errc := make(chan error, 5)
+	for i := 1; i <= 5; i++ {
+		rs := peerSettings(t, "100.101.102.103/10", []string{fmt.Sprintf("10.%d.0.0/16", i)})
+		go func() { errc <- r.SetRoutes(ctx, rs) }()
+		// Wait for the call to start waiting, so the calls are
+		// made in order.
+		waitPending(t, r, i)
+	}
+	for i := 0; i < 5; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := countPrefix(fake.cmds, "ip -o addr show "); n != 1 {
+		t.Errorf("applied settings %d times; want 1", n)
+	}
+	if n := countPrefix(fake.cmds, "ip route add "); n != 1 {
+		t.Errorf("added %d routes; want 1: %q", n, fake.cmds)
+	}
+	if want := "ip route add 10.5.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"; !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+// waitPending waits for r to have a burst of n SetRoutes calls pending.
+func waitPending(t *testing.T, r *linuxRouter, n int) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		r.debounceMu.Lock()
+		calls := 0
+		if r.pending != nil {
+			calls = r.pending.calls
+		}
+		r.debounceMu.Unlock()
+		if calls == n {
+			return
+		}
+	}
+	t.Fatalf("%d SetRoutes calls never pending", n)
+}
+
+func TestLinuxRouterDebounceCanceled(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, setRoutesDelay: 50 * time.Millisecond}
+	errc := make(chan error, 1)
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16"})
+	go func() { errc <- r.SetRoutes(context.Background(), rs) }()
+	waitPending(t, r, 1)
+
+	// The last call gives up waiting, but its settings are still
+	// the ones applied.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rs = peerSettings(t, "100.101.102.103/10", []string{"10.2.0.0/16"})
+	if err := r.SetRoutes(ctx, rs); err != context.Canceled {
+		t.Errorf("canceled SetRoutes = %v; want %v", err, context.Canceled)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want := "ip route add 10.2.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"; !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+	if n := countPrefix(fake.cmds, "ip route add "); n != 1 {
+		t.Errorf("added %d routes; want 1: %q", n, fake.cmds)
+	}
+}
+
+func TestLinuxRouterDebounceMaxDelay(t *testing.T) {
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: &fakeRunner{},
+		setRoutesDelay: 50 * time.Millisecond, setRoutesMaxDelay: 200 * time.Millisecond}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16"})
+
+	// Calls closer together than setRoutesDelay never end the
+	// burst, so only setRoutesMaxDelay gets them applied.
+	errc := make(chan error, 1000)
+	start := time.Now()
+	n := 0
+	timeout := time.After(5 * time.Second)
+burst:
+	for {
+		go func() { errc <- r.SetRoutes(context.Background(), rs) }()
+		n++
+		select {
+		case err := <-errc:
+			n--
+			if err != nil {
+				t.Error(err)
+			}
+			break burst
+		case <-timeout:
+			t.Fatal("burst of SetRoutes calls was never applied")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("burst applied after %v; want about 200ms", d)
+	}
+	for ; n > 0; n-- {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestLinuxRouterOnLinkSubnet(t *testing.T) {
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	rs := peerSettings(t, "100.64.0.5/24", []string{"100.64.0.0/24", "100.64.0.128/25", "100.64.0.9/32", "10.1.0.0/16"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range fake.cmds {
+		if strings.HasPrefix(c, "ip route add ") {
+			got = append(got, c)
+		}
+	}
+	want := []string{
+		"ip route add 10.1.0.0/16 via 100.64.0.5 dev tailscale0 src 100.64.0.5 proto 84",
+		"ip route add 100.64.0.9/32 via 100.64.0.5 dev tailscale0 src 100.64.0.5 proto 84",
+	}
+	sort.Strings(got)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("added:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A next hop needs the route.
+	fake = &fakeRunner{}
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	rs = peerSettings(t, "100.64.0.5/24", []string{"100.64.0.0/25"})
+	rs.NextHops = map[wgcfg.CIDR]wgcfg.IP{mustCIDR(t, "100.64.0.0/25"): mustCIDR(t, "100.64.0.9/32").IP}
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ip route add 100.64.0.0/25 via 100.64.0.9 dev tailscale0 src 100.64.0.5 proto 84"; !fake.ran(want) {
+		t.Errorf("did not run %q; ran %q", want, fake.cmds)
+	}
+}
+
+func TestLinuxRouterPrefSrc(t *testing.T) {
+	for _, noPrefSrc := range []bool{false, true} {
+		fake := &fakeRunner{}
+		r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, noPrefSrc: noPrefSrc}
+		rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "fd7a:1::/48"})
+		rs.LocalAddrs = append(rs.LocalAddrs, mustCIDR(t, "fd7a::1/48"))
+		if err := r.SetRoutes(context.Background(), rs); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{
+			"ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+			"ip route add fd7a:1::/48 via fd7a::1 dev tailscale0 src fd7a::1 proto 84",
+		}
+		if noPrefSrc {
+			want = []string{
+				"ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 proto 84",
+				"ip route add fd7a:1::/48 via fd7a::1 dev tailscale0 proto 84",
+			}
+		}
+		for _, c := range want {
+			if !fake.ran(c) {
+				t.Errorf("noPrefSrc=%v: %q not run; ran:\n%s", noPrefSrc, c, strings.Join(fake.cmds, "\n"))
+			}
+		}
+	}
+
+	// Without a local address of its family, a route has no src.
+	op := routeOp{add: true, dst: mustCIDR(t, "fd7a:1::/48"), src: mustCIDR(t, "100.101.102.103/32").IP}
+	if got, want := strings.Join(op.args("tailscale0"), " "), "route add fd7a:1::/48 dev tailscale0 proto 84"; got != want {
+		t.Errorf("args = %q; want %q", got, want)
+	}
+}
+
+func TestRouteOpProto(t *testing.T) {
+	dst := mustCIDR(t, "10.1.0.0/16")
+	via := mustCIDR(t, "100.101.102.103/32").IP
+	tests := []struct {
+		op   routeOp
+		want string
+	}{
+		{routeOp{add: true, dst: dst, via: via}, "route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 proto 84"},
+		{routeOp{add: true, replace: true, dst: dst, via: via, metric: 5}, "route replace 10.1.0.0/16 via 100.101.102.103 dev tailscale0 proto 84 metric 5"},
+		// Deletes match routes from before they were tagged too.
+		{routeOp{dst: dst}, "route del 10.1.0.0/16 dev tailscale0"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(tt.op.args("tailscale0"), " "); got != tt.want {
+			t.Errorf("args = %q; want %q", got, tt.want)
+		}
+	}
+}
+
+// kernelRunner is a commandRunner that keeps the routes that ip(8)
+// adds and deletes on the tun device, and lists them for "ip route
+// show", as the kernel would. It counts the commands it runs.
+type kernelRunner struct {
+	routes map[string]string // "ip route show" line, by destination
+	n      int               // commands run
+}
+
+func (k *kernelRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	k.n++
+	if len(args) < 4 || args[1] == "-6" {
+		return nil, nil
+	}
+	switch {
+	case args[1] == "-4" && args[3] == "show" && args[4] == "dev":
+		var b strings.Builder
+		for _, line := range k.routes {
+			b.WriteString(line)
+			b.WriteByte('\n')
+		}
+		return []byte(b.String()), nil
+	case args[1] == "route" && args[2] == "add":
+		k.routes[args[3]] = strings.Join(args[3:], " ")
+	case args[1] == "route" && args[2] == "del":
+		delete(k.routes, args[3])
+	}
+	return nil, nil
+}
+
+// RunStdin runs each of the commands in the batch, counting them as
+// one.
+func (k *kernelRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	n := k.n
+	for _, line := range strings.Split(strings.TrimSpace(string(stdin)), "\n") {
+		k.Run(ctx, append([]string{args[0]}, strings.Fields(line)...)...)
+	}
+	k.n = n + 1
+	return nil, nil
+}
+
+func BenchmarkLinuxRouterPeerChange(b *testing.B) {
+	for _, peers := range []int{10, 1000} {
+		b.Run(fmt.Sprintf("peers=%d", peers), func(b *testing.B) {
+			kernel := &kernelRunner{routes: make(map[string]string)}
+			r := &linuxRouter{logf: func(string, ...interface{}) {}, tunname: "tailscale0", runner: kernel, routeRetries: -1}
+			rs := RouteSettings{
+				LocalAddrs: []wgcfg.CIDR{{IP: wgcfg.IPv4(100, 101, 102, 103), Mask: 10}},
+				Cfg:        new(wgcfg.Config),
+			}
+			for i := 0; i < peers; i++ {
+				ip := wgcfg.IPv4(100, 64, byte(i>>8), byte(i))
+				rs.Cfg.Peers = append(rs.Cfg.Peers, wgcfg.Peer{AllowedIPs: []wgcfg.CIDR{{IP: ip, Mask: 32}}})
+			}
+			// The last peer moves between two addresses.
+			last := &rs.Cfg.Peers[peers-1].AllowedIPs[0]
+			moves := [2]wgcfg.IP{last.IP, wgcfg.IPv4(100, 65, 0, 1)}
+			ctx := context.Background()
+			if err := r.SetRoutes(ctx, rs); err != nil {
+				b.Fatal(err)
+			}
+
+			kernel.n = 0
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				last.IP = moves[(i+1)%2]
+				if err := r.SetRoutes(ctx, rs); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(kernel.n)/float64(b.N), "cmds/op")
+		})
+	}
+}
+
+// flakyRunner is a fakeRunner whose commands fail, with canned
+// output, a set number of times before they succeed.
+type flakyRunner struct {
+	fakeRunner
+	failures map[string]int // remaining failures, keyed by command
+}
+
+func (f *flakyRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	f.next(strings.Join(args, " "))
+	return f.fakeRunner.Run(ctx, args...)
+}
+
+func (f *flakyRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	for _, line := range strings.Split(strings.TrimSpace(string(stdin)), "\n") {
+		f.next(args[0] + " " + line)
+	}
+	return f.fakeRunner.RunStdin(ctx, stdin, args...)
+}
+
+// next sets up whether c fails this time.
+func (f *flakyRunner) next(c string) {
+	if f.fail == nil {
+		f.fail = make(map[string]bool)
+	}
+	f.fail[c] = f.failures[c] > 0
+	if f.fail[c] {
+		f.failures[c]--
+	}
+}
+
+func TestLinuxRouterRetry(t *testing.T) {
+	const (
+		add1 = "ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"
+		add2 = "ip route add 10.2.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"
+	)
+	tests := []struct {
+		name     string
+		out      string
+		failures int
+		retries  int
+		wantErr  bool
+		wantRuns int
+	}{
+		{"transient", "RTNETLINK answers: No buffer space available", 2, 0, false, 3},
+		{"busy", "RTNETLINK answers: Device or resource busy", 1, 0, false, 2},
+		{"out of retries", "RTNETLINK answers: No buffer space available", 3, 2, true, 3},
+		{"no retries", "RTNETLINK answers: Device or resource busy", 1, -1, true, 1},
+		{"exists", "RTNETLINK answers: File exists", 1, 0, false, 1},
+		{"permanent", "RTNETLINK answers: Invalid argument", 1, 0, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &flakyRunner{failures: map[string]int{add1: tt.failures}}
+			fake.outputs = map[string]string{add1: tt.out}
+			r := &linuxRouter{
+				logf:               t.Logf,
+				tunname:            "tailscale0",
+				runner:             fake,
+				routeRetries:       tt.retries,
+				routeRetryInterval: time.Millisecond,
+			}
+			rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "10.2.0.0/16"})
+			err := r.SetRoutes(context.Background(), rs)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetRoutes = %v; want error %v", err, tt.wantErr)
+			}
+			if n := countPrefix(fake.cmds, add1); n != tt.wantRuns {
+				t.Errorf("ran %q %d times, want %d", add1, n, tt.wantRuns)
+			}
+			if n := countPrefix(fake.cmds, add2); n != 1 {
+				t.Errorf("ran %q %d times, want 1", add2, n)
+			}
+		})
+	}
+}
+
+func TestLinuxRouterFileExists(t *testing.T) {
+	const (
+		addAddr   = "ip addr add 100.101.102.103/10 dev tailscale0"
+		addRoute  = "ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"
+		badRoute  = "ip route add 10.2.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"
+		fileExist = "RTNETLINK answers: File exists"
+	)
+	fake := &fakeRunner{
+		outputs: map[string]string{
+			addAddr:  fileExist,
+			addRoute: fileExist,
+			badRoute: "RTNETLINK answers: Network is unreachable",
+		},
+		fail: map[string]bool{addAddr: true, addRoute: true},
+	}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "10.2.0.0/16", "10.3.0.0/16"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatalf("SetRoutes with existing address and route: %v", err)
+	}
+
+	// Genuine failures are still reported.
+	fake.fail[badRoute] = true
+	r = &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	err := r.SetRoutes(context.Background(), rs)
+	merr, ok := err.(MultiError)
+	if !ok || len(merr) != 1 || !strings.Contains(err.Error(), "Network is unreachable") {
+		t.Errorf("got %v; want only the unreachable error", err)
+	}
+}
+
+func TestLinuxRouterAcceptRA(t *testing.T) {
+	const want = "sysctl -q -w net/ipv6/conf/tun.1/accept_ra=0"
+	fake := &fakeRunner{}
+	r := &linuxRouter{logf: t.Logf, tunname: "tun.1", runner: fake}
+	if err := r.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.ran(want) {
+		t.Errorf("%q not run; ran:\n%s", want, strings.Join(fake.cmds, "\n"))
+	}
+
+	// It's best effort.
+	fake = &fakeRunner{fail: map[string]bool{want: true}}
+	r = &linuxRouter{logf: t.Logf, tunname: "tun.1", runner: fake}
+	if err := r.Up(context.Background()); err != nil {
+		t.Errorf("Up failed along with sysctl: %v", err)
+	}
+}
+
+func TestLinuxRouterRPFilter(t *testing.T) {
+	const (
+		key   = "net/ipv4/conf/tailscale0/rp_filter"
+		get   = "sysctl -n " + key
+		set   = "sysctl -q -w " + key + "=2"
+		reset = "sysctl -q -w " + key + "=1"
+	)
+	for _, advertise := range []bool{false, true} {
+		fake := &fakeRunner{outputs: map[string]string{get: "1\n"}}
+		r := &linuxRouter{
+			logf:            t.Logf,
+			tunname:         "tailscale0",
+			runner:          fake,
+			advertiseRoutes: advertise,
+			egressIface:     "eth0",
+			firewall:        firewallIPTables,
+		}
+		ctx := context.Background()
+		if err := r.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		// Reloading mustn't lose the original value.
+		if err := r.Reload(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if !advertise {
+			if n := countPrefix(fake.cmds, "sysctl -n net/ipv4/") + countPrefix(fake.cmds, "sysctl -q -w net/ipv4/"); n != 0 {
+				t.Errorf("rp_filter changed without subnet routing; ran:\n%s", strings.Join(fake.cmds, "\n"))
+			}
+			continue
+		}
+		if got := countPrefix(fake.cmds, get); got != 1 {
+			t.Errorf("read rp_filter %d times; want 1", got)
+		}
+		if got := countPrefix(fake.cmds, set); got != 2 {
+			t.Errorf("set rp_filter %d times; want 2", got)
+		}
+		if !fake.ran(reset) {
+			t.Errorf("%q not run; ran:\n%s", reset, strings.Join(fake.cmds, "\n"))
+		}
+	}
+}
+
+func TestLinuxRouterIPForwarding(t *testing.T) {
+	keys := []string{"net/ipv4/ip_forward", "net/ipv6/conf/all/forwarding"}
+	for _, advertise := range []bool{false, true} {
+		fake := &fakeRunner{outputs: map[string]string{}}
+		for _, key := range keys {
+			fake.outputs["sysctl -n "+key] = "0\n"
+		}
+		r := &linuxRouter{
+			logf:            t.Logf,
+			tunname:         "tailscale0",
+			runner:          fake,
+			advertiseRoutes: advertise,
+			egressIface:     "eth0",
+			firewall:        firewallIPTables,
+		}
+		ctx := context.Background()
+		if err := r.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if got := fake.ran("sysctl -q -w " + key + "=1"); got != advertise {
+				t.Errorf("advertise=%v: enabled %s = %v", advertise, key, got)
+			}
+		}
+		fake.cmds = nil
+		if err := r.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range keys {
+			if got := fake.ran("sysctl -q -w " + key + "=0"); got != advertise {
+				t.Errorf("advertise=%v: restored %s = %v", advertise, key, got)
+			}
+		}
+	}
+}
+
+func TestLinuxRouterCloseLogs(t *testing.T) {
+	var std bytes.Buffer
+	log.SetOutput(&std)
+	defer log.SetOutput(os.Stderr)
+
+	var logs []string
+	r := &linuxRouter{
+		logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+		tunname:         "tailscale0",
+		runner:          &fakeRunner{},
+		advertiseRoutes: true,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+	}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	logs = nil
+	r.runner = failingRunner{}
+	r.Close(ctx)
+	if len(logs) == 0 {
+		t.Error("Close failed without logging")
+	}
+	if std.Len() > 0 {
+		t.Errorf("Close logged to the log package:\n%s", std.Bytes())
+	}
+}
+
+func TestLinuxRouterCheckHealth(t *testing.T) {
+	fake := &fakeRunner{outputs: map[string]string{}}
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		advertiseRoutes: true,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+	}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32", "10.1.2.3/16"})
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+
+	fake.outputs["ip -o addr show dev tailscale0"] = "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n"
+	fake.outputs["ip -4 route show dev tailscale0 proto 84"] = "" +
+		"10.1.0.0/16 via 100.101.102.103\n" +
+		"100.64.0.1 via 100.101.102.103\n"
+	if err := r.CheckHealth(ctx); err != nil {
+		t.Errorf("healthy router: %v", err)
+	}
+
+	// Something else removes a route and a firewall rule.
+	fake.outputs["ip -4 route show dev tailscale0 proto 84"] = "10.1.0.0/16 via 100.101.102.103\n"
+	fake.fail = map[string]bool{"iptables -t nat -C POSTROUTING -j ts-postrouting": true}
+	err := r.CheckHealth(ctx)
+	if err == nil {
+		t.Fatal("CheckHealth didn't notice the missing route and rule")
+	}
+	for _, want := range []string{
+		"route 100.64.0.1/32 missing from tailscale0",
+		`firewall chain missing: cmd="iptables -t nat -C POSTROUTING -j ts-postrouting"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("CheckHealth error doesn't mention %q:\n%v", want, err)
+		}
+	}
+	if errs, ok := err.(MultiError); !ok || len(errs) != 2 {
+		t.Errorf("CheckHealth = %#v; want 2 errors", err)
+	}
+}
+
+func TestLinuxRouterNoFirewall(t *testing.T) {
+	fake := &fakeRunner{missing: map[string]bool{"iptables": true, "ip6tables": true, "nft": true}}
+	var warnings []string
+	r := &linuxRouter{
+		logf: func(format string, args ...interface{}) {
+			if msg := fmt.Sprintf(format, args...); strings.Contains(msg, "WARNING") {
+				warnings = append(warnings, msg)
+			}
+		},
+		tunname:         "tailscale0",
+		runner:          fake,
+		advertiseRoutes: true,
+		egressIface:     "eth0",
+	}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if r.firewall != firewallNone {
+		t.Errorf("firewall = %q; want %q", r.firewall, firewallNone)
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "fd7a::/64"})
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "skipping firewall") {
+		t.Errorf("got warnings %q; want one about skipping the firewall", warnings)
+	}
+	n := countPrefix(fake.cmds, "iptables ") + countPrefix(fake.cmds, "ip6tables ") + countPrefix(fake.cmds, "nft ")
+	if n != 2 { // the --version checks
+		t.Errorf("ran %d firewall commands; want 2; ran:\n%s", n, strings.Join(fake.cmds, "\n"))
+	}
+}
+
+func TestLinuxRouterNoARP(t *testing.T) {
+	const (
+		off = "ip link set tailscale0 arp off"
+		on  = "ip link set tailscale0 arp on"
+	)
+	for _, noARP := range []bool{false, true} {
+		fake := &fakeRunner{}
+		r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake, noARP: noARP}
+		ctx := context.Background()
+		if err := r.Up(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := fake.ran(off); got != noARP {
+			t.Errorf("noARP=%v: turned ARP off = %v", noARP, got)
+		}
+		if err := r.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := fake.ran(on); got != noARP {
+			t.Errorf("noARP=%v: turned ARP back on = %v", noARP, got)
+		}
+	}
+}
+
+func TestLinuxRouterDryRun(t *testing.T) {
+	fake := &fakeRunner{}
+	dns := &fakeDNS{}
+	var logs []string
+	r := &linuxRouter{
+		logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+		tunname:         "tailscale0",
+		runner:          fake,
+		dnsConfig:       dns,
+		advertiseRoutes: true,
+		egressIface:     "eth0",
+		firewall:        firewallIPTables,
+		dryRun:          true,
+	}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32", "10.1.2.3/16"})
+	rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+	if err := r.SetRoutes(ctx, rs); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.cmds) != 0 {
+		t.Errorf("ran commands in dry run:\n%s", strings.Join(fake.cmds, "\n"))
+	}
+	if len(dns.sets) != 0 || dns.restores != 0 {
+		t.Errorf("changed DNS in dry run: %d sets, %d restores", len(dns.sets), dns.restores)
+	}
+	all := strings.Join(logs, "\n")
+	for _, want := range []string{
+		"ip link set tailscale0 up",
+		"iptables -A ts-forward -i tailscale0 -j ACCEPT",
+		"iptables -t nat -A ts-postrouting -o eth0 -j MASQUERADE",
+		"ip addr add 100.101.102.103/10 dev tailscale0",
+		"route add 100.64.0.1/32 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+		"set DNS servers [100.100.100.100]",
+		"iptables -X ts-forward",
+		"restore DNS",
+	} {
+		if !strings.Contains(all, want) {
+			t.Errorf("%q not logged; logged:\n%s", want, all)
+		}
+	}
+}
+
+func TestLinuxRouterInterfaceGone(t *testing.T) {
+	const gone = `Cannot find device "tailscale0"`
+	tests := []struct {
+		name string
+		fail []string
+	}{
+		{
+			name: "before reading state",
+			fail: []string{"ip -o addr show dev tailscale0"},
+		},
+		{
+			name: "while applying routes",
+			fail: []string{
+				"ip route del 10.2.0.0/16 dev tailscale0",
+				"ip route add 100.64.0.1/32 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+				"ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeRunner{
+				outputs: map[string]string{
+					"ip -o addr show dev tailscale0":           "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n",
+					"ip -4 route show dev tailscale0 proto 84": "10.2.0.0/16 via 100.101.102.103\n",
+				},
+				fail: map[string]bool{},
+			}
+			for _, c := range tt.fail {
+				fake.outputs[c] = gone
+				fake.fail[c] = true
+			}
+			var logs []string
+			r := &linuxRouter{
+				logf: func(format string, args ...interface{}) {
+					logs = append(logs, fmt.Sprintf(format, args...))
+				},
+				tunname: "tailscale0",
+				runner:  fake,
+			}
+			rs := peerSettings(t, "100.101.102.103/10", []string{"100.64.0.1/32", "10.1.2.3/16"})
+			if err := r.SetRoutes(context.Background(), rs); err != ErrInterfaceGone {
+				t.Fatalf("got %v; want ErrInterfaceGone", err)
+			}
+			for _, l := range logs {
+				if strings.Contains(l, "failed") {
+					t.Errorf("logged %q", l)
+				}
+			}
+			if len(r.routes) != 0 {
+				t.Errorf("router still has routes %v", r.routes)
+			}
+		})
+	}
+}
+
+func TestIsInterfaceGone(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"ip route", commandError([]string{"ip", "route", "add", "10.1.0.0/16", "dev", "tailscale0"}, errors.New("exit status 1"), []byte(`Cannot find device "tailscale0"`)), true},
+		{"ip addr show", commandError([]string{"ip", "-o", "addr", "show", "dev", "tailscale0"}, errors.New("exit status 1"), []byte(`Device "tailscale0" does not exist.`)), true},
+		{"rtnetlink lookup", &net.OpError{Op: "route", Net: "ip+net", Err: errors.New("no such network interface")}, true},
+		{"rtnetlink", &netlink.OpError{Op: "receive", Err: unix.ENODEV}, true},
+		{"rtnetlink wrapped", fmt.Errorf("route add failed: %w", &netlink.OpError{Op: "receive", Err: unix.ENODEV}), true},
+		{"rtnetlink exists", &netlink.OpError{Op: "receive", Err: unix.EEXIST}, false},
+		{"other", errors.New("exit status 2"), false},
+	}
+	for _, tt := range tests {
+		if got := isInterfaceGone(tt.err); got != tt.want {
+			t.Errorf("%s: isInterfaceGone(%v) = %v; want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestParseRoutesMetric(t *testing.T) {
+	out := []byte("" +
+		"10.1.0.0/16 dev tailscale0 scope link\n" +
+		"10.2.0.0/16 dev tailscale0 scope link metric 10\n")
+	routes := make(map[wgcfg.CIDR]struct{})
+	stale := make(map[wgcfg.CIDR]struct{})
+	gateways := make(map[wgcfg.CIDR]wgcfg.IP)
+	if err := parseRoutes(out, false, 0, routes, stale, gateways); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := routes[mustCIDR(t, "10.1.0.0/16")]; !ok || len(routes) != 1 {
+		t.Errorf("routes = %v; want just 10.1.0.0/16", routes)
+	}
+	if _, ok := stale[mustCIDR(t, "10.2.0.0/16")]; !ok || len(stale) != 1 {
+		t.Errorf("stale = %v; want just 10.2.0.0/16", stale)
+	}
+}
+
+// routerMetric returns the current value of the router counter name.
+func routerMetric(name string) int64 {
+	v, _ := routerMetrics.Get(name).(*expvar.Int)
+	if v == nil {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestRouterMetrics(t *testing.T) {
+	names := []string{
+		"setroutes_ok", "setroutes_fail",
+		"route_add_v4_ok", "route_add_v6_ok", "route_add_v4_fail",
+		"route_del_v4_ok",
+		"addr_add_v4_ok",
+	}
+	before := make(map[string]int64)
+	for _, name := range names {
+		before[name] = routerMetric(name)
+	}
+
+	fake := &fakeRunner{fail: map[string]bool{
+		"ip route add 10.3.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84": true,
+	}}
+	r := &linuxRouter{logf: t.Logf, tunname: "tailscale0", runner: fake}
+	rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "10.2.0.0/16"}, []string{"fd7a::1/128"})
+	if err := r.SetRoutes(context.Background(), rs); err != nil {
+		t.Fatal(err)
+	}
+	// The fake kernel state is empty, so the cached state is used
+	// from here on.
+	fake.fail["ip -o addr show dev tailscale0"] = true
+	rs = peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "10.3.0.0/16"}, []string{"fd7a::1/128"})
+	if err := r.SetRoutes(context.Background(), rs); err == nil {
+		t.Fatal("SetRoutes succeeded; want error")
+	}
+
+	want := map[string]int64{
+		"setroutes_ok":      1,
+		"setroutes_fail":    1,
+		"route_add_v4_ok":   2,
+		"route_add_v6_ok":   1,
+		"route_add_v4_fail": 1,
+		"route_del_v4_ok":   1,
+		"addr_add_v4_ok":    1,
+	}
+	for _, name := range names {
+		if got := routerMetric(name) - before[name]; got != want[name] {
+			t.Errorf("%s advanced by %d; want %d", name, got, want[name])
+		}
+	}
+}
+
+// sleepRunner runs sleep(1) in place of any command, so that
+// commands take far longer than a test should.
+type sleepRunner struct{}
+
+func (sleepRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, "sleep", "60").CombinedOutput()
+}
+
+func (sleepRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, "sleep", "60").CombinedOutput()
+}
+
+func TestLinuxRouterCancel(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("no sleep(1) to exec")
+	}
+	r := &linuxRouter{
+		logf:    t.Logf,
+		tunname: "tailscale0",
+		runner:  sleepRunner{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", []string{"10.0.0.0/24", "10.1.0.0/24"}))
+	if err == nil {
+		t.Error("SetRoutes succeeded after its context was cancelled")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("SetRoutes took %v to give up after cancellation", d)
+	}
+}
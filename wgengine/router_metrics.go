@@ -0,0 +1,36 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"expvar"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// routerMetrics counts Router operations, and is published through
+// expvar as "router". The keys are Prometheus-style counter names
+// with their labels folded in, ending in the address family where
+// there is one and then the result: "route_add_v4_ok",
+// "addr_del_v6_fail", "setroutes_ok", "command_fail" and so on.
+var routerMetrics = expvar.NewMap("router")
+
+// countResult counts an operation named name, as having failed if
+// err is non-nil.
+func countResult(name string, err error) {
+	if err != nil {
+		routerMetrics.Add(name+"_fail", 1)
+	} else {
+		routerMetrics.Add(name+"_ok", 1)
+	}
+}
+
+// metricFamily returns the address family label of cidr.
+func metricFamily(cidr wgcfg.CIDR) string {
+	if cidr.IP.Is6() {
+		return "v6"
+	}
+	return "v4"
+}
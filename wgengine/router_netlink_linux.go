@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/sys/unix"
+)
+
+// rtnetlink adds and removes addresses and routes by talking
+// rtnetlink directly, instead of running ip(8) for each change.
+type rtnetlink struct {
+	conn *netlink.Conn
+}
+
+func dialRtnetlink() (*rtnetlink, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, fmt.Errorf("dialing rtnetlink: %v", err)
+	}
+	return &rtnetlink{conn: conn}, nil
+}
+
+func (nl *rtnetlink) Close() error {
+	return nl.conn.Close()
+}
+
+func (nl *rtnetlink) addAddr(ctx context.Context, dev string, addr wgcfg.CIDR) error {
+	return nl.addr(ctx, unix.RTM_NEWADDR, netlink.Create|netlink.Excl, dev, addr)
+}
+
+func (nl *rtnetlink) delAddr(ctx context.Context, dev string, addr wgcfg.CIDR) error {
+	return nl.addr(ctx, unix.RTM_DELADDR, 0, dev, addr)
+}
+
+func (nl *rtnetlink) applyRoute(ctx context.Context, dev string, op routeOp) error {
+	if op.add && op.replace {
+		return nl.route(ctx, unix.RTM_NEWROUTE, netlink.Create|netlink.Replace, dev, op)
+	}
+	if op.add {
+		return nl.route(ctx, unix.RTM_NEWROUTE, netlink.Create|netlink.Excl, dev, op)
+	}
+	return nl.route(ctx, unix.RTM_DELROUTE, 0, dev, op)
+}
+
+func (nl *rtnetlink) addr(ctx context.Context, typ netlink.HeaderType, flags netlink.HeaderFlags, dev string, addr wgcfg.CIDR) error {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return err
+	}
+	family, ip := ipFamilyBytes(addr.IP.IP())
+
+	// struct ifaddrmsg, from linux/if_addr.h.
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = addr.Mask
+	copy(b[4:], nlenc.Uint32Bytes(uint32(ifi.Index)))
+
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.IFA_LOCAL, Data: ip},
+		{Type: unix.IFA_ADDRESS, Data: ip},
+	})
+	if err != nil {
+		return err
+	}
+	return nl.execute(ctx, typ, flags, append(b, attrs...))
+}
+
+func (nl *rtnetlink) route(ctx context.Context, typ netlink.HeaderType, flags netlink.HeaderFlags, dev string, op routeOp) error {
+	ifi, err := net.InterfaceByName(dev)
+	if err != nil {
+		return err
+	}
+	var via wgcfg.IP
+	if op.add {
+		via = routeGateway(op.dst, op.via)
+	}
+	ipnet := op.dst.IPNet()
+	family, dstIP := ipFamilyBytes(ipnet.IP.Mask(ipnet.Mask))
+
+	// struct rtmsg, from linux/rtnetlink.h. Filled in the same
+	// way that ip(8) does for "ip route add/del".
+	b := make([]byte, unix.SizeofRtMsg)
+	b[0] = family
+	b[1] = op.dst.Mask
+	b[4] = unix.RT_TABLE_MAIN
+	if op.table != 0 {
+		// Tables above 255 don't fit, and go in RTA_TABLE instead.
+		b[4] = unix.RT_TABLE_UNSPEC
+		if op.table < 256 {
+			b[4] = uint8(op.table)
+		}
+	}
+	if typ == unix.RTM_DELROUTE {
+		b[6] = unix.RT_SCOPE_NOWHERE
+	} else {
+		b[5] = routeProto
+		b[6] = unix.RT_SCOPE_UNIVERSE
+		b[7] = unix.RTN_UNICAST
+		if via == (wgcfg.IP{}) {
+			b[6] = unix.RT_SCOPE_LINK
+		} else if op.onlink {
+			copy(b[8:], nlenc.Uint32Bytes(unix.RTNH_F_ONLINK)) // rtm_flags
+		}
+	}
+
+	attrs := []netlink.Attribute{
+		{Type: unix.RTA_DST, Data: dstIP},
+		{Type: unix.RTA_OIF, Data: nlenc.Uint32Bytes(uint32(ifi.Index))},
+	}
+	if via != (wgcfg.IP{}) {
+		_, viaIP := ipFamilyBytes(via.IP())
+		attrs = append(attrs, netlink.Attribute{Type: unix.RTA_GATEWAY, Data: viaIP})
+	}
+	if src := op.routeSrc(); src != (wgcfg.IP{}) {
+		_, srcIP := ipFamilyBytes(src.IP())
+		attrs = append(attrs, netlink.Attribute{Type: unix.RTA_PREFSRC, Data: srcIP})
+	}
+	if op.add && op.metric != 0 {
+		attrs = append(attrs, netlink.Attribute{Type: unix.RTA_PRIORITY, Data: nlenc.Uint32Bytes(uint32(op.metric))})
+	}
+	if op.table >= 256 {
+		attrs = append(attrs, netlink.Attribute{Type: unix.RTA_TABLE, Data: nlenc.Uint32Bytes(uint32(op.table))})
+	}
+	ab, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return err
+	}
+	return nl.execute(ctx, typ, flags, append(b, ab...))
+}
+
+func (nl *rtnetlink) execute(ctx context.Context, typ netlink.HeaderType, flags netlink.HeaderFlags, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		if err := nl.conn.SetDeadline(d); err != nil {
+			return err
+		}
+		defer nl.conn.SetDeadline(time.Time{})
+	}
+	_, err := nl.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  typ,
+			Flags: netlink.Request | netlink.Acknowledge | flags,
+		},
+		Data: data,
+	})
+	return err
+}
+
+// ipFamilyBytes returns the address family of ip, and ip in the
+// form rtnetlink expects for that family.
+func ipFamilyBytes(ip net.IP) (family uint8, b []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return unix.AF_INET, ip4
+	}
+	return unix.AF_INET6, ip.To16()
+}
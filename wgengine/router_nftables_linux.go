@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// nftTable is the nftables table that holds all of the router's
+// rules, so that they can be removed in one go.
+const nftTable = "tailscale"
+
+// nftBaseChains maps the iptables built-in chains that the router
+// uses to the nftables base chain that hooks the same place.
+var nftBaseChains = map[string]string{
+	"FORWARD":     "{ type filter hook forward priority 0; }",
+	"POSTROUTING": "{ type nat hook postrouting priority 100; }",
+}
+
+// nftAddRule adds the nftables equivalent of rule, creating the
+// router's table and the rule's chain first if needed. A table left
+// behind by an earlier run, as after a crash, is flushed when it's
+// first used, as addChain does for iptables chains, so that its
+// rules aren't added a second time.
+func (r *linuxRouter) nftAddRule(ctx context.Context, rule iptablesRule) error {
+	expr, err := rule.nftExpr()
+	if err != nil {
+		return err
+	}
+	hook, ok := nftBaseChains[rule.chain]
+	if !ok {
+		return fmt.Errorf("no nftables equivalent for chain %q", rule.chain)
+	}
+	family := rule.nftFamily()
+	chain := strings.ToLower(rule.chain)
+	if !r.hasNFTRule(ctx, family, "") {
+		if err := r.nft(ctx, "add", "table", family, nftTable); err != nil {
+			return err
+		}
+		if err := r.nft(ctx, "flush", "table", family, nftTable); err != nil {
+			return err
+		}
+	}
+	if !r.hasNFTRule(ctx, family, rule.chain) {
+		if err := r.nft(ctx, "add", "chain", family, nftTable, chain, hook); err != nil {
+			return err
+		}
+	}
+	return r.nft(ctx, append([]string{"add", "rule", family, nftTable, chain}, expr...)...)
+}
+
+// nftDelRules removes all the rules added by nftAddRule.
+func (r *linuxRouter) nftDelRules(ctx context.Context) error {
+	var errq error
+	for _, family := range []string{"ip", "ip6"} {
+		if !r.hasNFTRule(ctx, family, "") {
+			continue
+		}
+		if err := r.nft(ctx, "delete", "table", family, nftTable); err != nil {
+			r.logf("nft del failed: %v", err)
+			if errq == nil {
+				errq = err
+			}
+		}
+	}
+	r.rules = nil
+	return errq
+}
+
+// nftFlushTables empties the router's tables, making each first in
+// case something else deleted it, so that its rules can be added
+// again without duplicating them.
+func (r *linuxRouter) nftFlushTables(ctx context.Context) error {
+	for _, family := range []string{"ip", "ip6"} {
+		if !r.hasNFTRule(ctx, family, "") {
+			continue
+		}
+		if err := r.nft(ctx, "add", "table", family, nftTable); err != nil {
+			return err
+		}
+		if err := r.nft(ctx, "flush", "table", family, nftTable); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasNFTRule reports whether the router has installed a rule in the
+// named chain of its table for family. If chain is empty, it reports
+// whether there are any rules in the table at all.
+func (r *linuxRouter) hasNFTRule(ctx context.Context, family, chain string) bool {
+	for _, rule := range r.rules {
+		if rule.nftFamily() == family && (chain == "" || rule.chain == chain) {
+			return true
+		}
+	}
+	return false
+}
+
+// nftFamily returns the nftables address family for rule.
+func (rule iptablesRule) nftFamily() string {
+	if rule.v6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// nft runs nft(8) with args.
+func (r *linuxRouter) nft(ctx context.Context, args ...string) error {
+	args = append([]string{"nft"}, args...)
+	if out, err := r.commands().Run(ctx, args...); err != nil {
+		return commandError(args, err, out)
+	}
+	return nil
+}
+
+// nftExpr translates rule's iptables specification into the
+// equivalent nftables rule expression.
+func (rule iptablesRule) nftExpr() ([]string, error) {
+	if len(rule.spec)%2 != 0 {
+		return nil, fmt.Errorf("malformed rule %q", rule.spec)
+	}
+	var expr []string
+	for i := 0; i < len(rule.spec); i += 2 {
+		flag, val := rule.spec[i], rule.spec[i+1]
+		switch {
+		case flag == "-i":
+			expr = append(expr, "iifname", val)
+		case flag == "-o":
+			expr = append(expr, "oifname", val)
+		case flag == "-m" && val == "conntrack":
+			// Implied by ct expressions.
+		case flag == "--ctstate":
+			expr = append(expr, "ct", "state", strings.ToLower(val))
+		case flag == "-j" && val == "ACCEPT":
+			expr = append(expr, "accept")
+		case flag == "-j" && val == "MASQUERADE":
+			expr = append(expr, "masquerade")
+		case flag == "-j" && val == "SNAT":
+			expr = append(expr, "snat")
+		case flag == "--to-source":
+			expr = append(expr, "to", val)
+		default:
+			return nil, fmt.Errorf("no nftables equivalent for %q in rule %q", flag+" "+val, rule.spec)
+		}
+	}
+	return expr, nil
+}
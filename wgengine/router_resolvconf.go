@@ -0,0 +1,307 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux freebsd openbsd
+
+package wgengine
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tailscale.com/atomicfile"
+)
+
+// resolvConfFiles are the files used to take over the system's
+// resolv.conf.
+type resolvConfFiles struct {
+	conf   string // the system's resolv.conf
+	ts     string // the file we point conf at
+	backup string // the original conf, while it points at ts
+}
+
+// defaultResolvConf is the system's resolv.conf, unless a router
+// is told otherwise.
+const defaultResolvConf = "/etc/resolv.conf"
+
+// resolvConfFilesAt returns the resolvConfFiles for the resolv.conf
+// at path, or defaultResolvConf if path is empty. Our own files go
+// next to it.
+func resolvConfFilesAt(path string) resolvConfFiles {
+	if path == "" {
+		path = defaultResolvConf
+	}
+	dir := filepath.Dir(path)
+	return resolvConfFiles{
+		conf:   path,
+		ts:     filepath.Join(dir, "resolv.tailscale.conf"),
+		backup: filepath.Join(dir, "resolv.pre-tailscale-backup.conf"),
+	}
+}
+
+// replaceResolvConf points the resolv.conf at path (if empty,
+// defaultResolvConf) at a file listing servers and domains, backing
+// up the original to put back with restoreResolvConf. With no
+// servers, it restores the original instead. If non-nil, changed is
+// called after resolv.conf changes.
+func replaceResolvConf(path string, servers []net.IP, domains []string, changed func()) error {
+	return resolvConfFilesAt(path).replace(servers, domains, changed)
+}
+
+// restoreResolvConf undoes replaceResolvConf for the resolv.conf at
+// path. If non-nil, changed is called after resolv.conf changes.
+func restoreResolvConf(path string, changed func()) error {
+	return resolvConfFilesAt(path).restore(changed)
+}
+
+// replace is replaceResolvConf for the files in f.
+//
+// Each file is replaced with a rename, so that a crash at any point
+// leaves either the old or the new version in place. The original
+// conf, be it a file or a symlink, is only backed up while conf
+// doesn't already point at ts, so a replace after a crash doesn't
+// back up our own file over the original.
+func (f resolvConfFiles) replace(servers []net.IP, domains []string, changed func()) error {
+	if len(servers) == 0 {
+		return f.restore(changed)
+	}
+
+	// First write the ts file.
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# resolv.conf(5) file generated by tailscale\n")
+	fmt.Fprintf(buf, "#     DO NOT EDIT THIS FILE BY HAND -- CHANGES WILL BE OVERWRITTEN\n\n")
+	for _, ns := range servers {
+		fmt.Fprintf(buf, "nameserver %s\n", ns)
+	}
+	if len(domains) > 0 {
+		fmt.Fprintf(buf, "search "+strings.Join(domains, " ")+"\n")
+	}
+	if err := atomicfile.WriteFile(f.ts, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if linkPath, err := os.Readlink(f.conf); err != nil {
+		// Back up the existing file, keeping its permissions.
+		fi, err := os.Stat(f.conf)
+		if os.IsNotExist(err) {
+			// No existing resolv.conf file to back up.
+			// Nothing to do.
+			return nil
+		} else if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(f.conf)
+		if err != nil {
+			return err
+		}
+		if err := atomicfile.WriteFile(f.backup, contents, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	} else if linkPath != f.ts {
+		// Back up the existing symlink, as it is: its target may
+		// well be relative.
+		if err := replaceSymlink(linkPath, f.backup); err != nil {
+			return err
+		}
+	} else {
+		// Nothing to do, conf already points to ts.
+		return nil
+	}
+
+	if err := replaceSymlink(f.ts, f.conf); err != nil {
+		return err
+	}
+	if changed != nil {
+		changed()
+	}
+	return nil
+}
+
+// restore is restoreResolvConf for the files in f.
+func (f resolvConfFiles) restore(changed func()) error {
+	if _, err := os.Lstat(f.backup); err != nil {
+		if os.IsNotExist(err) {
+			return nil // no backup resolv.conf to restore
+		}
+		return err
+	}
+	if ln, err := os.Readlink(f.conf); err != nil || ln != f.ts {
+		// Something else has replaced conf since, or we crashed
+		// between backing it up and replacing it. Either way,
+		// conf is no longer ours to restore, and the backup is
+		// stale.
+		os.Remove(f.backup)
+		return nil
+	}
+	if err := os.Rename(f.backup, f.conf); err != nil {
+		return err
+	}
+	os.Remove(f.ts) // best effort removal of ts file
+	if changed != nil {
+		changed()
+	}
+	return nil
+}
+
+// resolvConfBegin and resolvConfEnd bracket the lines that
+// appendResolvConf adds to resolv.conf, so that they can be found and
+// taken out again.
+const (
+	resolvConfBegin = "# BEGIN tailscale: lines added by tailscaled, removed when it stops"
+	resolvConfEnd   = "# END tailscale"
+)
+
+// maxResolvConfNameservers is how many nameserver lines the resolver
+// reads from resolv.conf (MAXNS in resolv.h); it ignores the rest.
+const maxResolvConfNameservers = 3
+
+// appendResolvConf adds servers and domains to the resolv.conf at
+// path (if empty, defaultResolvConf) after its own entries, which are
+// left as they are, replacing the lines of any earlier call. Only the
+// last search line counts, so ours lists the file's own domains
+// before domains. With no servers, it takes our lines out instead.
+// If non-nil, changed is called after resolv.conf changes. If the
+// file's own nameservers leave no room for ours, a warning is logged
+// with logf.
+func appendResolvConf(logf func(format string, args ...interface{}), path string, servers []net.IP, domains []string, changed func()) error {
+	if len(servers) == 0 {
+		return unappendResolvConf(path, changed)
+	}
+	return editResolvConf(path, func(own []string) []string {
+		if ns := resolvConfNameservers(own); len(ns) >= maxResolvConfNameservers {
+			logf("warning: resolv.conf already has %d nameservers, and the resolver only uses the first %d; ours will be ignored", len(ns), maxResolvConfNameservers)
+		}
+		lines := append(own, resolvConfBegin)
+		for _, ns := range servers {
+			lines = append(lines, "nameserver "+ns.String())
+		}
+		if len(domains) > 0 {
+			search := resolvConfSearch(own)
+			for _, d := range domains {
+				if !hasString(search, d) {
+					search = append(search, d)
+				}
+			}
+			lines = append(lines, "search "+strings.Join(search, " "))
+		}
+		return append(lines, resolvConfEnd)
+	}, changed)
+}
+
+// unappendResolvConf takes the lines added by appendResolvConf out of
+// the resolv.conf at path. If non-nil, changed is called after
+// resolv.conf changes.
+func unappendResolvConf(path string, changed func()) error {
+	return editResolvConf(path, func(own []string) []string { return own }, changed)
+}
+
+// editResolvConf replaces the resolv.conf at path (if empty,
+// defaultResolvConf) with the lines that edit returns, given its
+// lines without those added by appendResolvConf. If conf is a
+// symlink, its target is edited. It's left alone if nothing changes.
+func editResolvConf(path string, edit func(own []string) []string, changed func()) error {
+	if path == "" {
+		path = defaultResolvConf
+	}
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	mode := os.FileMode(0644)
+	contents, err := ioutil.ReadFile(path)
+	if err == nil {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		mode = fi.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var own []string
+	if text := strings.TrimRight(string(contents), "\n"); text != "" {
+		ours := false
+		for _, line := range strings.Split(text, "\n") {
+			switch {
+			case line == resolvConfBegin:
+				ours = true
+			case line == resolvConfEnd:
+				ours = false
+			case !ours:
+				own = append(own, line)
+			}
+		}
+	}
+	lines := edit(own)
+	var out []byte
+	if len(lines) > 0 {
+		out = []byte(strings.Join(lines, "\n") + "\n")
+	}
+	if bytes.Equal(out, contents) || (len(out) == 0 && contents == nil) {
+		return nil
+	}
+	if err := atomicfile.WriteFile(path, out, mode); err != nil {
+		return err
+	}
+	if changed != nil {
+		changed()
+	}
+	return nil
+}
+
+// resolvConfSearch returns the search domains in lines, from
+// resolv.conf: those of the last search or domain line.
+func resolvConfSearch(lines []string) []string {
+	var search []string
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if len(f) > 0 && (f[0] == "search" || f[0] == "domain") {
+			search = append([]string(nil), f[1:]...)
+		}
+	}
+	return search
+}
+
+// resolvConfNameservers returns the addresses of the nameserver
+// lines in a resolv.conf, in order.
+func resolvConfNameservers(lines []string) []string {
+	var ret []string
+	for _, line := range lines {
+		f := strings.Fields(line)
+		if len(f) >= 2 && f[0] == "nameserver" {
+			ret = append(ret, f[1])
+		}
+	}
+	return ret
+}
+
+// hasString reports whether ss contains s.
+func hasString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// replaceSymlink atomically makes name a symlink to target, replacing
+// whatever name was before.
+func replaceSymlink(target, name string) error {
+	tmp := name + ".new.tmp"
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux freebsd openbsd
+
+package wgengine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempResolvConf returns resolvConfFiles in a new temporary
+// directory, and a func to remove it.
+func tempResolvConf(t *testing.T) (resolvConfFiles, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "resolvconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := resolvConfFilesAt(filepath.Join(dir, "resolv.conf"))
+	return f, func() { os.RemoveAll(dir) }
+}
+
+// readFile returns the contents of name, which must exist.
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// exists reports whether name exists, not following symlinks.
+func exists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
+}
+
+func TestResolvConfFile(t *testing.T) {
+	f, cleanup := tempResolvConf(t)
+	defer cleanup()
+	const orig = "nameserver 192.168.1.1\n"
+	if err := ioutil.WriteFile(f.conf, []byte(orig), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	changes := 0
+	changed := func() { changes++ }
+	servers := []net.IP{net.ParseIP("100.100.100.100")}
+	for i := 0; i < 2; i++ {
+		if err := f.replace(servers, []string{"example.com"}, changed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ln, err := os.Readlink(f.conf); err != nil || ln != f.ts {
+		t.Errorf("resolv.conf links to %q, %v; want %q", ln, err, f.ts)
+	}
+	if got := readFile(t, f.conf); !strings.Contains(got, "nameserver 100.100.100.100\nsearch example.com\n") {
+		t.Errorf("resolv.conf is:\n%s", got)
+	}
+	// The second replace mustn't back up our own file.
+	if got := readFile(t, f.backup); got != orig {
+		t.Errorf("backup is %q; want %q", got, orig)
+	}
+	if changes != 1 {
+		t.Errorf("changed called %d times after replace; want 1", changes)
+	}
+
+	if err := f.restore(changed); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(f.conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.Mode().IsRegular() || fi.Mode().Perm() != 0640 {
+		t.Errorf("restored resolv.conf has mode %v; want a regular file with mode 0640", fi.Mode())
+	}
+	if got := readFile(t, f.conf); got != orig {
+		t.Errorf("restored resolv.conf is %q; want %q", got, orig)
+	}
+	if exists(f.backup) || exists(f.ts) {
+		t.Error("restore left the backup or our file behind")
+	}
+	if changes != 2 {
+		t.Errorf("changed called %d times after restore; want 2", changes)
+	}
+}
+
+func TestResolvConfSymlink(t *testing.T) {
+	f, cleanup := tempResolvConf(t)
+	defer cleanup()
+	// Like systemd-resolved's, the link is relative and its target
+	// needn't be there.
+	const orig = "../run/systemd/resolve/stub-resolv.conf"
+	if err := os.Symlink(orig, f.conf); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := []net.IP{net.ParseIP("100.100.100.100")}
+	if err := f.replace(servers, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := os.Readlink(f.conf); err != nil || ln != f.ts {
+		t.Errorf("resolv.conf links to %q, %v; want %q", ln, err, f.ts)
+	}
+	if ln, err := os.Readlink(f.backup); err != nil || ln != orig {
+		t.Errorf("backup links to %q, %v; want %q", ln, err, orig)
+	}
+
+	// No servers is the same as restoring.
+	if err := f.replace(nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := os.Readlink(f.conf); err != nil || ln != orig {
+		t.Errorf("restored resolv.conf links to %q, %v; want %q", ln, err, orig)
+	}
+	if exists(f.backup) || exists(f.ts) {
+		t.Error("restore left the backup or our file behind")
+	}
+}
+
+func TestResolvConfStaleBackup(t *testing.T) {
+	f, cleanup := tempResolvConf(t)
+	defer cleanup()
+	// As if we crashed between backing up resolv.conf and
+	// replacing it.
+	const orig = "nameserver 192.168.1.1\n"
+	for _, name := range []string{f.conf, f.backup} {
+		if err := ioutil.WriteFile(name, []byte(orig), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.restore(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, f.conf); got != orig {
+		t.Errorf("resolv.conf is %q; want %q", got, orig)
+	}
+	if exists(f.backup) {
+		t.Error("stale backup left behind")
+	}
+}
+
+func TestResolvConfFilesAt(t *testing.T) {
+	f := resolvConfFilesAt("")
+	want := resolvConfFiles{
+		conf:   "/etc/resolv.conf",
+		ts:     "/etc/resolv.tailscale.conf",
+		backup: "/etc/resolv.pre-tailscale-backup.conf",
+	}
+	if f != want {
+		t.Errorf("default files are %+v; want %+v", f, want)
+	}
+}
+
+func TestAppendResolvConf(t *testing.T) {
+	f, cleanup := tempResolvConf(t)
+	defer cleanup()
+	const orig = "# from DHCP\nnameserver 192.168.1.1\nsearch home.arpa\n"
+	if err := ioutil.WriteFile(f.conf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	changes := 0
+	changed := func() { changes++ }
+
+	servers := []net.IP{net.ParseIP("100.100.100.100")}
+	domains := []string{"example.ts.net", "home.arpa"}
+	want := orig + resolvConfBegin + "\n" +
+		"nameserver 100.100.100.100\n" +
+		"search home.arpa example.ts.net\n" +
+		resolvConfEnd + "\n"
+	// Appending again changes nothing.
+	for i := 0; i < 2; i++ {
+		if err := appendResolvConf(t.Logf, f.conf, servers, domains, changed); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, f.conf); got != want {
+			t.Errorf("append %d: resolv.conf is:\n%s\nwant:\n%s", i+1, got, want)
+		}
+	}
+	if changes != 1 {
+		t.Errorf("resolv.conf changed %d times; want 1", changes)
+	}
+
+	// New settings replace our lines, not add to them.
+	servers = []net.IP{net.ParseIP("100.100.100.100"), net.ParseIP("fd7a:115c:a1e0::53")}
+	if err := appendResolvConf(t.Logf, f.conf, servers, nil, changed); err != nil {
+		t.Fatal(err)
+	}
+	want = orig + resolvConfBegin + "\n" +
+		"nameserver 100.100.100.100\n" +
+		"nameserver fd7a:115c:a1e0::53\n" +
+		resolvConfEnd + "\n"
+	if got := readFile(t, f.conf); got != want {
+		t.Errorf("resolv.conf is:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Something else adding lines after ours keeps them.
+	const extra = "options edns0\n"
+	fh, err := os.OpenFile(f.conf, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh.WriteString(extra)
+	fh.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := unappendResolvConf(f.conf, changed); err != nil {
+			t.Fatal(err)
+		}
+		if got := readFile(t, f.conf); got != orig+extra {
+			t.Errorf("remove %d: resolv.conf is:\n%s\nwant:\n%s", i+1, got, orig+extra)
+		}
+	}
+	if changes != 3 {
+		t.Errorf("resolv.conf changed %d times; want 3", changes)
+	}
+	if exists(f.ts) || exists(f.backup) {
+		t.Error("appending made our own resolv.conf files")
+	}
+}
+
+func TestAppendResolvConfSymlink(t *testing.T) {
+	f, cleanup := tempResolvConf(t)
+	defer cleanup()
+	target := filepath.Join(filepath.Dir(f.conf), "stub-resolv.conf")
+	const orig = "nameserver 127.0.0.53\n"
+	if err := ioutil.WriteFile(target, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("stub-resolv.conf", f.conf); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendResolvConf(t.Logf, f.conf, []net.IP{net.ParseIP("100.100.100.100")}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := os.Readlink(f.conf); err != nil || ln != "stub-resolv.conf" {
+		t.Errorf("resolv.conf links to %q, %v; want it left alone", ln, err)
+	}
+	if got := readFile(t, target); !strings.Contains(got, "nameserver 100.100.100.100\n") {
+		t.Errorf("link target is:\n%s\nwant our nameserver added", got)
+	}
+	if err := unappendResolvConf(f.conf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, target); got != orig {
+		t.Errorf("link target is:\n%s\nwant:\n%s", got, orig)
+	}
+}
+
+func TestAppendResolvConfFull(t *testing.T) {
+	f, cleanup := tempResolvConf(t)
+	defer cleanup()
+	const orig = "nameserver 192.168.1.1\nnameserver 192.168.1.2\nnameserver 192.168.1.3\n"
+	if err := ioutil.WriteFile(f.conf, []byte(orig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	if err := appendResolvConf(logf, f.conf, []net.IP{net.ParseIP("100.100.100.100")}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 1 || !strings.Contains(logs[0], "already has 3 nameservers") {
+		t.Errorf("logged %q; want a warning about the 3 nameservers", logs)
+	}
+	if got := readFile(t, f.conf); !strings.Contains(got, "nameserver 100.100.100.100\n") {
+		t.Errorf("resolv.conf is:\n%s\nwant our nameserver added anyway", got)
+	}
+
+	// With room for ours, there's no warning.
+	if err := ioutil.WriteFile(f.conf, []byte("nameserver 192.168.1.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	logs = nil
+	if err := appendResolvConf(logf, f.conf, []net.IP{net.ParseIP("100.100.100.100")}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 0 {
+		t.Errorf("logged %q; want nothing", logs)
+	}
+}
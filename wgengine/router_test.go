@@ -0,0 +1,339 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/tailscale/wireguard-go/wgcfg"
+)
+
+// fakeRunner is a commandRunner that records the commands it is
+// asked to run and returns canned output for them.
+type fakeRunner struct {
+	cmds    []string          // commands run, space-separated
+	outputs map[string]string // canned output, keyed by command
+	fail    map[string]bool   // commands that fail
+	missing map[string]bool   // programs that aren't installed
+
+	// script is the result of the commands that aren't in outputs
+	// or fail, from the first response whose prefix they start
+	// with.
+	script []fakeResponse
+}
+
+// fakeResponse is a scripted fakeRunner result for the commands
+// that start with prefix.
+type fakeResponse struct {
+	prefix string
+	out    string
+	err    error // if non-nil, the command fails with it
+}
+
+// result returns the output and error to give for the command c.
+func (f *fakeRunner) result(c string) ([]byte, error) {
+	_, canned := f.outputs[c]
+	if f.fail[c] {
+		return []byte(f.outputs[c]), errors.New("exit status 1")
+	}
+	if !canned {
+		for _, resp := range f.script {
+			if strings.HasPrefix(c, resp.prefix) {
+				return []byte(resp.out), resp.err
+			}
+		}
+	}
+	return []byte(f.outputs[c]), nil
+}
+
+func (f *fakeRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	c := strings.Join(args, " ")
+	f.cmds = append(f.cmds, c)
+	if f.missing[args[0]] {
+		return nil, &exec.Error{Name: args[0], Err: exec.ErrNotFound}
+	}
+	return f.result(c)
+}
+
+// RunStdin records the batch command, followed by each of the
+// commands in the batch as if they'd been run by themselves.
+// Failing batch commands are reported the way "ip -force -batch"
+// does.
+func (f *fakeRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	f.cmds = append(f.cmds, strings.Join(args, " "))
+	var out []byte
+	var err error
+	for i, line := range strings.Split(strings.TrimSpace(string(stdin)), "\n") {
+		c := args[0] + " " + line
+		f.cmds = append(f.cmds, c)
+		if cout, cerr := f.result(c); cerr != nil {
+			out = append(out, fmt.Sprintf("%s\nCommand failed -:%d\n", cout, i+1)...)
+			err = errors.New("exit status 1")
+		}
+	}
+	return out, err
+}
+
+// ran reports whether the command c was run.
+func (f *fakeRunner) ran(c string) bool {
+	for _, got := range f.cmds {
+		if got == c {
+			return true
+		}
+	}
+	return false
+}
+
+// countPrefix returns the number of commands in cmds that start
+// with prefix.
+func countPrefix(cmds []string, prefix string) int {
+	n := 0
+	for _, c := range cmds {
+		if strings.HasPrefix(c, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// failingRunner is a commandRunner whose commands all fail.
+type failingRunner struct{}
+
+func (failingRunner) Run(ctx context.Context, args ...string) ([]byte, error) {
+	return []byte("Cannot find device"), errors.New("exit status 1")
+}
+
+func (failingRunner) RunStdin(ctx context.Context, stdin []byte, args ...string) ([]byte, error) {
+	return []byte("Cannot find device"), errors.New("exit status 1")
+}
+
+// mustCIDR returns the CIDR for s, which must be valid.
+func mustCIDR(t *testing.T, s string) wgcfg.CIDR {
+	t.Helper()
+	cidr, err := wgcfg.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *cidr
+}
+
+// peerSettings returns RouteSettings with local address local and
+// one peer per entry in allowedIPs.
+func peerSettings(t *testing.T, local string, allowedIPs ...[]string) RouteSettings {
+	t.Helper()
+	rs := RouteSettings{Cfg: new(wgcfg.Config)}
+	if local != "" {
+		rs.LocalAddrs = []wgcfg.CIDR{mustCIDR(t, local)}
+	}
+	for _, ips := range allowedIPs {
+		var peer wgcfg.Peer
+		for _, ip := range ips {
+			peer.AllowedIPs = append(peer.AllowedIPs, mustCIDR(t, ip))
+		}
+		rs.Cfg.Peers = append(rs.Cfg.Peers, peer)
+	}
+	return rs
+}
+
+func TestMultiErrorIs(t *testing.T) {
+	err := MultiError{errors.New("route add failed"), fmt.Errorf("setting routes: %w", ErrInterfaceGone)}
+	if !errors.Is(err, ErrInterfaceGone) {
+		t.Errorf("errors.Is(%v, ErrInterfaceGone) = false", err)
+	}
+	if errors.Is(MultiError{errors.New("route add failed")}, ErrInterfaceGone) {
+		t.Error("found ErrInterfaceGone in a MultiError without it")
+	}
+}
+
+func TestCommandErrorFields(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh")
+	}
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	args := []string{"sh", "-c", "echo 'RTNETLINK answers: File exists' >&2; exit 2"}
+	out, err := execRunner{}.Run(context.Background(), args...)
+	if err == nil {
+		t.Fatal("command didn't fail")
+	}
+	err = commandError(args, err, out)
+	logf("route add failed: %v", err)
+	want := `route add failed: cmd="sh -c echo 'RTNETLINK answers: File exists' >&2; exit 2" exit=2 output="RTNETLINK answers: File exists"`
+	if logs[0] != want {
+		t.Errorf("logged:\n%s\nwant:\n%s", logs[0], want)
+	}
+	if !isFileExists(err) {
+		t.Error("isFileExists doesn't see the output")
+	}
+
+	// A command that doesn't run has no exit status.
+	args = []string{"tailscale-no-such-command"}
+	out, err = execRunner{}.Run(context.Background(), args...)
+	err = commandError(args, err, out)
+	if got := err.Error(); !strings.HasPrefix(got, `cmd="tailscale-no-such-command" err=`) || strings.Contains(got, "exit=") {
+		t.Errorf("error is %q", got)
+	}
+	if !isNotInstalled(err) {
+		t.Error("isNotInstalled doesn't see through the error")
+	}
+}
+
+func TestExecRunnerNoArgs(t *testing.T) {
+	if _, err := (execRunner{}).Run(context.Background()); err == nil {
+		t.Error("Run with no args succeeded; want error")
+	}
+	if _, err := (execRunner{}).RunStdin(context.Background(), []byte("in\n")); err == nil {
+		t.Error("RunStdin with no args succeeded; want error")
+	}
+}
+
+func TestResolveBinPaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs an executable without an extension")
+	}
+	dir, err := ioutil.TempDir("", "binpaths")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ip := filepath.Join(dir, "ip")
+	if err := ioutil.WriteFile(ip, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	programs := []program{
+		{name: "ip", required: true},
+		{name: "tailscale-no-such-program"},
+	}
+	paths, err := resolveBinPaths(programs, map[string]string{"ip": ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths["ip"] != ip {
+		t.Errorf("ip resolved to %q; want the override %q", paths["ip"], ip)
+	}
+	if _, ok := paths["tailscale-no-such-program"]; ok || len(paths) != 1 {
+		t.Errorf("paths = %v; want just ip", paths)
+	}
+
+	// A required program that can't be found is an error.
+	programs[0].required, programs[1].required = false, true
+	if _, err := resolveBinPaths(programs, map[string]string{"ip": ip}); err == nil || !strings.Contains(err.Error(), "tailscale-no-such-program is required") {
+		t.Errorf("missing required program: err = %v", err)
+	}
+}
+
+func TestCheckTunName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"tailscale0", true},
+		{"utun3", true},
+		{"tun-1.2_3", true},
+		{"", false},
+		{"tailscale0123456", false}, // 16 characters
+		{"-tailscale0", false},
+		{"tail scale", false},
+		{"tail/scale", false},
+		{"tail:0", false},
+	}
+	for _, tt := range tests {
+		err := checkTunName(tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkTunName(%q) = %v; want ok=%v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestRouteSettingsValidate(t *testing.T) {
+	valid := func() RouteSettings {
+		rs := peerSettings(t, "100.101.102.103/10", []string{"10.1.2.3/16", "fd7a::/48"})
+		rs.NextHops = map[wgcfg.CIDR]wgcfg.IP{mustCIDR(t, "10.1.0.0/16"): mustCIDR(t, "100.64.0.2/32").IP}
+		rs.DNS = []net.IP{net.ParseIP("100.100.100.100")}
+		return rs
+	}
+	rs := valid()
+	if err := rs.Validate(); err != nil {
+		t.Fatalf("valid settings: %v", err)
+	}
+	empty := peerSettings(t, "")
+	if err := empty.Validate(); err != nil {
+		t.Errorf("empty settings: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*RouteSettings)
+		want   string
+	}{
+		{"no config", func(rs *RouteSettings) { rs.Cfg = nil }, "no WireGuard config"},
+		{"no local address", func(rs *RouteSettings) { rs.LocalAddrs = nil }, "no local address"},
+		{"unspecified local address", func(rs *RouteSettings) { rs.LocalAddrs[0] = mustCIDR(t, "0.0.0.0/10") }, "unspecified"},
+		{"long local mask", func(rs *RouteSettings) { rs.LocalAddrs[0].Mask = 33 }, "mask /33"},
+		{"long allowed IP mask", func(rs *RouteSettings) { rs.Cfg.Peers[0].AllowedIPs[1].Mask = 129 }, "mask /129"},
+		{"long next hop mask", func(rs *RouteSettings) {
+			rs.NextHops = map[wgcfg.CIDR]wgcfg.IP{{IP: mustCIDR(t, "10.1.0.0/16").IP, Mask: 40}: mustCIDR(t, "100.64.0.2/32").IP}
+		}, "mask /40"},
+		{"next hop family", func(rs *RouteSettings) {
+			rs.NextHops = map[wgcfg.CIDR]wgcfg.IP{mustCIDR(t, "fd7a::/48"): mustCIDR(t, "100.64.0.2/32").IP}
+		}, "other address family"},
+		{"long blackhole mask", func(rs *RouteSettings) { rs.Blackholes = []wgcfg.CIDR{{IP: mustCIDR(t, "10.9.0.0/16").IP, Mask: 33}} }, "mask /33"},
+		{"bad DNS server", func(rs *RouteSettings) { rs.DNS = []net.IP{{1, 2, 3}} }, "invalid DNS server"},
+	}
+	for _, tt := range tests {
+		rs := valid()
+		tt.modify(&rs)
+		if err := rs.Validate(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Validate = %v; want an error containing %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCanonicalCIDR(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"10.1.0.0/16", "10.1.0.0/16"},
+		{"10.1.2.3/16", "10.1.0.0/16"},
+		{"100.101.102.103/32", "100.101.102.103/32"},
+		{"100.101.102.103/0", "0.0.0.0/0"},
+		{"fd7a:115c:a1e0::/48", "fd7a:115c:a1e0::/48"},
+		{"fd7a:115c:a1e0:ab12:4843:cd96:6258:b240/48", "fd7a:115c:a1e0::/48"},
+		{"fd7a:115c:a1e0:ab12:4843:cd96:6258:b240/128", "fd7a:115c:a1e0:ab12:4843:cd96:6258:b240/128"},
+		{"fd7a::1/0", "::/0"},
+	}
+	for _, tt := range tests {
+		if got := canonicalCIDR(mustCIDR(t, tt.in)); got != tt.want {
+			t.Errorf("canonicalCIDR(%s) = %s; want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRouterStatusMasksRoutes(t *testing.T) {
+	routes := map[wgcfg.CIDR]struct{}{
+		mustCIDR(t, "10.1.2.3/16"): {},
+		mustCIDR(t, "10.1.0.0/16"): {},
+		mustCIDR(t, "fd7a::1/64"):  {},
+		mustCIDR(t, "10.0.0.1/32"): {},
+		mustCIDR(t, "10.0.0.0/8"):  {},
+	}
+	st := routerStatus(nil, routes, nil, nil)
+	if got, want := fmt.Sprint(st.Routes), "[10.0.0.0/8 10.0.0.1/32 10.1.0.0/16 fd7a::/64]"; got != want {
+		t.Errorf("Routes = %v; want %v", got, want)
+	}
+}
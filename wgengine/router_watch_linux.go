@@ -0,0 +1,307 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"github.com/tailscale/wireguard-go/wgcfg"
+	"golang.org/x/sys/unix"
+)
+
+// The rtnetlink multicast groups for address and route changes, from
+// rtnetlink.h, as x/sys/unix doesn't have them.
+const (
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6Ifaddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// routeEventConn is where the watcher receives rtnetlink events from.
+// *netlink.Conn implements it.
+type routeEventConn interface {
+	Receive() ([]netlink.Message, error)
+	Close() error
+}
+
+// dialRouteEvents subscribes to the kernel's address and route
+// changes.
+func dialRouteEvents() (routeEventConn, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{
+		Groups: rtmgrpIPv4Ifaddr | rtmgrpIPv4Route | rtmgrpIPv6Ifaddr | rtmgrpIPv6Route,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dialing rtnetlink: %v", err)
+	}
+	return conn, nil
+}
+
+// routeDeletion is an address or route that the kernel reported
+// deleted from the interface with index ifindex.
+type routeDeletion struct {
+	addr    bool // whether it's an address, rather than a route
+	ifindex int
+	cidr    wgcfg.CIDR
+}
+
+// parseRouteDeletion returns the deletion that m reports, if it's an
+// RTM_DELADDR or RTM_DELROUTE message.
+func parseRouteDeletion(m netlink.Message) (routeDeletion, bool) {
+	var d routeDeletion
+	var hdrLen int
+	var ipAttrs []uint16 // attributes holding the IP, in preference order
+	switch m.Header.Type {
+	case unix.RTM_DELADDR:
+		// struct ifaddrmsg: family, prefix length, flags, scope,
+		// then the interface index.
+		hdrLen, d.addr = unix.SizeofIfAddrmsg, true
+		ipAttrs = []uint16{unix.IFA_LOCAL, unix.IFA_ADDRESS}
+	case unix.RTM_DELROUTE:
+		// struct rtmsg: family, then the destination's length.
+		hdrLen = unix.SizeofRtMsg
+		ipAttrs = []uint16{unix.RTA_DST}
+	default:
+		return d, false
+	}
+	if len(m.Data) < hdrLen {
+		return d, false
+	}
+	family, mask := m.Data[0], m.Data[1]
+	if family != unix.AF_INET && family != unix.AF_INET6 {
+		return d, false
+	}
+	if d.addr {
+		d.ifindex = int(nlenc.Uint32(m.Data[4:8]))
+	}
+	attrs, err := netlink.UnmarshalAttributes(m.Data[hdrLen:])
+	if err != nil {
+		return d, false
+	}
+	ips := make(map[uint16][]byte)
+	for _, a := range attrs {
+		if !d.addr && a.Type == unix.RTA_OIF && len(a.Data) == 4 {
+			d.ifindex = int(nlenc.Uint32(a.Data))
+			continue
+		}
+		ips[a.Type] = a.Data
+	}
+	// A default route has no RTA_DST, and is all zeros.
+	ip := net.IPv4zero
+	if family == unix.AF_INET6 {
+		ip = net.IPv6zero
+	}
+	for _, t := range ipAttrs {
+		if b, ok := ips[t]; ok && (len(b) == net.IPv4len || len(b) == net.IPv6len) {
+			ip = net.IP(b)
+			break
+		}
+	}
+	copy(d.cidr.IP.Addr[:], ip.To16())
+	d.cidr.Mask = mask
+	return d, true
+}
+
+// startWatch starts watching rtnetlink for the tun device's addresses
+// and routes being deleted by something else, such as NetworkManager
+// or dhcpcd, adding them back with setRoutes when they are. Close
+// stops it. Failing to start is only logged, as the router works
+// without it.
+func (r *linuxRouter) startWatch() {
+	if r.netns != "" {
+		// The socket would be in tailscaled's namespace, not the
+		// tun device's.
+		r.logf("not watching for deleted routes in network namespace %s", r.netns)
+		return
+	}
+	ifindex, err := r.tunIfindex()
+	if err != nil {
+		r.logf("not watching for deleted routes: %v", err)
+		return
+	}
+	dial := r.dialRouteEvents
+	if dial == nil {
+		dial = dialRouteEvents
+	}
+	conn, err := dial()
+	if err != nil {
+		r.logf("not watching for deleted routes: %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &routeWatch{
+		r:       r,
+		conn:    conn,
+		ifindex: ifindex,
+		kick:    make(chan struct{}, 1),
+	}
+	r.stopWatch = func() {
+		cancel()
+		conn.Close()
+	}
+	r.watchIndex = ifindex
+	go w.receive(ctx)
+	go w.repairLoop(ctx)
+}
+
+// checkWatch starts the watcher if repairRoutes is set and it isn't
+// running. If the tun device has a new interface index, as after it
+// was deleted and made again, the watcher is restarted, as it would
+// otherwise ignore the new device's events.
+func (r *linuxRouter) checkWatch() {
+	if !r.repairRoutes || r.dryRun {
+		return
+	}
+	if r.stopWatch != nil {
+		ifindex, err := r.tunIfindex()
+		if err != nil || ifindex == r.watchIndex {
+			return
+		}
+		r.logf("%s has a new interface index %d; restarting the route watcher", r.tunname, ifindex)
+		r.stopWatch()
+		r.stopWatch, r.watchIndex, r.ownDeletes = nil, 0, nil
+	}
+	r.startWatch()
+}
+
+// tunIfindex returns the tun device's interface index. checkTun,
+// which Up and Reload run first, keeps tunIndex up to date as the
+// device is made again; without it, as with an ip(8) too old to say,
+// the kernel is asked.
+func (r *linuxRouter) tunIfindex() (int, error) {
+	if r.tunIndex != 0 {
+		return r.tunIndex, nil
+	}
+	ifi, err := net.InterfaceByName(r.tunname)
+	if err != nil {
+		return 0, err
+	}
+	return ifi.Index, nil
+}
+
+// noteOwnDeletes records the routes through the tun device that ops
+// deleted, where errs says they succeeded, so that repair doesn't
+// take the kernel's events for them as something else deleting
+// them. Changing a route, as for a new metric, deletes it and adds
+// it back.
+func (r *linuxRouter) noteOwnDeletes(ops []routeOp, errs []error) {
+	for i, op := range ops {
+		if op.add || op.kind != "" || errs[i] != nil {
+			continue
+		}
+		if r.ownDeletes == nil {
+			r.ownDeletes = make(map[wgcfg.CIDR]int)
+		}
+		r.ownDeletes[networkCIDR(op.dst)]++
+	}
+}
+
+// routeWatch is a running watcher started by startWatch.
+type routeWatch struct {
+	r       *linuxRouter
+	conn    routeEventConn
+	ifindex int           // the tun device's
+	kick    chan struct{} // signals that pending has deletions
+
+	mu      sync.Mutex // guards pending
+	pending []routeDeletion
+}
+
+// receive queues the deletions from the tun device that conn
+// reports, until ctx is done.
+func (w *routeWatch) receive(ctx context.Context) {
+	for {
+		msgs, err := w.conn.Receive()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			w.r.logf("receiving route events failed: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, m := range msgs {
+			d, ok := parseRouteDeletion(m)
+			if !ok || d.ifindex != w.ifindex {
+				continue
+			}
+			w.mu.Lock()
+			w.pending = append(w.pending, d)
+			w.mu.Unlock()
+			select {
+			case w.kick <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// repairLoop repairs the tun device after each batch of deletions,
+// until ctx is done.
+func (w *routeWatch) repairLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.kick:
+		}
+		w.mu.Lock()
+		pending := w.pending
+		w.pending = nil
+		w.mu.Unlock()
+		w.r.repair(ctx, pending)
+	}
+}
+
+// repair adds back whichever of deleted are the router's own
+// addresses and routes. The router's own changes also delete them,
+// but by the time repair has opMu, they're no longer in its state.
+func (r *linuxRouter) repair(ctx context.Context, deleted []routeDeletion) {
+	r.opMu.Lock()
+	defer r.opMu.Unlock()
+	if r.closed || ctx.Err() != nil {
+		return
+	}
+	var lost []wgcfg.CIDR
+	for _, d := range deleted {
+		dst := networkCIDR(d.cidr)
+		if !d.addr && r.ownDeletes[dst] > 0 {
+			// The router's own deletion.
+			if r.ownDeletes[dst]--; r.ownDeletes[dst] == 0 {
+				delete(r.ownDeletes, dst)
+			}
+			continue
+		}
+		_, route := r.routes[dst]
+		if d.addr && containsCIDR(r.local, d.cidr) || !d.addr && route {
+			lost = append(lost, d.cidr)
+		}
+	}
+	if len(lost) == 0 {
+		return
+	}
+	r.logf("%v deleted from %s by something else; adding back", lost, r.tunname)
+	err := r.setRoutes(ctx, r.lastSettings())
+	countResult("repair", err)
+	if err != nil {
+		r.logf("repairing %s failed: %v", r.tunname, err)
+	}
+}
+
+// containsCIDR reports whether cidrs contains c.
+func containsCIDR(cidrs []wgcfg.CIDR, c wgcfg.CIDR) bool {
+	for _, x := range cidrs {
+		if x == c {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2020 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// fakeRouteEvents is a routeEventConn that delivers the messages sent
+// on msgs.
+type fakeRouteEvents struct {
+	msgs   chan []netlink.Message
+	closed chan struct{}
+}
+
+func newFakeRouteEvents() *fakeRouteEvents {
+	return &fakeRouteEvents{msgs: make(chan []netlink.Message), closed: make(chan struct{})}
+}
+
+func (f *fakeRouteEvents) Receive() ([]netlink.Message, error) {
+	select {
+	case m := <-f.msgs:
+		return m, nil
+	case <-f.closed:
+		return nil, errors.New("use of closed connection")
+	}
+}
+
+func (f *fakeRouteEvents) Close() error {
+	close(f.closed)
+	return nil
+}
+
+// delRouteMsg returns the RTM_DELROUTE message the kernel sends when
+// the route to dst on the interface with index ifindex is deleted.
+func delRouteMsg(t *testing.T, dst string, ifindex int) netlink.Message {
+	t.Helper()
+	cidr := mustCIDR(t, dst)
+	family, ip := ipFamilyBytes(cidr.IP.IP())
+	b := make([]byte, unix.SizeofRtMsg)
+	b[0], b[1] = family, cidr.Mask
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.RTA_DST, Data: ip},
+		{Type: unix.RTA_OIF, Data: nlenc.Uint32Bytes(uint32(ifindex))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return netlink.Message{Header: netlink.Header{Type: unix.RTM_DELROUTE}, Data: append(b, attrs...)}
+}
+
+func TestParseRouteDeletion(t *testing.T) {
+	d, ok := parseRouteDeletion(delRouteMsg(t, "10.1.0.0/16", 7))
+	if !ok || d.addr || d.ifindex != 7 || d.cidr != mustCIDR(t, "10.1.0.0/16") {
+		t.Errorf("route: got %+v, %v", d, ok)
+	}
+
+	b := make([]byte, unix.SizeofIfAddrmsg)
+	b[0], b[1] = unix.AF_INET6, 64
+	copy(b[4:], nlenc.Uint32Bytes(7))
+	addr := mustCIDR(t, "fd7a::1/64")
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{{Type: unix.IFA_ADDRESS, Data: addr.IP.IP()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, ok = parseRouteDeletion(netlink.Message{Header: netlink.Header{Type: unix.RTM_DELADDR}, Data: append(b, attrs...)})
+	if !ok || !d.addr || d.ifindex != 7 || d.cidr != addr {
+		t.Errorf("addr: got %+v, %v", d, ok)
+	}
+
+	if _, ok := parseRouteDeletion(netlink.Message{Header: netlink.Header{Type: unix.RTM_NEWROUTE}, Data: b}); ok {
+		t.Error("parsed RTM_NEWROUTE as a deletion")
+	}
+}
+
+func TestLinuxRouterRepairRoutes(t *testing.T) {
+	const readd = "ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"
+	ctx := context.Background()
+	fake := &fakeRunner{}
+	events := newFakeRouteEvents()
+	r := &linuxRouter{
+		logf:            t.Logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		routeRetries:    -1,
+		tunIndex:        7,
+		repairRoutes:    true,
+		dialRouteEvents: func() (routeEventConn, error) { return events, nil },
+	}
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/32", []string{"10.1.0.0/16"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// ran reports, once the watcher has had opMu, whether it has
+	// run c since the last reset.
+	ran := func(c string) bool {
+		r.opMu.Lock()
+		defer r.opMu.Unlock()
+		return fake.ran(c)
+	}
+	r.opMu.Lock()
+	fake.cmds = nil
+	r.opMu.Unlock()
+
+	// Deletions from other interfaces, and of routes that aren't
+	// the router's, are left alone.
+	events.msgs <- []netlink.Message{delRouteMsg(t, "10.1.0.0/16", 3), delRouteMsg(t, "10.9.0.0/16", 7)}
+	events.msgs <- []netlink.Message{delRouteMsg(t, "10.1.0.0/16", 7)}
+	deadline := time.Now().Add(5 * time.Second)
+	for !ran(readd) {
+		if time.Now().After(deadline) {
+			r.opMu.Lock()
+			t.Fatalf("route not added back; ran %q", fake.cmds)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.opMu.Lock()
+	if n := countPrefix(fake.cmds, "ip -o addr show dev tailscale0"); n != 1 {
+		t.Errorf("repaired %d times; want once, for the router's own route", n)
+	}
+	r.opMu.Unlock()
+
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events.closed:
+	default:
+		t.Error("Close didn't stop the watcher")
+	}
+}
+
+func TestLinuxRouterRepairOwnDeletes(t *testing.T) {
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	// The kernel has 10.1.0.0/16 with the default metric, so
+	// SetRoutes changes it by deleting it and adding it back.
+	fake := &fakeRunner{outputs: map[string]string{
+		"ip -o addr show dev tailscale0":           "5: tailscale0    inet 100.101.102.103/10 scope global tailscale0\n",
+		"ip -4 route show dev tailscale0 proto 84": "10.1.0.0/16 via 100.101.102.103\n10.2.0.0/16 via 100.101.102.103 metric 500\n",
+	}}
+	events := newFakeRouteEvents()
+	r := &linuxRouter{
+		logf:            logf,
+		tunname:         "tailscale0",
+		runner:          fake,
+		routeRetries:    -1,
+		routeMetric:     500,
+		tunIndex:        7,
+		repairRoutes:    true,
+		dialRouteEvents: func() (routeEventConn, error) { return events, nil },
+	}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/10", []string{"10.1.0.0/16", "10.2.0.0/16"})); err != nil {
+		t.Fatal(err)
+	}
+	r.opMu.Lock()
+	if !fake.ran("ip route del 10.1.0.0/16 dev tailscale0") {
+		t.Errorf("10.1.0.0/16 not deleted to change its metric; ran %q", fake.cmds)
+	}
+	r.opMu.Unlock()
+
+	// Only the deletion that SetRoutes didn't make is repaired.
+	events.msgs <- []netlink.Message{delRouteMsg(t, "10.1.0.0/16", 7), delRouteMsg(t, "10.2.0.0/16", 7)}
+	const want = "[10.2.0.0/16] deleted from tailscale0 by something else; adding back"
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		var got []string
+		for _, l := range logs {
+			if strings.Contains(l, "by something else") {
+				got = append(got, l)
+			}
+		}
+		mu.Unlock()
+		if len(got) > 0 {
+			if len(got) != 1 || got[0] != want {
+				t.Errorf("logged %q; want %q", got, want)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("deleted route not repaired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinuxRouterRepairNewIndex(t *testing.T) {
+	// The router knows the index from the start when it made the
+	// device, as newUserspaceRouter does, or else from checkTun.
+	for _, tunIndex := range []int{7, 0} {
+		t.Run(fmt.Sprintf("tunIndex=%d", tunIndex), func(t *testing.T) {
+			testRepairNewIndex(t, tunIndex)
+		})
+	}
+}
+
+func testRepairNewIndex(t *testing.T, tunIndex int) {
+	const (
+		show  = "ip -j -d link show dev tailscale0"
+		readd = "ip route add 10.1.0.0/16 via 100.101.102.103 dev tailscale0 src 100.101.102.103 proto 84"
+	)
+	fake := &fakeRunner{outputs: map[string]string{show: tunLinkJSON(7, false)}}
+	var dialed []*fakeRouteEvents // guarded by opMu, which Up and Reload hold
+	r := &linuxRouter{
+		logf:         t.Logf,
+		tunname:      "tailscale0",
+		runner:       fake,
+		routeRetries: -1,
+		tunIndex:     tunIndex,
+		repairRoutes: true,
+		dialRouteEvents: func() (routeEventConn, error) {
+			events := newFakeRouteEvents()
+			dialed = append(dialed, events)
+			return events, nil
+		},
+	}
+	ctx := context.Background()
+	if err := r.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetRoutes(ctx, peerSettings(t, "100.101.102.103/32", []string{"10.1.0.0/16"})); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tun device is deleted and made again, with a new index.
+	r.opMu.Lock()
+	fake.outputs[show] = tunLinkJSON(9, false)
+	r.opMu.Unlock()
+	if err := r.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	r.opMu.Lock()
+	if len(dialed) != 2 {
+		t.Fatalf("dialed %d times; want a new watcher after Reload", len(dialed))
+	}
+	select {
+	case <-dialed[0].closed:
+	default:
+		t.Error("the old watcher wasn't stopped")
+	}
+	fake.cmds = nil
+	events := dialed[1]
+	r.opMu.Unlock()
+
+	events.msgs <- []netlink.Message{delRouteMsg(t, "10.1.0.0/16", 9)}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.opMu.Lock()
+		ok := fake.ran(readd)
+		r.opMu.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("route on the new device not added back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := r.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,45 +5,53 @@
 package wgengine
 
 import (
-	"log"
+	"context"
+	"fmt"
 
 	winipcfg "github.com/tailscale/winipcfg-go"
 	"github.com/tailscale/wireguard-go/device"
 	"github.com/tailscale/wireguard-go/tun"
+	"github.com/tailscale/wireguard-go/wgcfg"
 	"tailscale.com/logger"
 )
 
 type winRouter struct {
-	logf                func(fmt string, args ...interface{})
+	logf                logger.Logf
 	tunname             string
 	dev                 *device.Device
 	nativeTun           *tun.NativeTun
 	routeChangeCallback *winipcfg.RouteChangeCallback
+	adapter             adapterConfig // last applied by SetRoutes
+	last                RouteSettings // last passed to SetRoutes
 }
 
-func NewUserspaceRouter(logf logger.Logf, tunname string, dev *device.Device, tuntap tun.Device, netChanged func()) Router {
+func newUserspaceRouter(opts RouterOptions) (Router, error) {
 	r := winRouter{
-		logf:      logf,
-		tunname:   tunname,
-		dev:       dev,
-		nativeTun: tuntap.(*tun.NativeTun),
+		logf:      opts.Logf,
+		tunname:   opts.TunName,
+		dev:       opts.Device,
+		nativeTun: opts.Tun.(*tun.NativeTun),
 	}
-	return &r
+	return &r, nil
 }
 
-func (r *winRouter) Up() error {
+func (r *winRouter) Up(ctx context.Context) error {
 	// MonitorDefaultRoutes handles making sure our wireguard UDP
 	// traffic goes through the old route, not recursively through the VPN.
 	var err error
-	r.routeChangeCallback, err = MonitorDefaultRoutes(r.dev, true, r.nativeTun)
+	r.routeChangeCallback, err = MonitorDefaultRoutes(r.logf, r.dev, true, r.nativeTun)
 	if err != nil {
-		log.Fatalf("MonitorDefaultRoutes: %v\n", err)
+		return fmt.Errorf("MonitorDefaultRoutes: %v", err)
 	}
 	return nil
 }
 
-func (r *winRouter) SetRoutes(rs RouteSettings) error {
-	err := ConfigureInterface(rs.Cfg, r.nativeTun, rs.DNS, rs.DNSDomains)
+func (r *winRouter) SetRoutes(ctx context.Context, rs RouteSettings) error {
+	if err := rs.Validate(); err != nil {
+		return fmt.Errorf("invalid route settings: %v", err)
+	}
+	r.last = rs
+	err := ConfigureInterface(r.logf, &r.adapter, rs.Cfg, r.nativeTun, rs.DNS, rs.DNSDomains)
 	if err != nil {
 		r.logf("ConfigureInterface: %v\n", err)
 		return err
@@ -51,9 +59,39 @@ func (r *winRouter) SetRoutes(rs RouteSettings) error {
 	return nil
 }
 
-func (r *winRouter) Close() error {
+// Reload applies the last settings passed to SetRoutes from
+// scratch. Default route monitoring, set up by Up, keeps itself
+// going.
+func (r *winRouter) Reload(ctx context.Context) error {
+	if r.last.Cfg == nil {
+		return nil
+	}
+	r.adapter = adapterConfig{}
+	return r.SetRoutes(ctx, r.last)
+}
+
+// Status returns the settings last passed to SetRoutes.
+func (r *winRouter) Status() RouterStatus {
+	routes := make(map[wgcfg.CIDR]struct{})
+	if r.last.Cfg != nil {
+		for _, peer := range r.last.Cfg.Peers {
+			for _, route := range peer.AllowedIPs {
+				routes[route] = struct{}{}
+			}
+		}
+	}
+	return routerStatus(r.last.LocalAddrs, routes, r.last.DNS, r.last.DNSDomains)
+}
+
+// CheckHealth doesn't check anything yet.
+func (r *winRouter) CheckHealth(ctx context.Context) error {
+	return nil
+}
+
+func (r *winRouter) Close(ctx context.Context) error {
 	if r.routeChangeCallback != nil {
 		r.routeChangeCallback.Unregister()
+		r.routeChangeCallback = nil
 	}
 	return nil
 }
@@ -6,6 +6,8 @@ package wgengine
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -51,6 +53,9 @@ func (l *Loggify) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// NewFakeUserspaceEngine returns an Engine with a fake tun device and
+// a Router that leaves the OS networking alone, for running entirely
+// in userspace.
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16, derp bool) (Engine, error) {
 	logf("Starting userspace wireguard engine (FAKE tuntap device).")
 	tun := NewFakeTun()
@@ -72,7 +77,7 @@ func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16, der
 	}
 	logf("CreateTUN ok.\n")
 
-	e, err := NewUserspaceEngineAdvanced(logf, tuntap, NewUserspaceRouter, listenPort, derp)
+	e, err := NewUserspaceEngineAdvanced(logf, tuntap, NewRouter, listenPort, derp)
 	if err != nil {
 		logf("NewUserspaceEngineAdv: %v\n", err)
 		return nil, err
@@ -80,7 +85,9 @@ func NewUserspaceEngine(logf logger.Logf, tunname string, listenPort uint16, der
 	return e, err
 }
 
-type RouterGen func(logf logger.Logf, tunname string, dev *device.Device, tuntap tun.Device, netStateChanged func()) Router
+// RouterGen makes the Router for an engine. The engine fills in the
+// Logf, TunName, Device, Tun and NetChanged fields of opts.
+type RouterGen func(opts RouterOptions) (Router, error)
 
 func NewUserspaceEngineAdvanced(logf logger.Logf, tuntap tun.Device, routerGen RouterGen, listenPort uint16, derp bool) (Engine, error) {
 	e := &userspaceEngine{
@@ -177,13 +184,23 @@ func NewUserspaceEngineAdvanced(logf logger.Logf, tuntap tun.Device, routerGen R
 		}
 	}()
 
-	e.router = routerGen(logf, tunname, e.wgdev, e.tuntap, func() { e.LinkChange(false) })
+	e.router, err = routerGen(RouterOptions{
+		Logf:       logf,
+		TunName:    tunname,
+		Device:     e.wgdev,
+		Tun:        e.tuntap,
+		NetChanged: func() { e.LinkChange(false) },
+	})
+	if err != nil {
+		e.wgdev.Close()
+		return nil, err
+	}
 	e.wgdev.Up()
-	if err := e.router.Up(); err != nil {
+	if err := e.router.Up(context.Background()); err != nil {
 		e.wgdev.Close()
 		return nil, err
 	}
-	if err := e.router.SetRoutes(RouteSettings{Cfg: new(wgcfg.Config)}); err != nil {
+	if err := e.router.SetRoutes(context.Background(), RouteSettings{Cfg: new(wgcfg.Config)}); err != nil {
 		e.wgdev.Close()
 		return nil, err
 	}
@@ -228,23 +245,23 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, dnsDomains []string) error
 		e.logf("magicsock: %v\n", err)
 	}
 
-	// TODO(apenwarr): only handling the first local address.
-	//   Currently we never use more than one anyway.
-	var cidr wgcfg.CIDR
-	if len(cfg.Interface.Addresses) > 0 {
-		cidr = cfg.Interface.Addresses[0]
-		// TODO(apenwarr): this shouldn't be hardcoded in the client
-		cidr.Mask = 10 // route the whole cgnat range
+	var addrs []wgcfg.CIDR
+	for _, cidr := range cfg.Interface.Addresses {
+		if cidr.IP.Is4() {
+			// TODO(apenwarr): this shouldn't be hardcoded in the client
+			cidr.Mask = 10 // route the whole cgnat range
+		}
+		addrs = append(addrs, cidr)
 	}
 
 	rs := RouteSettings{
-		LocalAddr:  cidr,
+		LocalAddrs: addrs,
 		Cfg:        cfg,
 		DNS:        cfg.Interface.Dns,
 		DNSDomains: dnsDomains,
 	}
 	e.logf("Reconfiguring router. la=%v dns=%v dom=%v\n",
-		rs.LocalAddr, rs.DNS, rs.DNSDomains)
+		rs.LocalAddrs, rs.DNS, rs.DNSDomains)
 
 	// TODO(apenwarr): all the parts of RouteSettings should be "relevant."
 	// We're checking only the "relevant" parts to see if they have
@@ -260,7 +277,12 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, dnsDomains []string) error
 		return nil
 	}
 	e.lastRoutes = rss
-	err = e.router.SetRoutes(rs)
+	err = e.router.SetRoutes(context.Background(), rs)
+	if errors.Is(err, ErrInterfaceGone) {
+		// Don't skip the same routes next time, once the
+		// tun device is back.
+		e.lastRoutes = ""
+	}
 	e.logf("Reconfig() done.\n")
 	return err
 }
@@ -444,9 +466,16 @@ func (e *userspaceEngine) RequestStatus() {
 	}
 }
 
+// routerCloseTimeout is how long Close waits for the router to undo
+// its system configuration, so that a stuck command can't hang
+// shutdown.
+const routerCloseTimeout = 10 * time.Second
+
 func (e *userspaceEngine) Close() {
 	e.Reconfig(&wgcfg.Config{}, nil)
-	e.router.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), routerCloseTimeout)
+	defer cancel()
+	e.router.Close(ctx)
 	e.magicConn.Close()
 	close(e.waitCh)
 }
@@ -5,8 +5,13 @@
 package wgengine
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/tailscale/wireguard-go/wgcfg"
@@ -42,10 +47,24 @@ type StatusCallback func(*Status, error)
 // IP, etc in wgcfg.Config) plus the things that WireGuard doesn't do
 // itself, like DNS stuff.
 type RouteSettings struct {
-	LocalAddr  wgcfg.CIDR // TODO: why is this here? how does it differ from wgcfg.Config's info?
+	LocalAddrs []wgcfg.CIDR // TODO: why is this here? how does it differ from wgcfg.Config's info?
 	DNS        []net.IP
 	DNSDomains []string
 	Cfg        *wgcfg.Config
+
+	// NextHops optionally sets the gateway for the routes to some
+	// of the peers' AllowedIPs, such as a peer's own Tailscale IP.
+	// Other routes go via the local address of their family. Only
+	// the Linux router supports it.
+	NextHops map[wgcfg.CIDR]wgcfg.IP
+
+	// Blackholes are networks whose traffic is dropped by
+	// "blackhole" routes, so that it doesn't leak to the underlay
+	// when no peer's route covers it. With RejectBlackholes, the
+	// routes are "unreachable" ones instead, which reject packets
+	// with an ICMP error. Only the Linux router supports them.
+	Blackholes       []wgcfg.CIDR
+	RejectBlackholes bool
 }
 
 // OnlyRelevantParts returns a string minimally describing the route settings.
@@ -54,26 +73,445 @@ func (rs *RouteSettings) OnlyRelevantParts() string {
 	for _, p := range rs.Cfg.Peers {
 		peers = append(peers, p.AllowedIPs)
 	}
-	return fmt.Sprintf("%v %v %v %v",
-		rs.LocalAddr, rs.DNS, rs.DNSDomains, peers)
+	return fmt.Sprintf("%v %v %v %v %v %v %v",
+		rs.LocalAddrs, rs.DNS, rs.DNSDomains, peers, rs.NextHops, rs.Blackholes, rs.RejectBlackholes)
+}
+
+// clone returns a copy of rs that shares no slices or maps with it.
+func (rs *RouteSettings) clone() RouteSettings {
+	c := *rs
+	c.LocalAddrs = append([]wgcfg.CIDR(nil), rs.LocalAddrs...)
+	c.DNS = append([]net.IP(nil), rs.DNS...)
+	c.DNSDomains = append([]string(nil), rs.DNSDomains...)
+	c.Blackholes = append([]wgcfg.CIDR(nil), rs.Blackholes...)
+	if rs.NextHops != nil {
+		c.NextHops = make(map[wgcfg.CIDR]wgcfg.IP, len(rs.NextHops))
+		for dst, via := range rs.NextHops {
+			c.NextHops[dst] = via
+		}
+	}
+	if rs.Cfg != nil {
+		cfg := *rs.Cfg
+		cfg.Interface.Addresses = append([]wgcfg.CIDR(nil), rs.Cfg.Interface.Addresses...)
+		cfg.Peers = make([]wgcfg.Peer, len(rs.Cfg.Peers))
+		for i, p := range rs.Cfg.Peers {
+			p.AllowedIPs = append([]wgcfg.CIDR(nil), p.AllowedIPs...)
+			cfg.Peers[i] = p
+		}
+		c.Cfg = &cfg
+	}
+	return c
+}
+
+// Validate returns an error if rs can't be applied as it is, so that
+// a Router can reject it before changing anything. Allowed IPs may
+// have host bits set; routers clear them.
+func (rs *RouteSettings) Validate() error {
+	if rs.Cfg == nil {
+		return errors.New("no WireGuard config")
+	}
+	for _, addr := range rs.LocalAddrs {
+		if addr.IP.IP().IsUnspecified() {
+			return fmt.Errorf("local address %v is unspecified", addr)
+		}
+		if err := checkMask(addr); err != nil {
+			return fmt.Errorf("local address %v: %v", addr, err)
+		}
+	}
+	routes := false
+	for _, peer := range rs.Cfg.Peers {
+		for _, allowed := range peer.AllowedIPs {
+			if err := checkMask(allowed); err != nil {
+				return fmt.Errorf("allowed IP %v of peer %v: %v", allowed, peer.PublicKey.ShortString(), err)
+			}
+			routes = true
+		}
+	}
+	if routes && len(rs.LocalAddrs) == 0 {
+		return errors.New("peers have allowed IPs but there's no local address")
+	}
+	for dst, via := range rs.NextHops {
+		if err := checkMask(dst); err != nil {
+			return fmt.Errorf("next hop destination %v: %v", dst, err)
+		}
+		if via.Is4() != dst.IP.Is4() {
+			return fmt.Errorf("next hop %v for %v is in the other address family", via, dst)
+		}
+	}
+	for _, dst := range rs.Blackholes {
+		if err := checkMask(dst); err != nil {
+			return fmt.Errorf("blackhole %v: %v", dst, err)
+		}
+	}
+	for _, ip := range rs.DNS {
+		if ip.To16() == nil {
+			return fmt.Errorf("invalid DNS server %q", ip)
+		}
+	}
+	return nil
+}
+
+// checkMask returns an error if c's mask is longer than its address.
+func checkMask(c wgcfg.CIDR) error {
+	bits := 128
+	if c.IP.Is4() {
+		bits = 32
+	}
+	if int(c.Mask) > bits {
+		return fmt.Errorf("mask /%d is longer than the address", c.Mask)
+	}
+	return nil
+}
+
+// MultiError is an error made up of several independent failures,
+// such as a Router failing to add more than one route.
+type MultiError []error
+
+func (e MultiError) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d errors:", len(e))
+	for _, err := range e {
+		b.WriteString("\n\t")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+// Is reports whether any of e's errors is target, so that errors.Is
+// finds sentinels such as ErrInterfaceGone among them.
+func (e MultiError) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteOpError is a route that a Router failed to add or delete.
+// SetRoutes returns them among the errors of a MultiError, for
+// FailedRoutes to find.
+type RouteOpError struct {
+	Add bool // whether adding the route failed, rather than deleting it
+	Dst wgcfg.CIDR
+	Err error
+}
+
+func (e *RouteOpError) Error() string { return e.Err.Error() }
+func (e *RouteOpError) Unwrap() error { return e.Err }
+
+// FailedRoutes returns the routes that err, as returned by SetRoutes,
+// reports couldn't be added and deleted, so that the caller can retry
+// only those.
+func FailedRoutes(err error) (adds, dels []wgcfg.CIDR) {
+	errs, ok := err.(MultiError)
+	if !ok && err != nil {
+		errs = MultiError{err}
+	}
+	for _, err := range errs {
+		var re *RouteOpError
+		if !errors.As(err, &re) {
+			continue
+		}
+		if re.Add {
+			adds = append(adds, re.Dst)
+		} else {
+			dels = append(dels, re.Dst)
+		}
+	}
+	return adds, dels
+}
+
+// errOrNil returns e as an error, or nil if e has no errors.
+func (e MultiError) errOrNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// routerStatus returns a RouterStatus for a router with the local
+// addresses local, routes (which may have host bits set) and DNS
+// settings. It copies everything, so the router can go on changing
+// them.
+func routerStatus(local []wgcfg.CIDR, routes map[wgcfg.CIDR]struct{}, dns []net.IP, dnsDomains []string) RouterStatus {
+	masked := make(map[wgcfg.CIDR]struct{}, len(routes))
+	for route := range routes {
+		masked[networkCIDR(route)] = struct{}{}
+	}
+	return RouterStatus{
+		LocalAddrs: append([]wgcfg.CIDR(nil), local...),
+		Routes:     sortedCIDRs(masked),
+		DNS:        append([]net.IP(nil), dns...),
+		DNSDomains: append([]string(nil), dnsDomains...),
+	}
+}
+
+// sortedCIDRs returns the CIDRs in m, sorted by address and then
+// mask.
+func sortedCIDRs(m map[wgcfg.CIDR]struct{}) []wgcfg.CIDR {
+	ret := make([]wgcfg.CIDR, 0, len(m))
+	for c := range m {
+		ret = append(ret, c)
+	}
+	sortCIDRs(ret)
+	return ret
+}
+
+// sortCIDRs sorts cidrs by address, then by mask length.
+func sortCIDRs(cidrs []wgcfg.CIDR) {
+	sort.Slice(cidrs, func(i, j int) bool {
+		if c := bytes.Compare(cidrs[i].IP.Addr[:], cidrs[j].IP.Addr[:]); c != 0 {
+			return c < 0
+		}
+		return cidrs[i].Mask < cidrs[j].Mask
+	})
+}
+
+// routeChanges returns the routes in old that aren't in new, and
+// those in new that aren't in old, each sorted as by sortedCIDRs.
+func routeChanges(old, new map[wgcfg.CIDR]struct{}) (del, add []wgcfg.CIDR) {
+	for _, route := range sortedCIDRs(old) {
+		if _, ok := new[route]; !ok {
+			del = append(del, route)
+		}
+	}
+	for _, route := range sortedCIDRs(new) {
+		if _, ok := old[route]; !ok {
+			add = append(add, route)
+		}
+	}
+	return del, add
+}
+
+// addrChanges returns the addresses in old that aren't in new, and
+// those in new that aren't in old, each in their original order.
+func addrChanges(old, new []wgcfg.CIDR) (del, add []wgcfg.CIDR) {
+	in := func(addrs []wgcfg.CIDR, addr wgcfg.CIDR) bool {
+		for _, a := range addrs {
+			if a == addr {
+				return true
+			}
+		}
+		return false
+	}
+	for _, addr := range old {
+		if !in(new, addr) {
+			del = append(del, addr)
+		}
+	}
+	for _, addr := range new {
+		if !in(old, addr) && !in(add, addr) {
+			add = append(add, addr)
+		}
+	}
+	return del, add
+}
+
+// localIP returns the first of the local addresses addrs in the same
+// address family as dst, failing that the first of them, or the zero
+// IP if addrs is empty.
+func localIP(addrs []wgcfg.CIDR, dst wgcfg.CIDR) wgcfg.IP {
+	for _, addr := range addrs {
+		if addr.IP.Is4() == dst.IP.Is4() {
+			return addr.IP
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0].IP
+	}
+	return wgcfg.IP{}
+}
+
+// networkCIDR returns c with its host bits cleared.
+func networkCIDR(c wgcfg.CIDR) wgcfg.CIDR {
+	ipnet := c.IPNet()
+	copy(c.IP.Addr[:], ipnet.IP.Mask(ipnet.Mask).To16())
+	return c
+}
+
+// linkScopeRanges are the link-local and multicast networks. Their
+// traffic belongs to the links it's on, for protocols such as ARP,
+// NDP, DHCP and mDNS, so routing it into the tun device would break
+// them.
+var linkScopeRanges = mustParseCIDRs("169.254.0.0/16", "224.0.0.0/4", "fe80::/10", "ff00::/8")
+
+// mustParseCIDRs parses each of ss, panicking if one isn't a CIDR.
+func mustParseCIDRs(ss ...string) []wgcfg.CIDR {
+	var ret []wgcfg.CIDR
+	for _, s := range ss {
+		cidr, err := wgcfg.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		ret = append(ret, *cidr)
+	}
+	return ret
+}
+
+// isLinkScope reports whether dst is inside one of linkScopeRanges.
+func isLinkScope(dst wgcfg.CIDR) bool {
+	for _, lr := range linkScopeRanges {
+		if cidrContains(lr, dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// cidrContains reports whether every address in inner is in outer.
+func cidrContains(outer, inner wgcfg.CIDR) bool {
+	return outer.IP.Is4() == inner.IP.Is4() && outer.Mask <= inner.Mask && outer.IPNet().Contains(inner.IP.IP())
+}
+
+// canonicalCIDR returns the network c is in, in the "addr/len" form
+// that ip(8) and route(8) take, which reject host bits.
+func canonicalCIDR(c wgcfg.CIDR) string {
+	return networkCIDR(c).String()
+}
+
+// sameIPs reports whether a and b hold the same IPs in the same order.
+func sameIPs(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// sameStrings reports whether a and b are equal.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // Router is responsible for managing the system route table.
 //
 // There's only one instance, and one per-OS implementation.
+//
+// Each method gives up, and returns an error, if its ctx is done
+// before the system has been configured.
 type Router interface {
 	// Up brings the router up.
-	Up() error
+	Up(ctx context.Context) error
 
 	// SetRoutes is called regularly on network map updates.
 	// It's how you kernel route table entries are populated for
 	// each peer.
-	SetRoutes(RouteSettings) error
+	//
+	// If the tun device has disappeared, it returns
+	// ErrInterfaceGone.
+	SetRoutes(ctx context.Context, rs RouteSettings) error
+
+	// Reload applies the settings from Up and the last SetRoutes
+	// again, putting back whatever something else, such as a
+	// network manager or the tun device going down and up, has
+	// removed from the system.
+	Reload(ctx context.Context) error
+
+	// Status returns a snapshot of what the router has configured
+	// the system with. It doesn't touch the system, so it's cheap.
+	Status() RouterStatus
+
+	// CheckHealth reports whether the system still has what the
+	// router configured it with, which other tools can remove. The
+	// error lists what's missing.
+	CheckHealth(ctx context.Context) error
 
 	// Close closes the router.
-	Close() error
+	Close(ctx context.Context) error
+}
+
+// RouterStatus is what a Router has configured the system with.
+type RouterStatus struct {
+	LocalAddrs []wgcfg.CIDR
+	Routes     []wgcfg.CIDR // sorted, with host bits cleared
+	DNS        []net.IP
+	DNSDomains []string
+}
+
+// TunState is the tun device's settings as the kernel has them,
+// which may differ from what the router asked for, such as when the
+// MTU was clamped.
+type TunState struct {
+	MTU   int
+	Addrs []wgcfg.CIDR
+}
+
+// TunStateReader is implemented by Routers that can read the tun
+// device's settings back from the kernel.
+type TunStateReader interface {
+	// TunState queries the tun device for its current settings.
+	TunState(ctx context.Context) (TunState, error)
+}
+
+// PathMTUSetter is implemented by Routers that can size the tun
+// device's MTU to fit the underlay path.
+type PathMTUSetter interface {
+	// SetPathMTU sets the tun device's MTU for an underlay path
+	// MTU of pathMTU, such as the engine has measured, so that a
+	// full-size tun packet still fits once WireGuard wraps it.
+	SetPathMTU(ctx context.Context, pathMTU int) error
 }
 
+// FirewallRepairer is implemented by Routers that can install their
+// firewall rules again by themselves, for when other tools flush
+// them.
+type FirewallRepairer interface {
+	// RepairFirewall adds back whichever of the router's firewall
+	// rules are missing, leaving those that are still there, and
+	// the tun device's addresses and routes, alone.
+	RepairFirewall(ctx context.Context) error
+}
+
+// Bounds on the tun MTU picked for an underlay path MTU. Below the
+// IPv6 minimum, IPv6 can't be used over the tun device at all; above
+// what a 9000-byte jumbo frame fits, the underlay is unlikely to
+// really carry it.
+const (
+	minTunMTU = 1280
+	maxTunMTU = 9000 - wgOverhead
+)
+
+// wgOverhead is how much bigger WireGuard makes a packet over an IPv6
+// underlay, the worse case: a 40-byte IPv6 header, an 8-byte UDP
+// header, and 32 bytes of WireGuard header and authentication tag.
+const wgOverhead = 80
+
+// tunMTUForPath returns the tun MTU for an underlay path MTU of
+// pathMTU, clamped to minTunMTU and maxTunMTU.
+func tunMTUForPath(pathMTU int) int {
+	mtu := pathMTU - wgOverhead
+	if mtu < minTunMTU {
+		return minTunMTU
+	}
+	if mtu > maxTunMTU {
+		return maxTunMTU
+	}
+	return mtu
+}
+
+// ErrInterfaceGone is returned by Router.SetRoutes when the tun
+// device no longer exists, such as after its driver is reloaded or
+// it's deleted by hand. The router forgets the device's state, so
+// the next SetRoutes with the recreated device configures it again
+// from scratch.
+var ErrInterfaceGone = errors.New("tun device is gone")
+
 // Engine is the Tailscale WireGuard engine interface.
 type Engine interface {
 	// Reconfig reconfigures WireGuard and makes sure it's running.